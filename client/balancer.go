@@ -0,0 +1,370 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"syscall"
+	"time"
+
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// StrategyRoundRobin selects the healthy endpoints in turns
+	StrategyRoundRobin = 0
+	// StrategyLatency selects the healthy endpoint with the lowest latency
+	StrategyLatency = 1
+
+	// DefaultMaxRetries is the default number of retries of a failed request
+	DefaultMaxRetries = 3
+	// DefaultRetryBackoff is the default wait before the first retry, doubled on each attempt
+	DefaultRetryBackoff = 200 * time.Millisecond
+
+	// latencyWeight is the weight of the last sample on the latency moving average
+	latencyWeight = 0.2
+)
+
+// ErrNoEndpoints is returned when the balancer has no endpoints configured
+var ErrNoEndpoints = errors.New("no endpoints available")
+
+type methodKey struct{}
+
+// withMethod returns a context holding the request method name
+func withMethod(ctx context.Context, method string) context.Context {
+	return context.WithValue(ctx, methodKey{}, method)
+}
+
+// MethodFromContext returns the method name of the request being sent, if known
+func MethodFromContext(ctx context.Context) string {
+	method, _ := ctx.Value(methodKey{}).(string)
+	return method
+}
+
+// Endpoint is a multirpc server the balancer can send requests to
+type Endpoint struct {
+	Name      string
+	Transport Transport
+	// HealthCheck is executed periodically by the balancer. If nil, the
+	// endpoint health is only updated by the result of the requests.
+	HealthCheck func(ctx context.Context) error
+
+	healthy   bool
+	latency   time.Duration
+	failures  int
+	lastError error
+	lastCheck time.Time
+}
+
+// EndpointHealth is a snapshot of the health of an endpoint
+type EndpointHealth struct {
+	Name      string        `json:"name"`
+	Healthy   bool          `json:"healthy"`
+	Latency   time.Duration `json:"latency"`
+	Failures  int           `json:"failures"`
+	LastError string        `json:"lastError,omitempty"`
+	LastCheck time.Time     `json:"lastCheck"`
+}
+
+// Balancer is a client Transport distributing the requests among several
+// endpoints. If the request fails because of a transport error the endpoint
+// is marked as unhealthy, and the request is retried on another endpoint
+// if the method is idempotent or the request could not reach the endpoint.
+type Balancer struct {
+	Strategy     int
+	MaxRetries   int
+	RetryBackoff time.Duration
+
+	endpoints  []*Endpoint
+	idempotent map[string]bool
+	next       int
+	lock       sync.RWMutex
+	cancel     context.CancelFunc
+}
+
+// NewBalancer creates a new balancer using the given selection strategy.
+// If healthCheckInterval is not zero, the endpoints are checked periodically,
+// and the unhealthy endpoints without HealthCheck are given a new chance.
+func NewBalancer(strategy int, healthCheckInterval time.Duration, endpoints ...*Endpoint) *Balancer {
+	b := &Balancer{
+		Strategy:     strategy,
+		MaxRetries:   DefaultMaxRetries,
+		RetryBackoff: DefaultRetryBackoff,
+		endpoints:    endpoints,
+		idempotent:   make(map[string]bool),
+	}
+	for _, e := range endpoints {
+		e.healthy = true
+	}
+	var ctx context.Context
+	ctx, b.cancel = context.WithCancel(context.Background())
+	if healthCheckInterval > 0 {
+		go b.healthChecker(ctx, healthCheckInterval)
+	}
+	return b
+}
+
+// NewHTTPBalancer creates a round robin balancer for a list of HTTP namespace
+// URLs, checking their health on heartbeatPath (the HeartbeatPath of the
+// proxy, /ping by default). If heartbeatPath is empty the endpoints health is
+// only updated by the result of the requests.
+func NewHTTPBalancer(urls []string, heartbeatPath string, healthCheckInterval time.Duration) (*Balancer, error) {
+	var endpoints []*Endpoint
+	for _, u := range urls {
+		e := &Endpoint{Name: u, Transport: NewHTTPTransport(u, nil)}
+		if heartbeatPath != "" {
+			hc, err := HTTPHealthCheck(u, heartbeatPath, nil)
+			if err != nil {
+				return nil, err
+			}
+			e.HealthCheck = hc
+		}
+		endpoints = append(endpoints, e)
+	}
+	return NewBalancer(StrategyRoundRobin, healthCheckInterval, endpoints...), nil
+}
+
+// HTTPHealthCheck returns a health check function making a GET request to the
+// path of the host serving the namespace URL. Any status but 200 is an error.
+func HTTPHealthCheck(namespaceURL, path string, httpClient *http.Client) (func(ctx context.Context) error, error) {
+	u, err := url.Parse(namespaceURL)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	u.Path = path
+	u.RawQuery = ""
+	checkURL := u.String()
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, "GET", checkURL, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("health check returned %s", resp.Status)
+		}
+		return nil
+	}, nil
+}
+
+// SetIdempotent marks the methods that can be safely retried on another endpoint
+func (b *Balancer) SetIdempotent(methods ...string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for _, m := range methods {
+		b.idempotent[m] = true
+	}
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (b *Balancer) ConnectionType() string {
+	return "Balancer"
+}
+
+// Request sends the data to one of the endpoints, failing over to the next one
+// if the transport returns an error. The requests of the methods not marked
+// as idempotent are only sent again if they could not reach the endpoint.
+func (b *Balancer) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	b.lock.RLock()
+	idempotent := b.idempotent[MethodFromContext(ctx)]
+	retries := b.MaxRetries
+	b.lock.RUnlock()
+
+	var lastErr error
+	tried := make(map[*Endpoint]bool)
+	for attempt := 0; attempt <= retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(b.RetryBackoff << uint(attempt-1)):
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		e := b.pick(tried)
+		if e == nil {
+			return nil, ErrNoEndpoints
+		}
+		tried[e] = true
+		start := time.Now()
+		reply, err := e.Transport.Request(ctx, id, data)
+		b.report(e, time.Since(start), err)
+		if err == nil {
+			return reply, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		log.Debugf("request %s failed on endpoint %s: %v", id, e.Name, err)
+		lastErr = fmt.Errorf("%s: %w", e.Name, err)
+		if !idempotent && !isConnectionError(err) {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// isConnectionError reports whether err means the request could not reach
+// the endpoint, so it can be sent to another one even if not idempotent
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED)
+}
+
+// pick selects the next endpoint, preferring the healthy ones not tried yet
+func (b *Balancer) pick(tried map[*Endpoint]bool) *Endpoint {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.endpoints) == 0 {
+		return nil
+	}
+	var candidates []*Endpoint
+	for _, e := range b.endpoints {
+		if e.healthy && !tried[e] {
+			candidates = append(candidates, e)
+		}
+	}
+	if len(candidates) == 0 {
+		for _, e := range b.endpoints {
+			if !tried[e] {
+				candidates = append(candidates, e)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = b.endpoints
+	}
+	if b.Strategy == StrategyLatency {
+		best := candidates[0]
+		for _, e := range candidates[1:] {
+			if e.latency < best.latency {
+				best = e
+			}
+		}
+		return best
+	}
+	b.next = (b.next + 1) % len(candidates)
+	return candidates[b.next]
+}
+
+// report updates the endpoint health with the result of a request or check
+func (b *Balancer) report(e *Endpoint, latency time.Duration, err error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	e.lastCheck = time.Now()
+	if err != nil {
+		e.healthy = false
+		e.failures++
+		e.lastError = err
+		return
+	}
+	if !e.healthy {
+		log.Infof("endpoint %s is healthy again", e.Name)
+	}
+	e.healthy = true
+	e.failures = 0
+	e.lastError = nil
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = time.Duration(latencyWeight*float64(latency) + (1-latencyWeight)*float64(e.latency))
+	}
+}
+
+func (b *Balancer) healthChecker(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		b.lock.RLock()
+		endpoints := append([]*Endpoint(nil), b.endpoints...)
+		b.lock.RUnlock()
+		for _, e := range endpoints {
+			if e.HealthCheck == nil {
+				// Give a new chance to the passive endpoints
+				b.lock.Lock()
+				e.healthy = true
+				b.lock.Unlock()
+				continue
+			}
+			tctx, cancel := context.WithTimeout(ctx, interval)
+			start := time.Now()
+			err := e.HealthCheck(tctx)
+			cancel()
+			if err != nil {
+				log.Debugf("endpoint %s health check failed: %v", e.Name, err)
+			}
+			b.report(e, time.Since(start), err)
+		}
+	}
+}
+
+// Health returns the current health of all the endpoints
+func (b *Balancer) Health() []EndpointHealth {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	health := make([]EndpointHealth, 0, len(b.endpoints))
+	for _, e := range b.endpoints {
+		eh := EndpointHealth{
+			Name:      e.Name,
+			Healthy:   e.healthy,
+			Latency:   e.latency,
+			Failures:  e.failures,
+			LastCheck: e.lastCheck,
+		}
+		if e.lastError != nil {
+			eh.LastError = e.lastError.Error()
+		}
+		health = append(health, eh)
+	}
+	return health
+}
+
+// HealthHandler returns an HTTP handler serving the endpoints health as JSON
+func (b *Balancer) HealthHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.Marshal(b.Health())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	}
+}
+
+// Close stops the health checks and closes all the endpoint transports
+func (b *Balancer) Close() error {
+	b.cancel()
+	var firstErr error
+	for _, e := range b.endpoints {
+		if err := e.Transport.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
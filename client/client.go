@@ -0,0 +1,252 @@
+// Package client provides a Go client for multirpc servers
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/multirpc/router"
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/crypto"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/log"
+)
+
+// IDLength is the number of random bytes used for the request identifiers
+const IDLength = 16
+
+// Transport is the network layer used by the client for sending the signed
+// requests and fetching the replies.
+type Transport interface {
+	// Request sends the request payload identified by id and returns the payload of its reply.
+	Request(ctx context.Context, id string, data []byte) ([]byte, error)
+	// ConnectionType returns the human readable name for the client transport.
+	ConnectionType() string
+	// Close terminates the connection with the server.
+	Close() error
+}
+
+// Subscriber is implemented by the transports able to keep subscription
+// requests alive across reconnections.
+type Subscriber interface {
+	Subscribe(ctx context.Context, id string, data []byte) ([]byte, error)
+	Unsubscribe(id string)
+}
+
+// Client signs and sends requests to a multirpc server and verifies its replies
+type Client struct {
+	Transport Transport
+	Signer    *ethereum.SignKeys
+
+	messageType func() transports.MessageAPI
+	serverAddr  *ethcommon.Address
+	lock        sync.RWMutex
+}
+
+// New creates a new client using the transport t. If signer is nil, the requests
+// are sent without signature (only methods with skipSignature can be called).
+// The messageTypeFunc is the same function provided to the router, used for
+// unmarshaling the replies.
+func New(t Transport, signer *ethereum.SignKeys, messageTypeFunc func() transports.MessageAPI) *Client {
+	return &Client{
+		Transport:   t,
+		Signer:      signer,
+		messageType: messageTypeFunc,
+	}
+}
+
+// PinServerAddress sets the expected signer address of the server replies.
+// Once pinned, any reply not signed by this address is rejected.
+func (c *Client) PinServerAddress(addr ethcommon.Address) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.serverAddr = &addr
+}
+
+// ServerAddress returns the pinned server address, if any
+func (c *Client) ServerAddress() (ethcommon.Address, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.serverAddr == nil {
+		return ethcommon.Address{}, false
+	}
+	return *c.serverAddr, true
+}
+
+// NewID returns a new random request identifier
+func NewID() string {
+	id := make([]byte, IDLength)
+	if _, err := rand.Read(id); err != nil {
+		// This should never happen, crypto/rand does not fail on supported platforms.
+		panic(err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// Request signs and sends the request message and waits for its reply.
+// The request ID and timestamp are set by the client. If the server replies
+// with an error, the reply is returned along with an *Error.
+func (c *Client) Request(ctx context.Context, req transports.MessageAPI) (transports.MessageAPI, error) {
+	id := NewID()
+	data, err := c.BuildRequest(id, req)
+	if err != nil {
+		return nil, err
+	}
+	log.Debugf("sending request %s: %s", id, data)
+	respData, err := c.Transport.Request(withMethod(ctx, req.GetMethod()), id, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", req.GetMethod(), err)
+	}
+	log.Debugf("received reply %s: %s", id, respData)
+	return c.ParseReply(id, req.GetMethod(), respData)
+}
+
+// Subscribe sends the request as Request does, but the transport keeps it for
+// sending it again after each reconnection. It returns the subscription ID,
+// which can be used for Unsubscribe.
+func (c *Client) Subscribe(ctx context.Context, req transports.MessageAPI) (string, transports.MessageAPI, error) {
+	sub, ok := c.Transport.(Subscriber)
+	if !ok {
+		return "", nil, fmt.Errorf("transport %s does not support subscriptions", c.Transport.ConnectionType())
+	}
+	id := NewID()
+	data, err := c.BuildRequest(id, req)
+	if err != nil {
+		return "", nil, err
+	}
+	respData, err := sub.Subscribe(withMethod(ctx, req.GetMethod()), id, data)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: %w", req.GetMethod(), err)
+	}
+	resp, err := c.ParseReply(id, req.GetMethod(), respData)
+	if err != nil {
+		sub.Unsubscribe(id)
+	}
+	return id, resp, err
+}
+
+// Unsubscribe stops renewing the subscription identified by id
+func (c *Client) Unsubscribe(id string) {
+	if sub, ok := c.Transport.(Subscriber); ok {
+		sub.Unsubscribe(id)
+	}
+}
+
+// BuildRequest sets the ID and timestamp of req and returns the signed
+// request envelope, ready to be sent to the server.
+func (c *Client) BuildRequest(id string, req transports.MessageAPI) ([]byte, error) {
+	req.SetID(id)
+	req.SetTimestamp(int32(time.Now().Unix()))
+	reqInner, err := crypto.SortedMarshalJSON(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", req.GetMethod(), err)
+	}
+	var signature []byte
+	if c.Signer != nil {
+		if signature, err = c.Signer.Sign(reqInner); err != nil {
+			return nil, fmt.Errorf("%s: cannot sign request: %w", req.GetMethod(), err)
+		}
+	}
+	return json.Marshal(router.RequestMessage{
+		ID:         id,
+		Signature:  signature,
+		MessageAPI: reqInner,
+	})
+}
+
+// ParseReply decodes and verifies the reply of the request identified by id
+func (c *Client) ParseReply(id, method string, data []byte) (transports.MessageAPI, error) {
+	var respOuter router.ResponseMessage
+	if err := json.Unmarshal(data, &respOuter); err != nil {
+		return nil, fmt.Errorf("%s: cannot unmarshal reply: %w", method, err)
+	}
+	if respOuter.ID != id {
+		return nil, fmt.Errorf("%s: %w (got %q)", method, ErrIDMismatch, respOuter.ID)
+	}
+	if err := c.verify(respOuter.MessageAPI, respOuter.Signature); err != nil {
+		return nil, fmt.Errorf("%s: %w", method, err)
+	}
+	resp := c.messageType()
+	if err := json.Unmarshal(respOuter.MessageAPI, resp); err != nil {
+		return nil, fmt.Errorf("%s: cannot unmarshal reply: %w", method, err)
+	}
+	if errMsg := replyError(resp, respOuter.MessageAPI); errMsg != "" {
+		return resp, newError(method, errMsg)
+	}
+	return resp, nil
+}
+
+// ParseRequest decodes and verifies a request sent by the server (see
+// router.Call), returning its ID and message
+func (c *Client) ParseRequest(data []byte) (string, transports.MessageAPI, error) {
+	var reqOuter router.RequestMessage
+	if err := json.Unmarshal(data, &reqOuter); err != nil {
+		return "", nil, fmt.Errorf("cannot unmarshal server request: %w", err)
+	}
+	if len(reqOuter.MessageAPI) == 0 {
+		return "", nil, fmt.Errorf("message is not a server request")
+	}
+	if err := c.verify(reqOuter.MessageAPI, reqOuter.Signature); err != nil {
+		return "", nil, err
+	}
+	req := c.messageType()
+	if err := json.Unmarshal(reqOuter.MessageAPI, req); err != nil {
+		return "", nil, fmt.Errorf("cannot unmarshal server request: %w", err)
+	}
+	if req.GetID() != reqOuter.ID {
+		return "", nil, fmt.Errorf("server request message ID %q does not match %q", req.GetID(), reqOuter.ID)
+	}
+	return reqOuter.ID, req, nil
+}
+
+// BuildReply sets the ID and timestamp of resp and returns the signed reply
+// envelope of the server request identified by id
+func (c *Client) BuildReply(id string, resp transports.MessageAPI) ([]byte, error) {
+	resp.SetID(id)
+	resp.SetTimestamp(int32(time.Now().Unix()))
+	respInner, err := crypto.SortedMarshalJSON(resp)
+	if err != nil {
+		return nil, err
+	}
+	var signature []byte
+	if c.Signer != nil {
+		if signature, err = c.Signer.Sign(respInner); err != nil {
+			return nil, fmt.Errorf("cannot sign reply: %w", err)
+		}
+	}
+	return json.Marshal(router.ResponseMessage{
+		ID:         id,
+		Signature:  signature,
+		MessageAPI: respInner,
+	})
+}
+
+// verify checks the message signature against the pinned server address
+func (c *Client) verify(message, signature []byte) error {
+	addr, pinned := c.ServerAddress()
+	if !pinned {
+		return nil
+	}
+	if len(signature) != ethereum.SignatureLength {
+		return ErrNoSignature
+	}
+	signer, err := ethereum.AddrFromSignature(message, signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if signer != addr {
+		return fmt.Errorf("%w: signed by %s", ErrInvalidSignature, signer.Hex())
+	}
+	return nil
+}
+
+// Close closes the underlying transport
+func (c *Client) Close() error {
+	return c.Transport.Close()
+}
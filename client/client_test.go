@@ -0,0 +1,389 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/router"
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/mhttp"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+type testAPI struct {
+	ID        string `json:"request"`
+	Method    string `json:"method,omitempty"`
+	Timestamp int32  `json:"timestamp"`
+	Error     string `json:"error,omitempty"`
+	Reply     string `json:"reply,omitempty"`
+}
+
+func (ta *testAPI) GetID() string        { return ta.ID }
+func (ta *testAPI) SetID(id string)      { ta.ID = id }
+func (ta *testAPI) SetTimestamp(t int32) { ta.Timestamp = t }
+func (ta *testAPI) SetError(e string)    { ta.Error = e }
+func (ta *testAPI) GetMethod() string    { return ta.Method }
+
+func newTestAPI() transports.MessageAPI { return &testAPI{} }
+
+// newTestServer starts a router on a random local port and returns its address
+func newTestServer(t *testing.T, signer *ethereum.SignKeys) string {
+	pxy := mhttp.NewProxy()
+	pxy.Conn.Address = "127.0.0.1"
+	if err := pxy.Init(); err != nil {
+		t.Fatal(err)
+	}
+	ts := new(mhttp.HttpWsHandler)
+	if err := ts.Init(new(transports.Connection)); err != nil {
+		t.Fatal(err)
+	}
+	ts.SetProxy(pxy)
+	listener := make(chan transports.Message)
+	ts.Listen(listener)
+
+	r := router.NewRouter(listener, map[string]transports.Transport{"httpws": ts}, signer, newTestAPI)
+	if err := r.Transports["httpws"].AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	hello := func(rr router.RouterRequest) {
+		rr.Send(router.BuildReply(&testAPI{Reply: "hello " + rr.Address.Hex()}, rr))
+	}
+	if err := r.AddHandler("hello", "/main", hello, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddHandler("secret", "/main", hello, true, false); err != nil {
+		t.Fatal(err)
+	}
+	// ask calls the client and replies with its answer
+	ask := func(rr router.RouterRequest) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		reply, err := r.Call(ctx, rr.MessageContext, &testAPI{Method: "confirm"})
+		if err != nil {
+			r.SendError(rr, err.Error())
+			return
+		}
+		rr.Send(router.BuildReply(&testAPI{Reply: reply.Message.(*testAPI).Reply + " " + reply.Address.Hex()}, rr))
+	}
+	if err := r.AddHandler("ask", "/main", ask, false, true); err != nil {
+		t.Fatal(err)
+	}
+	status := func(rr router.RouterRequest) {
+		rr.Send(router.BuildReply(&testAPI{Reply: "status " + rr.Message.(*testAPI).Reply}, rr))
+	}
+	if err := r.AddHandler("status", "/main", status, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetReadOnly("/main", "status", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	go r.Route()
+	return pxy.Addr.String()
+}
+
+func TestClient(t *testing.T) {
+	server := ethereum.NewSignKeys()
+	if err := server.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wst, err := NewWebsocketTransport(ctx, fmt.Sprintf("ws://%s/main", addr), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tr := range []Transport{NewHTTPTransport(fmt.Sprintf("http://%s/main", addr), nil), wst} {
+		t.Run(tr.ConnectionType(), func(t *testing.T) {
+			c := New(tr, signer, newTestAPI)
+			c.PinServerAddress(server.Address())
+			resp, err := c.Request(ctx, &testAPI{Method: "hello"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := resp.(*testAPI).Reply, "hello "+signer.Address().Hex(); got != want {
+				t.Fatalf("got reply %q, want %q", got, want)
+			}
+
+			_, err = c.Request(ctx, &testAPI{Method: "secret"})
+			if !errors.Is(err, router.ErrInvalidAuthentication) {
+				t.Fatalf("expected invalid authentication error, got %v", err)
+			}
+			_, err = c.Request(ctx, &testAPI{Method: "unknown"})
+			if !errors.Is(err, router.ErrMethodNotValid) {
+				t.Fatalf("expected method not valid error, got %v", err)
+			}
+
+			c.PinServerAddress(signer.Address())
+			if _, err = c.Request(ctx, &testAPI{Method: "hello"}); !errors.Is(err, ErrInvalidSignature) {
+				t.Fatalf("expected invalid signature error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWebsocketConcurrentRequests(t *testing.T) {
+	server := ethereum.NewSignKeys()
+	if err := server.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wst, err := NewWebsocketTransport(ctx, fmt.Sprintf("ws://%s/main", addr), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wst.Close()
+	c := New(wst, nil, newTestAPI)
+	c.PinServerAddress(server.Address())
+
+	errs := make(chan error)
+	const numRequests = 50
+	for i := 0; i < numRequests; i++ {
+		go func() {
+			_, err := c.Request(ctx, &testAPI{Method: "hello"})
+			errs <- err
+		}()
+	}
+	for i := 0; i < numRequests; i++ {
+		// hello requires a signature, so every reply must be an error
+		if err := <-errs; !errors.Is(err, router.ErrInvalidSignature) {
+			t.Fatalf("expected invalid signature error, got %v", err)
+		}
+	}
+	if n := wst.Pending(); n != 0 {
+		t.Fatalf("expected no pending requests, got %d", n)
+	}
+
+	canceled, cancelRequest := context.WithCancel(ctx)
+	cancelRequest()
+	if _, err := c.Request(canceled, &testAPI{Method: "hello"}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+}
+
+// countingTransport counts the requests sent through it, failing them with
+// err if not nil
+type countingTransport struct {
+	Transport
+	err   error
+	calls int
+}
+
+func (c *countingTransport) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	c.calls++
+	if c.err != nil {
+		return nil, c.err
+	}
+	return c.Transport.Request(ctx, id, data)
+}
+
+func (c *countingTransport) Close() error {
+	if c.Transport == nil {
+		return nil
+	}
+	return c.Transport.Close()
+}
+
+func TestBalancerFailover(t *testing.T) {
+	server := ethereum.NewSignKeys()
+	if err := server.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, server)
+	alive := &countingTransport{Transport: NewHTTPTransport(fmt.Sprintf("http://%s/main", addr), nil)}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// The requests not reaching the endpoint fail over even if not idempotent,
+	// and the unhealthy endpoint is skipped afterwards
+	refused := &countingTransport{err: &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}}
+	b := NewBalancer(StrategyRoundRobin, 0,
+		&Endpoint{Name: "refused", Transport: refused},
+		&Endpoint{Name: "alive", Transport: alive},
+	)
+	b.RetryBackoff = time.Millisecond
+	defer b.Close()
+	c := New(b, nil, newTestAPI)
+	for i := 0; i < 4; i++ {
+		if _, err := c.Request(ctx, &testAPI{Method: "hello"}); !errors.Is(err, router.ErrInvalidSignature) {
+			t.Fatalf("expected the request to fail over, got %v", err)
+		}
+	}
+	if refused.calls != 1 || alive.calls != 4 {
+		t.Fatalf("expected 1 call to the refused endpoint and 4 to the alive one, got %d and %d",
+			refused.calls, alive.calls)
+	}
+	for _, h := range b.Health() {
+		if h.Healthy != (h.Name == "alive") {
+			t.Fatalf("endpoint %s reported as healthy=%v", h.Name, h.Healthy)
+		}
+	}
+
+	// Other transport errors are only retried for the idempotent methods
+	alive.calls = 0
+	lost := &countingTransport{err: ErrConnectionLost}
+	b2 := NewBalancer(StrategyRoundRobin, 0,
+		&Endpoint{Name: "lost", Transport: lost},
+		&Endpoint{Name: "alive", Transport: alive},
+	)
+	b2.RetryBackoff = time.Millisecond
+	defer b2.Close()
+	c = New(b2, nil, newTestAPI)
+	var failed bool
+	for i := 0; i < 2; i++ {
+		_, err := c.Request(ctx, &testAPI{Method: "hello"})
+		failed = failed || errors.Is(err, ErrConnectionLost)
+	}
+	if !failed || lost.calls != 1 || alive.calls != 1 {
+		t.Fatalf("expected a single failed request, got %d calls to the lost endpoint and %d to the alive one",
+			lost.calls, alive.calls)
+	}
+	b2.SetIdempotent("hello")
+	for i := 0; i < 4; i++ {
+		if _, err := c.Request(ctx, &testAPI{Method: "hello"}); !errors.Is(err, router.ErrInvalidSignature) {
+			t.Fatalf("expected the request to fail over, got %v", err)
+		}
+	}
+	if lost.calls != 1 || alive.calls != 5 {
+		t.Fatalf("expected the lost endpoint to be skipped, got %d calls to it", lost.calls)
+	}
+}
+
+func TestServerRequests(t *testing.T) {
+	server := ethereum.NewSignKeys()
+	if err := server.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, server)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wst, err := NewWebsocketTransport(ctx, fmt.Sprintf("ws://%s/main", addr), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wst.Close()
+	c := New(wst, signer, newTestAPI)
+	c.PinServerAddress(server.Address())
+
+	wst.OnNotification = func(data []byte) {
+		id, req, err := c.ParseRequest(data)
+		if err != nil {
+			t.Errorf("invalid server request: %v", err)
+			return
+		}
+		if req.GetMethod() != "confirm" {
+			t.Errorf("unexpected server request %q", req.GetMethod())
+		}
+		reply, err := c.BuildReply(id, &testAPI{Reply: "yes"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err := wst.Send(ctx, reply); err != nil {
+			t.Error(err)
+		}
+	}
+	resp, err := c.Request(ctx, &testAPI{Method: "ask"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := resp.(*testAPI).Reply, "yes "+signer.Address().Hex(); got != want {
+		t.Fatalf("got reply %q, want %q", got, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	server := ethereum.NewSignKeys()
+	if err := server.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	addr := newTestServer(t, server)
+	c := New(nil, nil, newTestAPI)
+	c.PinServerAddress(server.Address())
+
+	get := func(path, etag string) (*http.Response, []byte) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://%s%s", addr, path), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+	// parse checks the reply is signed by the server and returns it
+	parse := func(body []byte) (transports.MessageAPI, error) {
+		t.Helper()
+		var reply router.ResponseMessage
+		if err := json.Unmarshal(body, &reply); err != nil {
+			t.Fatal(err)
+		}
+		return c.ParseReply(reply.ID, "status", body)
+	}
+
+	resp, body := get("/main/status?reply=ok", "")
+	msg, err := parse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := msg.(*testAPI).Reply; got != "status ok" {
+		t.Fatalf("got reply %q", got)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=60" {
+		t.Fatalf("got Cache-Control %q", cc)
+	}
+	etag := resp.Header.Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("got ETag %q, want a weak one", etag)
+	}
+	// The validator matches the later replies, whatever their timestamp
+	time.Sleep(time.Second)
+	if resp, _ = get("/main/status?reply=ok", etag); resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("got status %d, want not modified", resp.StatusCode)
+	}
+	if resp, _ = get("/main/status?reply=other", etag); resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("ETag") == etag {
+		t.Fatalf("got status %d and the same ETag for another query", resp.StatusCode)
+	}
+
+	// The error replies are not cached
+	resp, body = get("/main/unknown", "")
+	if _, err := parse(body); !errors.Is(err, router.ErrMethodNotValid) {
+		t.Fatalf("expected error %v, got %v", router.ErrMethodNotValid, err)
+	}
+	if cc := resp.Header.Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf("error reply with Cache-Control %q", cc)
+	}
+}
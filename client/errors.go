@@ -0,0 +1,59 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vocdoni/multirpc/router"
+	"github.com/vocdoni/multirpc/transports"
+)
+
+var (
+	// ErrIDMismatch is returned when the reply ID does not match the request ID
+	ErrIDMismatch = errors.New("reply ID does not match the request")
+	// ErrNoSignature is returned when the reply is not signed but a server address is pinned
+	ErrNoSignature = errors.New("reply is not signed")
+	// ErrInvalidSignature is returned when the reply is not signed by the pinned server address
+	ErrInvalidSignature = errors.New("invalid reply signature")
+)
+
+// Error is the error replied by the server for a request. If the message
+// matches one of the router.ReplyErrors, Err holds it so errors.Is can be used.
+type Error struct {
+	Method  string
+	Message string
+	Err     error
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: server replied with error: %s", e.Method, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+func newError(method, msg string) *Error {
+	return &Error{Method: method, Message: msg, Err: router.MatchReplyError(msg)}
+}
+
+// errorGetter might be implemented by the MessageAPI type for returning the error field
+type errorGetter interface {
+	GetError() string
+}
+
+// replyError returns the error message of the reply. If the MessageAPI type
+// does not implement GetError(), the "error" JSON field is used.
+func replyError(resp transports.MessageAPI, data []byte) string {
+	if eg, ok := resp.(errorGetter); ok {
+		return eg.GetError()
+	}
+	var r struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return ""
+	}
+	return r.Error
+}
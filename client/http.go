@@ -0,0 +1,58 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// HTTPTransport sends the requests as HTTP POST to a multirpc namespace URL
+type HTTPTransport struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewHTTPTransport creates a new HTTP client transport for the given URL (i.e http://127.0.0.1:7788/main).
+// If httpClient is nil, http.DefaultClient is used.
+func NewHTTPTransport(url string, httpClient *http.Client) *HTTPTransport {
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	return &HTTPTransport{URL: url, Client: httpClient}
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (h *HTTPTransport) ConnectionType() string {
+	return "HTTP"
+}
+
+// Request sends the data and returns the reply body
+func (h *HTTPTransport) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", h.URL, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read reply: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+// Close releases the idle HTTP connections
+func (h *HTTPTransport) Close() error {
+	h.Client.CloseIdleConnections()
+	return nil
+}
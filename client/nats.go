@@ -0,0 +1,44 @@
+package client
+
+import (
+	"context"
+
+	"github.com/nats-io/nats.go"
+)
+
+// NATSTransport sends the requests to a NATS subject and waits for the reply
+// on a private inbox. The subject of a namespace is given by the server
+// transport (i.e multirpc.main for /main).
+type NATSTransport struct {
+	Conn    *nats.Conn
+	Subject string
+}
+
+// NewNATSTransport connects to the NATS server at url and sends the requests to subject
+func NewNATSTransport(url, subject string, options ...nats.Option) (*NATSTransport, error) {
+	nc, err := nats.Connect(url, options...)
+	if err != nil {
+		return nil, err
+	}
+	return &NATSTransport{Conn: nc, Subject: subject}, nil
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (n *NATSTransport) ConnectionType() string {
+	return "NATS"
+}
+
+// Request publishes the data and returns the reply
+func (n *NATSTransport) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	msg, err := n.Conn.RequestWithContext(ctx, n.Subject, data)
+	if err != nil {
+		return nil, err
+	}
+	return msg.Data, nil
+}
+
+// Close closes the NATS connection
+func (n *NATSTransport) Close() error {
+	n.Conn.Close()
+	return nil
+}
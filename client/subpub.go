@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/subpubtransport"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/log"
+)
+
+// SubPubTransport sends the requests through the libp2p subpub network.
+// If Peer is set the requests are sent to that peer, else they are broadcasted.
+type SubPubTransport struct {
+	Handle *subpubtransport.SubPubHandle
+	Peer   string
+
+	inbound chan transports.Message
+	pending map[string]chan []byte
+	lock    sync.Mutex
+}
+
+// NewSubPubTransport creates and starts a subpub node for the client.
+// The privKey identifies the node on the p2p network and the transportKey is
+// the group secret shared with the server.
+func NewSubPubTransport(privKey, transportKey string, port int32, bootnodes []string) (*SubPubTransport, error) {
+	conn := transports.Connection{
+		Port:         port,
+		Key:          privKey,
+		Topic:        fmt.Sprintf("%x", ethereum.HashRaw([]byte(transportKey))),
+		TransportKey: transportKey,
+	}
+	sp := &SubPubTransport{
+		Handle:  new(subpubtransport.SubPubHandle),
+		inbound: make(chan transports.Message),
+		pending: make(map[string]chan []byte),
+	}
+	if err := sp.Handle.Init(&conn); err != nil {
+		return nil, err
+	}
+	sp.Handle.SetBootnodes(bootnodes)
+	sp.Handle.Listen(sp.inbound)
+	go sp.dispatch()
+	return sp, nil
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (s *SubPubTransport) ConnectionType() string {
+	return "SubPub"
+}
+
+// dispatch delivers the received messages to the waiting requests
+func (s *SubPubTransport) dispatch() {
+	for msg := range s.inbound {
+		id := replyID(msg.Data)
+		s.lock.Lock()
+		ch, ok := s.pending[id]
+		delete(s.pending, id)
+		s.lock.Unlock()
+		if !ok {
+			log.Debugf("discarding subpub message not matching any request: %s", msg.Data)
+			continue
+		}
+		ch <- msg.Data
+	}
+}
+
+// Request sends the data to the server peer (or broadcasts it) and waits for the reply
+func (s *SubPubTransport) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	s.lock.Lock()
+	s.pending[id] = ch
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		delete(s.pending, id)
+		s.lock.Unlock()
+	}()
+
+	msg := transports.Message{Data: data}
+	var err error
+	if s.Peer != "" {
+		err = s.Handle.SendUnicast(s.Peer, msg)
+	} else {
+		err = s.Handle.Send(msg)
+	}
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops the subpub node
+func (s *SubPubTransport) Close() error {
+	return s.Handle.SubPub.Close()
+}
@@ -0,0 +1,368 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"go.vocdoni.io/dvote/log"
+	"nhooyr.io/websocket"
+)
+
+const (
+	// DefaultMaxPending is the default maximum number of in-flight requests on a websocket connection
+	DefaultMaxPending = 1024
+	// DefaultReconnectInterval is the default initial wait before reconnecting a websocket
+	DefaultReconnectInterval = 500 * time.Millisecond
+	// DefaultMaxReconnectInterval is the default maximum wait between websocket reconnection attempts
+	DefaultMaxReconnectInterval = 30 * time.Second
+	// DefaultWriteTimeout is the maximum time to write a message on a websocket,
+	// the connection is dropped if it is exceeded
+	DefaultWriteTimeout = 10 * time.Second
+	// WsSubprotocol is the websocket subprotocol offered to the server (mhttp.WsProtocolJSON),
+	// so the replies are sent on text frames
+	WsSubprotocol = "multirpc.json"
+)
+
+var (
+	// ErrTooManyPending is returned when the pending requests table is full
+	ErrTooManyPending = errors.New("too many pending requests")
+	// ErrConnectionLost is returned to the in-flight requests when the connection is lost
+	ErrConnectionLost = errors.New("connection lost")
+	// ErrClosed is returned when the transport is closed
+	ErrClosed = errors.New("transport is closed")
+)
+
+// WebsocketTransport sends the requests through a websocket connection.
+// Many requests can be in-flight at the same time, the replies are matched
+// to their callers by the ResponseMessage ID. If the connection is lost, the
+// transport reconnects and sends again the subscription requests.
+//
+// The replies to the subscription requests sent again are dropped, the
+// notifications following them are delivered to OnNotification.
+type WebsocketTransport struct {
+	URL                  string
+	ReadLimit            int64
+	MaxPending           int
+	ReconnectInterval    time.Duration
+	MaxReconnectInterval time.Duration
+	// OnNotification is called with the messages not matching any pending request
+	OnNotification func(data []byte)
+
+	conn          *websocket.Conn
+	connected     chan struct{} // closed while conn is usable
+	pending       map[string]*pendingRequest
+	subscriptions map[string][]byte
+	resubscribed  map[string]bool // subscriptions sent again, waiting for their reply
+	lock          sync.Mutex
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// NewWebsocketTransport dials the websocket server at url (i.e ws://127.0.0.1:7788/main)
+func NewWebsocketTransport(ctx context.Context, url string, readLimit int64) (*WebsocketTransport, error) {
+	w := &WebsocketTransport{
+		URL:                  url,
+		ReadLimit:            readLimit,
+		MaxPending:           DefaultMaxPending,
+		ReconnectInterval:    DefaultReconnectInterval,
+		MaxReconnectInterval: DefaultMaxReconnectInterval,
+		connected:            make(chan struct{}),
+		pending:              make(map[string]*pendingRequest),
+		subscriptions:        make(map[string][]byte),
+		resubscribed:         make(map[string]bool),
+	}
+	conn, err := w.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	w.ctx, w.cancel = context.WithCancel(context.Background())
+	w.setConn(conn)
+	go w.run(conn)
+	return w, nil
+}
+
+// pendingRequest is a request waiting for its reply on conn
+type pendingRequest struct {
+	reply chan []byte
+	conn  *websocket.Conn
+}
+
+// Conn returns the current websocket connection, nil while reconnecting.
+// It replaces the former Conn field, since the connection changes on each
+// reconnection.
+func (w *WebsocketTransport) Conn() *websocket.Conn {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.conn
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (w *WebsocketTransport) ConnectionType() string {
+	return "Websocket"
+}
+
+func (w *WebsocketTransport) dial(ctx context.Context) (*websocket.Conn, error) {
+	conn, _, err := websocket.Dial(ctx, w.URL, &websocket.DialOptions{Subprotocols: []string{WsSubprotocol}})
+	if err != nil {
+		return nil, err
+	}
+	if w.ReadLimit > 0 {
+		conn.SetReadLimit(w.ReadLimit)
+	}
+	return conn, nil
+}
+
+func (w *WebsocketTransport) setConn(conn *websocket.Conn) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.conn = conn
+	close(w.connected)
+}
+
+// currentConn waits until a connection is available and returns it
+func (w *WebsocketTransport) currentConn(ctx context.Context) (*websocket.Conn, error) {
+	for {
+		w.lock.Lock()
+		conn, connected := w.conn, w.connected
+		w.lock.Unlock()
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-connected:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-w.ctx.Done():
+			return nil, ErrClosed
+		}
+	}
+}
+
+// run reads and dispatches the messages, reconnecting when the connection is lost
+func (w *WebsocketTransport) run(conn *websocket.Conn) {
+	for {
+		w.readLoop(conn)
+		w.lock.Lock()
+		w.conn = nil
+		w.connected = make(chan struct{})
+		// The replies of the requests written on the lost connection will never arrive
+		for id, p := range w.pending {
+			if p.conn == conn {
+				close(p.reply)
+				delete(w.pending, id)
+			}
+		}
+		w.resubscribed = make(map[string]bool)
+		w.lock.Unlock()
+		if conn = w.reconnect(); conn == nil {
+			return
+		}
+		w.setConn(conn)
+		w.resubscribe(conn)
+	}
+}
+
+func (w *WebsocketTransport) readLoop(conn *websocket.Conn) {
+	for {
+		_, msg, err := conn.Read(w.ctx)
+		if err != nil {
+			if w.ctx.Err() == nil {
+				log.Warnf("websocket connection to %s lost: %v", w.URL, err)
+			}
+			conn.Close(websocket.StatusAbnormalClosure, "read error")
+			return
+		}
+		id := replyID(msg)
+		w.lock.Lock()
+		p, ok := w.pending[id]
+		delete(w.pending, id)
+		resubscribed := w.resubscribed[id]
+		delete(w.resubscribed, id)
+		w.lock.Unlock()
+		if ok {
+			p.reply <- msg
+			continue
+		}
+		if resubscribed {
+			log.Debugf("dropping reply of the subscription %s sent again: %s", id, msg)
+			continue
+		}
+		if fn := w.OnNotification; fn != nil {
+			fn(msg)
+		} else {
+			log.Debugf("discarding websocket message not matching any request: %s", msg)
+		}
+	}
+}
+
+// reconnect dials the server with exponential backoff until it succeeds or the transport is closed
+func (w *WebsocketTransport) reconnect() *websocket.Conn {
+	wait := w.ReconnectInterval
+	for {
+		select {
+		case <-w.ctx.Done():
+			return nil
+		case <-time.After(wait):
+		}
+		conn, err := w.dial(w.ctx)
+		if err == nil {
+			log.Infof("websocket reconnected to %s", w.URL)
+			return conn
+		}
+		log.Debugf("cannot reconnect to %s: %v", w.URL, err)
+		if wait *= 2; wait > w.MaxReconnectInterval {
+			wait = w.MaxReconnectInterval
+		}
+	}
+}
+
+// resubscribe sends again the subscription requests on a new connection
+func (w *WebsocketTransport) resubscribe(conn *websocket.Conn) {
+	w.lock.Lock()
+	subs := make([][]byte, 0, len(w.subscriptions))
+	for id, data := range w.subscriptions {
+		subs = append(subs, data)
+		w.resubscribed[id] = true
+	}
+	w.lock.Unlock()
+	for _, data := range subs {
+		if err := w.write(conn, data); err != nil {
+			log.Warnf("cannot resubscribe on %s: %v", w.URL, err)
+			return
+		}
+	}
+}
+
+// write writes the data on conn. The caller context is not used, as a write
+// interrupted by its context closes the connection shared by all the requests.
+func (w *WebsocketTransport) write(conn *websocket.Conn, data []byte) error {
+	ctx, cancel := context.WithTimeout(w.ctx, DefaultWriteTimeout)
+	defer cancel()
+	return conn.Write(ctx, websocket.MessageText, data)
+}
+
+// Request writes the data and waits for the message replied with the same id.
+// The request is abandoned if ctx is canceled, once it is written.
+func (w *WebsocketTransport) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	p, err := w.register(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.write(p.conn, data); err != nil {
+		w.forget(id)
+		return nil, err
+	}
+	select {
+	case msg, ok := <-p.reply:
+		if !ok {
+			return nil, ErrConnectionLost
+		}
+		return msg, nil
+	case <-ctx.Done():
+		w.forget(id)
+		return nil, ctx.Err()
+	case <-w.ctx.Done():
+		return nil, ErrClosed
+	}
+}
+
+// Send writes the data without waiting for a reply, e.g. the replies to the
+// server requests received by OnNotification. ctx bounds the wait for a
+// connection, not the write.
+func (w *WebsocketTransport) Send(ctx context.Context, data []byte) error {
+	conn, err := w.currentConn(ctx)
+	if err != nil {
+		return err
+	}
+	return w.write(conn, data)
+}
+
+// Subscribe sends a request as Request does, and keeps it for sending it again
+// each time the connection is reestablished. The notifications are delivered
+// to OnNotification.
+func (w *WebsocketTransport) Subscribe(ctx context.Context, id string, data []byte) ([]byte, error) {
+	reply, err := w.Request(ctx, id, data)
+	if err != nil {
+		return nil, err
+	}
+	w.lock.Lock()
+	w.subscriptions[id] = data
+	w.lock.Unlock()
+	return reply, nil
+}
+
+// Unsubscribe stops sending again the subscription request identified by id
+func (w *WebsocketTransport) Unsubscribe(id string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.subscriptions, id)
+}
+
+// Pending returns the number of in-flight requests
+func (w *WebsocketTransport) Pending() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return len(w.pending)
+}
+
+// register adds the pending request id on the current connection, waiting
+// for it if the transport is reconnecting
+func (w *WebsocketTransport) register(ctx context.Context, id string) (*pendingRequest, error) {
+	for {
+		conn, err := w.currentConn(ctx)
+		if err != nil {
+			return nil, err
+		}
+		w.lock.Lock()
+		if w.ctx.Err() != nil {
+			w.lock.Unlock()
+			return nil, ErrClosed
+		}
+		if w.conn != conn {
+			// The connection was lost meanwhile, wait for the new one
+			w.lock.Unlock()
+			continue
+		}
+		if len(w.pending) >= w.MaxPending {
+			w.lock.Unlock()
+			return nil, ErrTooManyPending
+		}
+		p := &pendingRequest{reply: make(chan []byte, 1), conn: conn}
+		w.pending[id] = p
+		w.lock.Unlock()
+		return p, nil
+	}
+}
+
+func (w *WebsocketTransport) forget(id string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	delete(w.pending, id)
+}
+
+// Close closes the websocket connection and stops reconnecting
+func (w *WebsocketTransport) Close() error {
+	w.lock.Lock()
+	conn := w.conn
+	w.lock.Unlock()
+	w.cancel()
+	if conn == nil {
+		return nil
+	}
+	return conn.Close(websocket.StatusNormalClosure, "")
+}
+
+// replyID returns the ID field of a reply envelope, or an empty string
+func replyID(data []byte) string {
+	var r struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(data, &r); err != nil {
+		return ""
+	}
+	return r.ID
+}
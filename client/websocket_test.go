@@ -0,0 +1,202 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"nhooyr.io/websocket"
+)
+
+func TestWebsocketResubscribe(t *testing.T) {
+	var lock sync.Mutex
+	conns := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.Accept(w, r, nil)
+		if err != nil {
+			return
+		}
+		lock.Lock()
+		conns++
+		n := conns
+		lock.Unlock()
+		ctx := r.Context()
+		for {
+			_, msg, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			id := replyID(msg)
+			reply := fmt.Sprintf(`{"id":%q,"reply":"ok"}`, id)
+			if err := conn.Write(ctx, websocket.MessageText, []byte(reply)); err != nil {
+				return
+			}
+			switch {
+			case n == 1 && id == "sub":
+				// Drop the first connection once subscribed
+				conn.Close(websocket.StatusGoingAway, "")
+				return
+			case n == 2 && id == "sub":
+				notification := `{"event":"new"}`
+				if err := conn.Write(ctx, websocket.MessageText, []byte(notification)); err != nil {
+					return
+				}
+			}
+		}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wst, err := NewWebsocketTransport(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wst.Close()
+	wst.ReconnectInterval = 10 * time.Millisecond
+	notifications := make(chan []byte, 10)
+	wst.OnNotification = func(data []byte) { notifications <- data }
+
+	if _, err := wst.Subscribe(ctx, "sub", []byte(`{"id":"sub"}`)); err != nil {
+		t.Fatal(err)
+	}
+	// The reply to the subscription sent again is dropped, only the
+	// notification sent on the new connection is received
+	select {
+	case data := <-notifications:
+		var n struct {
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(data, &n); err != nil || n.Event != "new" {
+			t.Fatalf("unexpected notification %s", data)
+		}
+	case <-ctx.Done():
+		t.Fatal("notification not received")
+	}
+	reply, err := wst.Request(ctx, "req", []byte(`{"id":"req"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id := replyID(reply); id != "req" {
+		t.Fatalf("got reply %s, want req", reply)
+	}
+	if wst.Conn() == nil {
+		t.Fatal("expected a connection")
+	}
+}
+
+// smallBufferListener limits the receive buffer of the accepted connections
+// until released, so the large writes to them block
+type smallBufferListener struct {
+	net.Listener
+	conns chan *net.TCPConn
+}
+
+func (l smallBufferListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if tc, ok := conn.(*net.TCPConn); ok {
+		tc.SetReadBuffer(4096)
+		l.conns <- tc
+	}
+	return conn, err
+}
+
+// release restores the receive buffer of the accepted connection
+func (l smallBufferListener) release() {
+	(<-l.conns).SetReadBuffer(4 << 20)
+}
+
+// TestWebsocketCancelRequest checks canceling a request being written does
+// not drop the connection shared by the other requests
+func TestWebsocketCancelRequest(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Without compression, so the large request is not shrunk
+		conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{CompressionMode: websocket.CompressionDisabled})
+		if err != nil {
+			return
+		}
+		conn.SetReadLimit(16 << 20)
+		ctx := r.Context()
+		// The requests are not read until released, so the writes block
+		select {
+		case <-release:
+		case <-ctx.Done():
+			return
+		}
+		for {
+			_, msg, err := conn.Read(ctx)
+			if err != nil {
+				return
+			}
+			reply := fmt.Sprintf(`{"id":%q,"reply":"ok"}`, replyID(msg))
+			if err := conn.Write(ctx, websocket.MessageText, []byte(reply)); err != nil {
+				return
+			}
+		}
+	}))
+	ln := smallBufferListener{Listener: srv.Listener, conns: make(chan *net.TCPConn, 1)}
+	srv.Listener = ln
+	srv.Start()
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wst, err := NewWebsocketTransport(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wst.Close()
+	conn := wst.Conn()
+	waitPending := func(n int) {
+		t.Helper()
+		for wst.Pending() != n {
+			if ctx.Err() != nil {
+				t.Fatalf("%d pending requests, want %d", wst.Pending(), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// The write of the large request blocks, and the small one waits for it
+	canceled, cancelRequest := context.WithCancel(ctx)
+	large := []byte(fmt.Sprintf(`{"id":"large","pad":%q}`, strings.Repeat("x", 8<<20)))
+	largeErr := make(chan error, 1)
+	go func() {
+		_, err := wst.Request(canceled, "large", large)
+		largeErr <- err
+	}()
+	waitPending(1)
+	smallErr := make(chan error, 1)
+	go func() {
+		reply, err := wst.Request(ctx, "small", []byte(`{"id":"small"}`))
+		if err == nil && replyID(reply) != "small" {
+			err = fmt.Errorf("got reply %s", reply)
+		}
+		smallErr <- err
+	}()
+	waitPending(2)
+	time.Sleep(100 * time.Millisecond)
+	cancelRequest()
+	time.Sleep(100 * time.Millisecond)
+	ln.release()
+	close(release)
+
+	if err := <-smallErr; err != nil {
+		t.Fatalf("request failed after canceling another one: %v", err)
+	}
+	if err := <-largeErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected canceled error, got %v", err)
+	}
+	if wst.Conn() != conn {
+		t.Fatal("connection dropped")
+	}
+}
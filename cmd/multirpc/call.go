@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/multirpc/client"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/log"
+)
+
+// connFlags are the flags shared by the commands connecting to a server
+type connFlags struct {
+	fs           *flag.FlagSet
+	host         *string
+	transport    *string
+	key          *string
+	keyFile      *string
+	noSign       *bool
+	address      *string
+	output       *string
+	raw          *bool
+	timeout      *time.Duration
+	logLevel     *string
+	transportKey *string
+	p2pPort      *int
+	bootnodes    *string
+	peer         *string
+}
+
+func newConnFlags(name string) *connFlags {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	return &connFlags{
+		fs:           fs,
+		host:         fs.String("host", "http://127.0.0.1:7788/main", "URL of the server namespace (http, https, ws or wss)"),
+		transport:    fs.String("transport", "", "transport to use <http, ws, subpub> (default guessed from the host URL)"),
+		key:          fs.String("key", "", "hex private key for signing the requests"),
+		keyFile:      fs.String("keyfile", defaultKeyFile(), "file holding the hex private key, used if -key is empty"),
+		noSign:       fs.Bool("nosign", false, "send the requests without signature"),
+		address:      fs.String("address", "", "expected server address; replies not signed by it are rejected"),
+		output:       fs.String("output", "text", "output format <text, json>"),
+		raw:          fs.Bool("raw", false, "print the full signed reply envelope, as accepted by verify"),
+		timeout:      fs.Duration("timeout", 30*time.Second, "request timeout"),
+		logLevel:     fs.String("logLevel", "error", "log level <debug, info, warn, error>"),
+		transportKey: fs.String("transportKey", "", "subpub group shared secret"),
+		p2pPort:      fs.Int("p2pPort", 45679, "subpub listening port"),
+		bootnodes:    fs.String("bootnodes", "", "comma separated list of subpub bootnodes"),
+		peer:         fs.String("peer", "", "subpub peer ID of the server (broadcast if empty)"),
+	}
+}
+
+func (cf *connFlags) parse(args []string) error {
+	if err := cf.fs.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+	if *cf.output != "text" && *cf.output != "json" {
+		return usagef("unknown output format %q", *cf.output)
+	}
+	log.Init(*cf.logLevel, "stderr")
+	return nil
+}
+
+// signer returns the signing key, or nil if the requests must not be signed
+func (cf *connFlags) signer() (*ethereum.SignKeys, error) {
+	if *cf.noSign {
+		return nil, nil
+	}
+	if *cf.key != "" {
+		return signerFromHex(*cf.key)
+	}
+	if _, err := os.Stat(*cf.keyFile); os.IsNotExist(err) {
+		// No key configured; use a throwaway key.
+		s := ethereum.NewSignKeys()
+		return s, s.Generate()
+	}
+	return loadKey(*cf.keyFile)
+}
+
+// dial creates the client for the configured host and transport
+func (cf *connFlags) dial(ctx context.Context) (*client.Client, error) {
+	signer, err := cf.signer()
+	if err != nil {
+		return nil, err
+	}
+	transport := *cf.transport
+	if transport == "" {
+		u, err := url.Parse(*cf.host)
+		if err != nil {
+			return nil, usagef("invalid host: %v", err)
+		}
+		switch u.Scheme {
+		case "http", "https":
+			transport = "http"
+		case "ws", "wss":
+			transport = "ws"
+		default:
+			return nil, usagef("cannot guess the transport for %q, use -transport", *cf.host)
+		}
+	}
+
+	var t client.Transport
+	switch transport {
+	case "http":
+		t = client.NewHTTPTransport(*cf.host, nil)
+	case "ws":
+		if t, err = client.NewWebsocketTransport(ctx, *cf.host, 0); err != nil {
+			return nil, err
+		}
+	case "subpub":
+		if *cf.transportKey == "" {
+			return nil, usagef("subpub requires -transportKey")
+		}
+		var bootnodes []string
+		if *cf.bootnodes != "" {
+			bootnodes = strings.Split(*cf.bootnodes, ",")
+		}
+		// The node key is not the signing key, so a throwaway key is used.
+		nodeKey := ethereum.NewSignKeys()
+		if err := nodeKey.Generate(); err != nil {
+			return nil, err
+		}
+		_, priv := nodeKey.HexString()
+		sp, err := client.NewSubPubTransport(priv, *cf.transportKey, int32(*cf.p2pPort), bootnodes)
+		if err != nil {
+			return nil, err
+		}
+		sp.Peer = *cf.peer
+		t = sp
+	default:
+		return nil, usagef("unknown transport %q", transport)
+	}
+
+	c := client.New(t, signer, newGenericAPI)
+	if *cf.address != "" {
+		if !ethcommon.IsHexAddress(*cf.address) {
+			return nil, usagef("invalid server address %q", *cf.address)
+		}
+		c.PinServerAddress(ethcommon.HexToAddress(*cf.address))
+	}
+	return c, nil
+}
+
+// print writes the reply on stdout using the configured output format
+func (cf *connFlags) print(resp interface{}) error {
+	var data []byte
+	var err error
+	if *cf.output == "json" {
+		data, err = json.Marshal(resp)
+	} else {
+		data, err = json.MarshalIndent(resp, "", "  ")
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+// request sends req and prints its reply (also when the server replies with an error)
+func (cf *connFlags) request(c *client.Client, req *genericAPI) error {
+	ctx, cancel := context.WithTimeout(context.Background(), *cf.timeout)
+	defer cancel()
+	if *cf.raw {
+		id := client.NewID()
+		data, err := c.BuildRequest(id, req)
+		if err != nil {
+			return err
+		}
+		respData, err := c.Transport.Request(ctx, id, data)
+		if err != nil {
+			return err
+		}
+		if perr := cf.print(json.RawMessage(respData)); perr != nil {
+			return perr
+		}
+		_, err = c.ParseReply(id, req.GetMethod(), respData)
+		return err
+	}
+	resp, err := c.Request(ctx, req)
+	if resp != nil {
+		if perr := cf.print(resp); perr != nil {
+			return perr
+		}
+	}
+	return err
+}
+
+// parseParams builds a request from a method name and a list of key=value
+// parameters. Values are decoded as JSON if possible, else used as strings.
+func parseParams(method string, params []string) (*genericAPI, error) {
+	req := genericAPI{"method": method}
+	for _, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, usagef("invalid parameter %q, expected key=value", p)
+		}
+		var value interface{}
+		if err := json.Unmarshal([]byte(kv[1]), &value); err != nil {
+			value = kv[1]
+		}
+		req[kv[0]] = value
+	}
+	return &req, nil
+}
+
+func cmdCall(args []string) error {
+	cf := newConnFlags("call")
+	cf.fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: multirpc call [flags] <method> [key=value...]\n")
+		cf.fs.PrintDefaults()
+	}
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+	if cf.fs.NArg() < 1 {
+		cf.fs.Usage()
+		return usagef("method name is required")
+	}
+	req, err := parseParams(cf.fs.Arg(0), cf.fs.Args()[1:])
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *cf.timeout)
+	defer cancel()
+	c, err := cf.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return cf.request(c, req)
+}
+
+func cmdIntrospect(args []string) error {
+	cf := newConnFlags("introspect")
+	method := cf.fs.String("method", "introspect", "name of the server introspection method")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *cf.timeout)
+	defer cancel()
+	c, err := cf.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return cf.request(c, &genericAPI{"method": *method})
+}
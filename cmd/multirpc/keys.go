@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/multirpc/client"
+	"github.com/vocdoni/multirpc/router"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// keyInfo is the printed information of a signing key
+type keyInfo struct {
+	Address    string `json:"address"`
+	PublicKey  string `json:"publicKey"`
+	PrivateKey string `json:"privateKey,omitempty"`
+}
+
+// defaultKeyFile returns the default path for storing the signing key
+func defaultKeyFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "multirpc.key"
+	}
+	return filepath.Join(home, ".multirpc", "key")
+}
+
+func signerFromHex(privKey string) (*ethereum.SignKeys, error) {
+	s := ethereum.NewSignKeys()
+	if err := s.AddHexKey(strings.TrimSpace(privKey)); err != nil {
+		return nil, usagef("invalid private key: %v", err)
+	}
+	return s, nil
+}
+
+func loadKey(path string) (*ethereum.SignKeys, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return signerFromHex(string(data))
+}
+
+// saveKey writes the private key to path, only readable by the owner
+func saveKey(path string, s *ethereum.SignKeys) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+	_, priv := s.HexString()
+	return ioutil.WriteFile(path, []byte(priv+"\n"), 0o600)
+}
+
+func printKey(s *ethereum.SignKeys, showPrivate bool) error {
+	pub, priv := s.HexString()
+	ki := keyInfo{Address: s.AddressString(), PublicKey: pub}
+	if showPrivate {
+		ki.PrivateKey = priv
+	}
+	data, err := json.MarshalIndent(ki, "", "  ")
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s\n", data)
+	return nil
+}
+
+func cmdKeygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ContinueOnError)
+	keyFile := fs.String("keyfile", "", "store the key on this file instead of printing the private key")
+	if err := fs.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+	s := ethereum.NewSignKeys()
+	if err := s.Generate(); err != nil {
+		return err
+	}
+	if *keyFile != "" {
+		if err := saveKey(*keyFile, s); err != nil {
+			return err
+		}
+	}
+	return printKey(s, *keyFile == "")
+}
+
+func cmdKeyImport(args []string) error {
+	fs := flag.NewFlagSet("keyimport", flag.ContinueOnError)
+	keyFile := fs.String("keyfile", defaultKeyFile(), "file where the key is stored")
+	force := fs.Bool("force", false, "overwrite the key file if it exists")
+	if err := fs.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+	if fs.NArg() != 1 {
+		return usagef("usage: multirpc keyimport [-keyfile file] <hexPrivKey>")
+	}
+	s, err := signerFromHex(fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(*keyFile); err == nil && !*force {
+		return usagef("key file %s already exists, use -force to overwrite it", *keyFile)
+	}
+	if err := saveKey(*keyFile, s); err != nil {
+		return err
+	}
+	return printKey(s, false)
+}
+
+// cmdVerify reads a reply envelope and checks its signature
+func cmdVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	address := fs.String("address", "", "expected signer address")
+	if err := fs.Parse(args); err != nil {
+		return usageError{err.Error()}
+	}
+	if *address != "" && !ethcommon.IsHexAddress(*address) {
+		return usagef("invalid address %q", *address)
+	}
+	var data []byte
+	var err error
+	if fs.NArg() > 0 {
+		data, err = ioutil.ReadFile(fs.Arg(0))
+	} else {
+		data, err = ioutil.ReadAll(os.Stdin)
+	}
+	if err != nil {
+		return err
+	}
+	var resp router.ResponseMessage
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return usagef("invalid reply: %v", err)
+	}
+	if len(resp.Signature) != ethereum.SignatureLength {
+		return client.ErrNoSignature
+	}
+	signer, err := ethereum.AddrFromSignature(resp.MessageAPI, resp.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", client.ErrInvalidSignature, err)
+	}
+	fmt.Printf("%s\n", signer.Hex())
+	if *address != "" && ethcommon.HexToAddress(*address) != signer {
+		return fmt.Errorf("%w: expected %s", client.ErrInvalidSignature, *address)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+// Command multirpc is a command line tool for calling the methods of multirpc servers.
+//
+// Usage:
+//
+//	multirpc call [flags] <method> [key=value...]
+//	multirpc repl [flags]
+//	multirpc introspect [flags]
+//	multirpc keygen [-keyfile file]
+//	multirpc keyimport [-keyfile file] <hexPrivKey>
+//	multirpc verify [-address addr] [reply.json]
+//
+// The exit code is 0 on success, 1 if the server replied with an error, 2 on
+// usage errors, 3 on transport errors and 4 if the reply signature is invalid.
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/vocdoni/multirpc/client"
+	"go.vocdoni.io/dvote/log"
+)
+
+// Exit codes
+const (
+	exitOK           = 0
+	exitReplyError   = 1
+	exitUsage        = 2
+	exitTransport    = 3
+	exitBadSignature = 4
+)
+
+// usageError is returned by the commands when the arguments are not valid
+type usageError struct{ msg string }
+
+func (e usageError) Error() string { return e.msg }
+
+func usagef(format string, args ...interface{}) error {
+	return usageError{fmt.Sprintf(format, args...)}
+}
+
+var commands = map[string]func(args []string) error{
+	"call":       cmdCall,
+	"repl":       cmdREPL,
+	"introspect": cmdIntrospect,
+	"keygen":     cmdKeygen,
+	"keyimport":  cmdKeyImport,
+	"verify":     cmdVerify,
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: multirpc <command> [flags] [args]
+
+commands:
+  call        call a method: call [flags] <method> [key=value...]
+  repl        open an interactive session, one request per line
+  introspect  call the server introspection method
+  keygen      generate a new signing key
+  keyimport   import a hex private key as signing key
+  verify      verify the signature of a reply
+
+run "multirpc <command> -h" for the command flags
+`)
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(exitUsage)
+	}
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		usage()
+		os.Exit(exitUsage)
+	}
+	log.Init("error", "stderr")
+	os.Exit(exitCode(cmd(os.Args[2:])))
+}
+
+// exitCode maps the command error into the process exit code
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	var ue usageError
+	var re *client.Error
+	switch {
+	case errors.As(err, &ue):
+		return exitUsage
+	case errors.Is(err, client.ErrInvalidSignature), errors.Is(err, client.ErrNoSignature):
+		return exitBadSignature
+	case errors.As(err, &re):
+		return exitReplyError
+	default:
+		return exitTransport
+	}
+}
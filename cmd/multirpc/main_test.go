@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/vocdoni/multirpc/client"
+	"github.com/vocdoni/multirpc/router"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+func TestExitCode(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		err  error
+		code int
+	}{
+		{"ok", nil, exitOK},
+		{"usage", usagef("method name is required"), exitUsage},
+		{"wrapped usage", fmt.Errorf("call: %w", usagef("bad")), exitUsage},
+		{"reply error", &client.Error{Method: "hello", Message: "failed"}, exitReplyError},
+		{"router reply error", &client.Error{Method: "hello", Err: router.ErrMethodNotValid}, exitReplyError},
+		{"invalid signature", fmt.Errorf("%w: expected 0x00", client.ErrInvalidSignature), exitBadSignature},
+		{"no signature", client.ErrNoSignature, exitBadSignature},
+		{"transport", errors.New("connection refused"), exitTransport},
+		{"timeout", context.DeadlineExceeded, exitTransport},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := exitCode(tc.err); code != tc.code {
+				t.Fatalf("got exit code %d, want %d", code, tc.code)
+			}
+		})
+	}
+}
+
+func TestParseParams(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		params []string
+		want   genericAPI
+		usage  bool
+	}{
+		{"no params", nil, genericAPI{"method": "m"}, false},
+		{"string", []string{"name=foo"}, genericAPI{"method": "m", "name": "foo"}, false},
+		{"json values", []string{"n=3", "ok=true", `list=["a"]`},
+			genericAPI{"method": "m", "n": 3.0, "ok": true, "list": []interface{}{"a"}}, false},
+		{"value with equal", []string{"q=a=b"}, genericAPI{"method": "m", "q": "a=b"}, false},
+		{"empty value", []string{"name="}, genericAPI{"method": "m", "name": ""}, false},
+		{"missing value", []string{"name"}, nil, true},
+		{"missing key", []string{"=foo"}, nil, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			req, err := parseParams("m", tc.params)
+			if tc.usage {
+				var ue usageError
+				if !errors.As(err, &ue) {
+					t.Fatalf("expected usage error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(*req, tc.want) {
+				t.Fatalf("got %v, want %v", *req, tc.want)
+			}
+		})
+	}
+}
+
+func TestConnFlags(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		args  []string
+		usage bool
+	}{
+		{"defaults", []string{"-nosign"}, false},
+		{"ws host", []string{"-nosign", "-host", "ws://127.0.0.1:1/main", "-transport", "http"}, false},
+		{"json output", []string{"-nosign", "-output", "json"}, false},
+		{"bad output", []string{"-output", "yaml"}, true},
+		{"unknown flag", []string{"-foo"}, true},
+		{"bad address", []string{"-nosign", "-address", "0x1234"}, true},
+		{"unknown scheme", []string{"-nosign", "-host", "tcp://127.0.0.1:1"}, true},
+		{"unknown transport", []string{"-nosign", "-transport", "smtp"}, true},
+		{"subpub without key", []string{"-nosign", "-transport", "subpub"}, true},
+		{"bad key", []string{"-key", "zz"}, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cf := newConnFlags("test")
+			cf.fs.SetOutput(nopWriter{})
+			err := cf.parse(tc.args)
+			if err == nil {
+				var c *client.Client
+				if c, err = cf.dial(context.Background()); err == nil {
+					c.Close()
+				}
+			}
+			var ue usageError
+			if tc.usage != errors.As(err, &ue) {
+				t.Fatalf("usage error expected: %v, got %v", tc.usage, err)
+			}
+			if !tc.usage && err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	other := ethereum.NewSignKeys()
+	if err := other.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	inner := []byte(`{"request":"1","timestamp":1}`)
+	signature, err := signer.Sign(inner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(router.ResponseMessage{ID: "1", Signature: signature, MessageAPI: inner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply := filepath.Join(t.TempDir(), "reply.json")
+	if err := os.WriteFile(reply, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name string
+		args []string
+		code int
+	}{
+		{"any signer", []string{reply}, exitOK},
+		{"expected signer", []string{"-address", signer.AddressString(), reply}, exitOK},
+		{"other signer", []string{"-address", other.AddressString(), reply}, exitBadSignature},
+		{"malformed address", []string{"-address", "0xabc", reply}, exitUsage},
+		{"not an address", []string{"-address", "foo", reply}, exitUsage},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if code := exitCode(cmdVerify(tc.args)); code != tc.code {
+				t.Fatalf("got exit code %d, want %d", code, tc.code)
+			}
+		})
+	}
+}
+
+type nopWriter struct{}
+
+func (nopWriter) Write(p []byte) (int, error) { return len(p), nil }
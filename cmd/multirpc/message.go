@@ -0,0 +1,44 @@
+package main
+
+import "github.com/vocdoni/multirpc/transports"
+
+// genericAPI is a transports.MessageAPI able to hold any JSON object. The
+// standard field names used by the multirpc examples are assumed.
+type genericAPI map[string]interface{}
+
+// GetID returns the request ID
+func (g *genericAPI) GetID() string {
+	id, _ := (*g)["request"].(string)
+	return id
+}
+
+// SetID sets a request ID
+func (g *genericAPI) SetID(id string) {
+	(*g)["request"] = id
+}
+
+// SetTimestamp sets the timestamp
+func (g *genericAPI) SetTimestamp(ts int32) {
+	(*g)["timestamp"] = ts
+}
+
+// SetError sets an error message
+func (g *genericAPI) SetError(e string) {
+	(*g)["error"] = e
+}
+
+// GetError returns the error message
+func (g *genericAPI) GetError() string {
+	e, _ := (*g)["error"].(string)
+	return e
+}
+
+// GetMethod returns the method
+func (g *genericAPI) GetMethod() string {
+	m, _ := (*g)["method"].(string)
+	return m
+}
+
+func newGenericAPI() transports.MessageAPI {
+	return &genericAPI{}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const replHelp = `enter one request per line, either as a JSON object or as: <method> [key=value...]
+commands: .help, .quit`
+
+// cmdREPL reads requests from stdin and prints the replies. The errors are
+// printed but do not end the session.
+func cmdREPL(args []string) error {
+	cf := newConnFlags("repl")
+	if err := cf.parse(args); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), *cf.timeout)
+	c, err := cf.dial(ctx)
+	cancel()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	interactive := isTerminal(os.Stdin)
+	if interactive {
+		fmt.Fprintln(os.Stderr, replHelp)
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		if interactive {
+			fmt.Fprint(os.Stderr, "> ")
+		}
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == ".quit":
+			return nil
+		case line == ".help":
+			fmt.Fprintln(os.Stderr, replHelp)
+		case line != "" && !strings.HasPrefix(line, "#"):
+			req, perr := parseLine(line)
+			if perr == nil {
+				perr = cf.request(c, req)
+			}
+			if perr != nil {
+				fmt.Fprintf(os.Stderr, "error: %v\n", perr)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
+// parseLine parses a REPL line as a JSON request or as a method with parameters
+func parseLine(line string) (*genericAPI, error) {
+	if strings.HasPrefix(line, "{") {
+		req := genericAPI{}
+		if err := json.Unmarshal([]byte(line), &req); err != nil {
+			return nil, err
+		}
+		return &req, nil
+	}
+	fields := strings.Fields(line)
+	return parseParams(fields[0], fields[1:])
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
@@ -1,6 +1,8 @@
 package endpoint
 
 import (
+	"context"
+
 	"github.com/vocdoni/multirpc/transports"
 )
 
@@ -10,4 +12,7 @@ type Endpoint interface {
 	SetOption(name string, value interface{}) error
 	Transport() transports.Transport
 	ID() string
+	// Close gracefully stops the endpoint and its transport, ctx bounds the
+	// time given to the in-flight requests.
+	Close(ctx context.Context) error
 }
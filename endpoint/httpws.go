@@ -1,7 +1,9 @@
 package endpoint
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"time"
 
@@ -19,20 +21,47 @@ const (
 	OptionTLSconfig       = "tlsConfig"
 	OptionMetricsInterval = "metricsInterval"
 	OptionSetMode         = "setMode"
+	OptionProxyConfig     = "proxyConfig"
+	OptionTLSclientCAs    = "tlsClientCAs"
+	OptionTLSclientAuth   = "tlsClientAuth"
+	OptionTLScertFile     = "tlsCertFile"
+	OptionTLSkeyFile      = "tlsKeyFile"
+	OptionACMEconfig      = "acmeConfig"
+	OptionWsKeepalive     = "wsKeepalive"
+	OptionWsSubprotocols  = "wsSubprotocols"
 
 	ModeHTTPWS   = 0
 	ModeHTTPonly = 1
 	ModeWSonly   = 2
+	ModeHTTP3    = 3
+	ModeSSE      = 4
+	ModeLongPoll = 5
 )
 
 type HTTPWSconfig struct {
-	ListenHost string
-	ListenPort int32
-	TLSdomain  string
-	TLSdirCert string
-	Mode       int8 // Modes available: 0:HTTP+WS, 1:HTTP, 2:WS
-	TLSconfig  *tls.Config
-	Metrics    *metrics.Metrics
+	ListenHost  string
+	ListenPort  int32
+	TLSdomain   string
+	TLSdirCert  string
+	TLScertFile string
+	TLSkeyFile  string
+	Mode        int8 // Modes available: 0:HTTP+WS, 1:HTTP, 2:WS, 3:HTTP+WS and HTTP/3, 4:HTTP+SSE, 5:HTTP+long-polling
+	// TLSconfig is the TLS config of the proxy. Without TLSdomain, HTTPS is
+	// served if it has certificates.
+	TLSconfig *tls.Config
+	Metrics   *metrics.Metrics
+	// Proxy holds the HTTP server settings (timeouts, throttling, CORS),
+	// its zero fields take the mhttp defaults
+	Proxy *mhttp.ProxyConfig
+	// ClientCAs enables the TLS client certificates authentication
+	ClientCAs  *x509.CertPool
+	ClientAuth tls.ClientAuthType
+	// ACME configures the letsencrypt certificates of TLSdomain
+	ACME *mhttp.ACMEConfig
+	// WsKeepalive configures the websocket pings and idle timeouts
+	WsKeepalive mhttp.WsKeepalive
+	// WsSubprotocols are the negotiated websocket subprotocols, mhttp.DefaultWsSubprotocols if nil
+	WsSubprotocols []string
 }
 
 // HTTPWSendPoint handles an HTTP + Websocket connection (client chooses).
@@ -55,7 +84,10 @@ func (e *HTTPWSendPoint) Transport() transports.Transport {
 }
 
 // SetOption configures a endpoint option, valid options are:
-// listenHost:string, listenPort:int32, tlsDomain:string, tlsDirCert:string, metricsInterval:int
+// listenHost:string, listenPort:int32, tlsDomain:string, tlsDirCert:string, metricsInterval:int,
+// proxyConfig:*mhttp.ProxyConfig, tlsClientCAs:*x509.CertPool, tlsClientAuth:tls.ClientAuthType,
+// tlsCertFile:string, tlsKeyFile:string, acmeConfig:*mhttp.ACMEConfig, wsKeepalive:mhttp.WsKeepalive,
+// wsSubprotocols:[]string
 func (e *HTTPWSendPoint) SetOption(name string, value interface{}) error {
 	switch name {
 	case OptionListenHost:
@@ -78,6 +110,16 @@ func (e *HTTPWSendPoint) SetOption(name string, value interface{}) error {
 			return fmt.Errorf("tlsDirCert must be a valid string")
 		}
 		e.config.TLSdirCert = value.(string)
+	case OptionTLScertFile:
+		if fmt.Sprintf("%T", value) != "string" {
+			return fmt.Errorf("tlsCertFile must be a valid string")
+		}
+		e.config.TLScertFile = value.(string)
+	case OptionTLSkeyFile:
+		if fmt.Sprintf("%T", value) != "string" {
+			return fmt.Errorf("tlsKeyFile must be a valid string")
+		}
+		e.config.TLSkeyFile = value.(string)
 	case OptionSetMode:
 		if fmt.Sprintf("%T", value) != "int" {
 			return fmt.Errorf("setMode must be a valid int")
@@ -89,6 +131,42 @@ func (e *HTTPWSendPoint) SetOption(name string, value interface{}) error {
 		} else {
 			e.config.TLSconfig = tc
 		}
+	case OptionProxyConfig:
+		if pc, ok := value.(*mhttp.ProxyConfig); !ok {
+			return fmt.Errorf("proxyConfig must be of type *mhttp.ProxyConfig")
+		} else {
+			e.config.Proxy = pc
+		}
+	case OptionTLSclientCAs:
+		if pool, ok := value.(*x509.CertPool); !ok {
+			return fmt.Errorf("tlsClientCAs must be of type *x509.CertPool")
+		} else {
+			e.config.ClientCAs = pool
+		}
+	case OptionTLSclientAuth:
+		if ca, ok := value.(tls.ClientAuthType); !ok {
+			return fmt.Errorf("tlsClientAuth must be of type tls.ClientAuthType")
+		} else {
+			e.config.ClientAuth = ca
+		}
+	case OptionACMEconfig:
+		if ac, ok := value.(*mhttp.ACMEConfig); !ok {
+			return fmt.Errorf("acmeConfig must be of type *mhttp.ACMEConfig")
+		} else {
+			e.config.ACME = ac
+		}
+	case OptionWsKeepalive:
+		if ka, ok := value.(mhttp.WsKeepalive); !ok {
+			return fmt.Errorf("wsKeepalive must be of type mhttp.WsKeepalive")
+		} else {
+			e.config.WsKeepalive = ka
+		}
+	case OptionWsSubprotocols:
+		if sp, ok := value.([]string); !ok {
+			return fmt.Errorf("wsSubprotocols must be of type []string")
+		} else {
+			e.config.WsSubprotocols = sp
+		}
 	case OptionMetricsInterval:
 		if fmt.Sprintf("%T", value) != "int" {
 			return fmt.Errorf("metricsInterval must be a valid int")
@@ -107,7 +185,7 @@ func (e *HTTPWSendPoint) Init(listener chan transports.Message) error {
 	log.Infof("creating API service")
 
 	// Create a HTTP Proxy service
-	pxy, err := proxy(e.config.ListenHost, e.config.ListenPort, e.config.TLSconfig, e.config.TLSdomain, e.config.TLSdirCert)
+	pxy, err := proxy(&e.config)
 	if err != nil {
 		return err
 	}
@@ -115,12 +193,16 @@ func (e *HTTPWSendPoint) Init(listener chan transports.Message) error {
 	// Create a HTTP+Websocket transport and attach the proxy
 	var ts transports.Transport
 	switch e.config.Mode {
-	case 0:
-		ts = new(mhttp.HttpWsHandler)
+	case 0, 3:
+		ts = &mhttp.HttpWsHandler{Keepalive: e.config.WsKeepalive, Subprotocols: e.config.WsSubprotocols}
 	case 1:
 		ts = new(mhttp.HttpHandler)
 	case 2:
-		ts = new(mhttp.WebsocketHandle)
+		ts = &mhttp.WebsocketHandle{Keepalive: e.config.WsKeepalive, Subprotocols: e.config.WsSubprotocols}
+	case 4:
+		ts = new(mhttp.SSEHandler)
+	case 5:
+		ts = new(mhttp.LongPollHandler)
 	default:
 		return fmt.Errorf("mode %d not supported", e.config.Mode)
 	}
@@ -128,12 +210,16 @@ func (e *HTTPWSendPoint) Init(listener chan transports.Message) error {
 	ts.Init(new(transports.Connection))
 
 	switch e.config.Mode {
-	case 0:
+	case 0, 3:
 		ts.(*mhttp.HttpWsHandler).SetProxy(pxy)
 	case 1:
 		ts.(*mhttp.HttpHandler).SetProxy(pxy)
 	case 2:
 		ts.(*mhttp.WebsocketHandle).SetProxy(pxy)
+	case 4:
+		ts.(*mhttp.SSEHandler).SetProxy(pxy)
+	case 5:
+		ts.(*mhttp.LongPollHandler).SetProxy(pxy)
 	}
 
 	go ts.Listen(listener)
@@ -142,6 +228,12 @@ func (e *HTTPWSendPoint) Init(listener chan transports.Message) error {
 	var ma *metrics.Agent
 	if e.config.Metrics != nil && e.config.Metrics.Enabled {
 		ma = metrics.NewAgent("/metrics", time.Second*time.Duration(e.config.Metrics.RefreshInterval), pxy)
+		if pxy.Certs != nil {
+			ma.RegisterCertExpiry(pxy.Certs)
+		}
+		if ws, ok := ts.(interface{ WsStats() *mhttp.WsStats }); ok {
+			ma.RegisterWsStats(pxy.Addr.String(), ws.WsStats())
+		}
 	}
 	e.id = "httpws"
 	e.Proxy = pxy
@@ -150,18 +242,39 @@ func (e *HTTPWSendPoint) Init(listener chan transports.Message) error {
 	return nil
 }
 
+// Close stops the transport, draining the in-flight requests and closing the
+// websockets, and then shuts down the HTTP proxy.
+func (e *HTTPWSendPoint) Close(ctx context.Context) error {
+	if e.transport == nil {
+		return nil
+	}
+	err := e.transport.Close(ctx)
+	if perr := e.Proxy.Close(ctx); err == nil {
+		err = perr
+	}
+	return err
+}
+
 // proxy creates a new service for routing HTTP connections using go-chi server
-// if tlsDomain is specified, it will use letsencrypt to fetch a valid TLS certificate
-func proxy(host string, port int32, tlsConfig *tls.Config, tlsDomain, tlsDir string) (*mhttp.Proxy, error) {
+// if TLSdomain is specified, it will use letsencrypt to fetch a valid TLS certificate.
+// On ModeHTTP3, HTTP/3 is also served over QUIC on the same UDP port.
+func proxy(c *HTTPWSconfig) (*mhttp.Proxy, error) {
 	pxy := mhttp.NewProxy()
-	pxy.Conn.TLSdomain = tlsDomain
-	pxy.Conn.TLScertDir = tlsDir
-	pxy.Conn.Address = host
-	pxy.Conn.Port = port
-	pxy.TLSConfig = tlsConfig
-	log.Infof("creating proxy service, listening on %s:%d", host, port)
+	pxy.Conn.TLSdomain = c.TLSdomain
+	pxy.Conn.TLScertDir = c.TLSdirCert
+	pxy.Conn.Address = c.ListenHost
+	pxy.Conn.Port = c.ListenPort
+	pxy.TLSConfig = c.TLSconfig
+	pxy.TLSCertFile = c.TLScertFile
+	pxy.TLSKeyFile = c.TLSkeyFile
+	pxy.HTTP3 = c.Mode == ModeHTTP3
+	pxy.Config = c.Proxy
+	pxy.ClientCAs = c.ClientCAs
+	pxy.ClientAuth = c.ClientAuth
+	pxy.ACME = c.ACME
+	log.Infof("creating proxy service, listening on %s:%d", c.ListenHost, c.ListenPort)
 	if pxy.Conn.TLSdomain != "" {
-		log.Infof("configuring proxy with TLS certificate for domain %s", tlsDomain)
+		log.Infof("configuring proxy with TLS certificate for domain %s", c.TLSdomain)
 	}
 	return pxy, pxy.Init()
 }
@@ -1,6 +1,7 @@
 package endpoint
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/vocdoni/multirpc/transports"
@@ -73,6 +74,12 @@ func (sp *SubPubEndpoint) SetOption(name string, value interface{}) error {
 func (sp *SubPubEndpoint) Transport() transports.Transport {
 	return &sp.transport
 }
+
+// Close stops the transport and shuts down the libp2p host
+func (sp *SubPubEndpoint) Close(ctx context.Context) error {
+	return sp.transport.Close(ctx)
+}
+
 func (sp *SubPubEndpoint) ID() string {
 	return "subpub"
 }
@@ -0,0 +1,90 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/tcp"
+)
+
+const (
+	OptionKeepAlive   = "setKeepAlive"
+	OptionMaxPipeline = "setMaxPipeline"
+)
+
+// TCPEndpoint handles raw TCP connections with length-prefixed messages,
+// optionally over TLS.
+type TCPEndpoint struct {
+	host        string
+	port        int32
+	tlsConfig   *tls.Config
+	keepAlive   time.Duration
+	maxPipeline int
+	transport   tcp.TCPHandle
+}
+
+// Init starts listening for TCP connections
+func (e *TCPEndpoint) Init(listener chan transports.Message) error {
+	conn := transports.Connection{
+		Address: e.host,
+		Port:    e.port,
+	}
+	e.transport.TLSConfig = e.tlsConfig
+	e.transport.KeepAlive = e.keepAlive
+	e.transport.MaxPipeline = e.maxPipeline
+	if err := e.transport.Init(&conn); err != nil {
+		return err
+	}
+	e.transport.Listen(listener)
+	return nil
+}
+
+// SetOption configures a endpoint option, valid options are:
+// listenHost:string, listenPort:int32, tlsConfig:*tls.Config,
+// setKeepAlive:time.Duration, setMaxPipeline:int
+func (e *TCPEndpoint) SetOption(name string, value interface{}) error {
+	var ok bool
+	switch name {
+	case OptionListenHost:
+		if e.host, ok = value.(string); !ok {
+			return fmt.Errorf("listenHost must be of type string")
+		}
+	case OptionListenPort:
+		if e.port, ok = value.(int32); !ok {
+			return fmt.Errorf("listenPort must be of type int32")
+		}
+	case OptionTLSconfig:
+		if e.tlsConfig, ok = value.(*tls.Config); !ok {
+			return fmt.Errorf("tlsConfig must be of type *tls.Config")
+		}
+	case OptionKeepAlive:
+		if e.keepAlive, ok = value.(time.Duration); !ok {
+			return fmt.Errorf("keepAlive must be of type time.Duration")
+		}
+	case OptionMaxPipeline:
+		if e.maxPipeline, ok = value.(int); !ok {
+			return fmt.Errorf("maxPipeline must be of type int")
+		}
+	default:
+		return fmt.Errorf("option %s is unknown", name)
+	}
+	return nil
+}
+
+// Transport returns the transport used for this endpoint
+func (e *TCPEndpoint) Transport() transports.Transport {
+	return &e.transport
+}
+
+// Close stops listening and waits for the in-flight requests until ctx is done
+func (e *TCPEndpoint) Close(ctx context.Context) error {
+	return e.transport.Close(ctx)
+}
+
+// ID returns the name of the transport implemented on the endpoint
+func (e *TCPEndpoint) ID() string {
+	return "tcp"
+}
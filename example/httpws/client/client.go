@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,86 +13,13 @@ import (
 	"strings"
 	"time"
 
-	"nhooyr.io/websocket"
-
+	"github.com/vocdoni/multirpc/client"
 	"github.com/vocdoni/multirpc/example/httpws/message"
-	"github.com/vocdoni/multirpc/router"
-	"go.vocdoni.io/dvote/crypto"
 	"go.vocdoni.io/dvote/crypto/ethereum"
 
 	"go.vocdoni.io/dvote/log"
 )
 
-// APIConnection holds an API websocket connection
-type APIConnection struct {
-	Conn *websocket.Conn
-}
-
-// NewAPIConnection starts a connection with the given endpoint address. The
-// connection is closed automatically when the test or benchmark finishes.
-func NewAPIConnection(addr string) *APIConnection {
-	r := &APIConnection{}
-	var err error
-	r.Conn, _, err = websocket.Dial(context.TODO(), addr, nil)
-	if err != nil {
-		log.Fatal(err)
-	}
-	return r
-}
-
-// Request makes a request to the previously connected endpoint
-func (r *APIConnection) Request(req *message.MyAPI, signer *ethereum.SignKeys) *router.ResponseMessage {
-
-	// Prepare and send request
-	req.Timestamp = (int32(time.Now().Unix()))
-	req.ID = fmt.Sprintf("%d", rand.Intn(1000))
-	reqInner, err := crypto.SortedMarshalJSON(req)
-	if err != nil {
-		log.Fatalf("%s: %v", req.Method, err)
-	}
-	var signature []byte
-	if signer != nil {
-		signature, err = signer.Sign(reqInner)
-		if err != nil {
-			log.Fatalf("%s: %v", req.Method, err)
-		}
-	}
-
-	reqOuter := router.RequestMessage{
-		ID:         req.ID,
-		Signature:  signature,
-		MessageAPI: reqInner,
-	}
-	reqBody, err := json.Marshal(reqOuter)
-	if err != nil {
-		log.Fatalf("%s: %v", req.Method, err)
-	}
-	log.Infof("sending: %s", reqBody)
-	if err := r.Conn.Write(context.TODO(), websocket.MessageText, reqBody); err != nil {
-		log.Fatalf("%s: %v", req.Method, err)
-	}
-
-	// Receive response
-	_, message, err := r.Conn.Read(context.TODO())
-	log.Infof("received: %s", message)
-	if err != nil {
-		log.Fatalf("%s: %v", req.Method, err)
-	}
-
-	var respOuter router.ResponseMessage
-	if err := json.Unmarshal(message, &respOuter); err != nil {
-		log.Fatalf("%v", err)
-	}
-	if respOuter.ID != reqOuter.ID {
-		log.Fatalf("%s: %v", req.Method, "request ID doesn'tb match")
-	}
-	if len(respOuter.Signature) == 0 {
-		log.Fatalf("%s: empty signature in response: %s", req.Method, message)
-	}
-
-	return &respOuter
-}
-
 func processLine(input []byte) *message.MyAPI {
 	var req message.MyAPI
 	err := json.Unmarshal(input, &req)
@@ -122,8 +50,12 @@ func main() {
 	}
 
 	log.Infof("connecting to %s", *host)
-	c := NewAPIConnection(*host)
-	defer c.Conn.Close(websocket.StatusNormalClosure, "")
+	wst, err := client.NewWebsocketTransport(context.Background(), *host, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c := client.New(wst, signer, message.NewAPI)
+	defer c.Close()
 
 	var req *message.MyAPI
 	reader := bufio.NewReader(os.Stdin)
@@ -139,7 +71,20 @@ func main() {
 			continue
 		}
 		req = processLine(line)
-		resp := c.Request(req, signer)
-		fmt.Printf("%s\n", resp.MessageAPI)
+		resp, err := c.Request(context.Background(), req)
+		if err != nil {
+			// The errors replied by the server are printed along with
+			// the reply, the others are fatal
+			var serverErr *client.Error
+			if !errors.As(err, &serverErr) {
+				log.Fatal(err)
+			}
+			log.Warn(err)
+		}
+		out, err := json.Marshal(resp)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", out)
 	}
 }
@@ -19,7 +19,12 @@ curl -s 127.0.0.1:7788/main -X POST -d '{"request":{"method":"hello", "request":
 */
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/vocdoni/multirpc/endpoint"
 	"github.com/vocdoni/multirpc/example/httpws/message"
@@ -84,7 +89,18 @@ func main() {
 	}
 
 	// Start routing
-	r.Route()
+	go r.Route()
+
+	// Wait for a termination signal and let the in-flight requests finish
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, os.Interrupt, syscall.SIGTERM)
+	<-sigc
+	log.Infof("shutting down")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ep.Close(ctx); err != nil {
+		log.Warnf("shutdown: %v", err)
+	}
 }
 
 //////////////
@@ -29,6 +29,44 @@ func NewAgent(path string, interval time.Duration, proxy *mhttp.Proxy) *Agent {
 	return &ma
 }
 
+// RegisterCertExpiry exposes the expiry of the certificate served by certs
+func (ma *Agent) RegisterCertExpiry(certs *mhttp.CertReloader) {
+	ma.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "multirpc_tls_certificate_expiry_timestamp_seconds",
+		Help:        "Expiry of the served TLS certificate, as a unix timestamp",
+		ConstLabels: prometheus.Labels{"file": certs.CertFile},
+	}, func() float64 {
+		return float64(certs.NotAfter().Unix())
+	}))
+}
+
+// RegisterWsStats exposes the open websocket connections of a handler and
+// the ones closed by the keepalive checks. The handler label tells apart the
+// handlers registered in the same process, e.g. their listen address.
+func (ma *Agent) RegisterWsStats(handler string, stats *mhttp.WsStats) {
+	ma.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "multirpc_websocket_connections",
+		Help:        "Open websocket connections",
+		ConstLabels: prometheus.Labels{"handler": handler},
+	}, func() float64 {
+		return float64(stats.Open())
+	}))
+	for reason, count := range map[string]func() int64{
+		"ping_timeout": stats.PingTimeouts,
+		"idle_timeout": stats.IdleTimeouts,
+		"max_lifetime": stats.LifetimeExpirations,
+	} {
+		count := count
+		ma.Register(prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name:        "multirpc_websocket_reaped_total",
+			Help:        "Websocket connections closed by the keepalive checks",
+			ConstLabels: prometheus.Labels{"handler": handler, "reason": reason},
+		}, func() float64 {
+			return float64(count())
+		}))
+	}
+}
+
 // Register adds a prometheus collector
 func (ma *Agent) Register(c prometheus.Collector) {
 	err := prometheus.Register(c)
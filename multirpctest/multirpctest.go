@@ -0,0 +1,238 @@
+// Package multirpctest provides utilities for testing multirpc handlers.
+//
+// A Harness builds a Router with throwaway signing keys over the in-process
+// memory transport, so the tests run fast and without network:
+//
+//	h := multirpctest.New(t, "/main", message.NewAPI)
+//	h.AddHandler("hello", hello, false, false)
+//	c := h.NewClient()
+//	c.Request(&message.MyAPI{Method: "hello"}).AssertOK()
+package multirpctest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/client"
+	"github.com/vocdoni/multirpc/router"
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/memory"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// DefaultTimeout is the default time a test client waits for a reply
+const DefaultTimeout = 10 * time.Second
+
+// Harness is a Router attached to an in-process transport
+type Harness struct {
+	Router    *router.Router
+	Transport *memory.MemoryHandle
+	Signer    *ethereum.SignKeys
+	Namespace string
+
+	t           testing.TB
+	messageType func() transports.MessageAPI
+	start       sync.Once
+}
+
+// New creates a router with throwaway signing keys, serving namespace over
+// the memory transport. The router starts routing on the first NewClient call,
+// so all the handlers must be added before.
+func New(t testing.TB, namespace string, messageTypeFunc func() transports.MessageAPI) *Harness {
+	t.Helper()
+	h := &Harness{
+		Signer:      newSigner(t),
+		Namespace:   namespace,
+		Transport:   new(memory.MemoryHandle),
+		t:           t,
+		messageType: messageTypeFunc,
+	}
+	if err := h.Transport.Init(new(transports.Connection)); err != nil {
+		t.Fatal(err)
+	}
+	listener := make(chan transports.Message)
+	h.Transport.Listen(listener)
+	h.Router = router.NewRouter(listener, map[string]transports.Transport{"memory": h.Transport},
+		h.Signer, messageTypeFunc)
+	if err := h.Router.Transports["memory"].AddNamespace(namespace); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// AddHandler registers a handler on the harness namespace, failing the test on error
+func (h *Harness) AddHandler(method string, handler func(router.RouterRequest), private, skipSignature bool) {
+	h.t.Helper()
+	if err := h.Router.AddHandler(method, h.Namespace, handler, private, skipSignature); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// NewClient connects a new test client with throwaway signing keys. The
+// server address is not pinned, the replies must be checked with the Reply
+// assertions.
+func (h *Harness) NewClient() *TestClient {
+	h.t.Helper()
+	h.start.Do(func() { go h.Router.Route() })
+	conn, err := h.Transport.Dial(h.Namespace)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	h.t.Cleanup(func() { conn.Close() })
+	return &TestClient{
+		Client:  client.New(conn, newSigner(h.t), h.messageType),
+		Conn:    conn,
+		Timeout: DefaultTimeout,
+		h:       h,
+	}
+}
+
+// Authorize adds the address of the client to the router authorized keys,
+// so it can call the private methods.
+func (h *Harness) Authorize(c *TestClient) {
+	h.Router.AddAuthKey(c.Signer.Address())
+}
+
+func newSigner(t testing.TB) *ethereum.SignKeys {
+	t.Helper()
+	s := ethereum.NewSignKeys()
+	if err := s.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// TestClient is a signing client connected to the harness router
+type TestClient struct {
+	*client.Client
+	Conn    *memory.Client
+	Timeout time.Duration
+
+	h *Harness
+}
+
+// Request sends req and returns its reply. The test fails if no reply is received.
+func (c *TestClient) Request(req transports.MessageAPI) *Reply {
+	c.h.t.Helper()
+	id := client.NewID()
+	data, err := c.BuildRequest(id, req)
+	if err != nil {
+		c.h.t.Fatal(err)
+	}
+	return c.RequestRaw(id, data)
+}
+
+// RequestRaw sends a raw request payload and returns the reply of the request
+// identified by id. Useful for testing malformed requests.
+func (c *TestClient) RequestRaw(id string, data []byte) *Reply {
+	c.h.t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+	raw, err := c.Conn.Request(ctx, id, data)
+	if err != nil {
+		c.h.t.Fatalf("no reply for request %s: %v", id, err)
+	}
+	r := &Reply{RequestID: id, Raw: raw, t: c.h.t, server: c.h.Signer}
+	if err := json.Unmarshal(raw, &r.Envelope); err != nil {
+		c.h.t.Fatalf("cannot unmarshal reply %s: %v", raw, err)
+	}
+	r.Message = c.h.messageType()
+	if err := json.Unmarshal(r.Envelope.MessageAPI, r.Message); err != nil {
+		c.h.t.Fatalf("cannot unmarshal reply message %s: %v", r.Envelope.MessageAPI, err)
+	}
+	if eg, ok := r.Message.(interface{ GetError() string }); ok {
+		r.Error = eg.GetError()
+		return r
+	}
+	var withError struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(r.Envelope.MessageAPI, &withError); err == nil {
+		r.Error = withError.Error
+	}
+	return r
+}
+
+// Reply is a reply received by a TestClient, with assertion helpers.
+// The assertions return the reply, so they can be chained.
+type Reply struct {
+	RequestID string
+	Raw       []byte
+	Envelope  router.ResponseMessage
+	Message   transports.MessageAPI
+	Error     string
+
+	t      testing.TB
+	server *ethereum.SignKeys
+}
+
+// AssertSignatureValid checks the reply is signed by the harness router
+func (r *Reply) AssertSignatureValid() *Reply {
+	r.t.Helper()
+	if len(r.Envelope.Signature) != ethereum.SignatureLength {
+		r.t.Fatalf("reply is not signed: %s", r.Raw)
+	}
+	addr, err := ethereum.AddrFromSignature(r.Envelope.MessageAPI, r.Envelope.Signature)
+	if err != nil {
+		r.t.Fatalf("invalid reply signature: %v", err)
+	}
+	if addr != r.server.Address() {
+		r.t.Fatalf("reply signed by %s, want %s", addr.Hex(), r.server.Address().Hex())
+	}
+	return r
+}
+
+// AssertIDMatches checks the reply IDs match the request ID
+func (r *Reply) AssertIDMatches() *Reply {
+	r.t.Helper()
+	if r.Envelope.ID != r.RequestID {
+		r.t.Fatalf("reply ID %q does not match request ID %q", r.Envelope.ID, r.RequestID)
+	}
+	if id := r.Message.GetID(); id != r.RequestID {
+		r.t.Fatalf("reply message ID %q does not match request ID %q", id, r.RequestID)
+	}
+	return r
+}
+
+// AssertError checks the reply holds the router error err (one of router.ReplyErrors)
+func (r *Reply) AssertError(err error) *Reply {
+	r.t.Helper()
+	if r.Error == "" {
+		r.t.Fatalf("expected error %q, got a successful reply: %s", err, r.Raw)
+	}
+	if !errors.Is(r.Err(), err) {
+		r.t.Fatalf("expected error %q, got %q", err, r.Error)
+	}
+	return r
+}
+
+// AssertNoError checks the reply does not hold an error
+func (r *Reply) AssertNoError() *Reply {
+	r.t.Helper()
+	if r.Error != "" {
+		r.t.Fatalf("unexpected error reply: %s", r.Error)
+	}
+	return r
+}
+
+// AssertOK checks the reply is signed by the router, matches the request ID and has no error
+func (r *Reply) AssertOK() *Reply {
+	r.t.Helper()
+	return r.AssertSignatureValid().AssertIDMatches().AssertNoError()
+}
+
+// Err returns the router error matching the reply error, or a generic error
+// holding the message if it does not match any. It returns nil if there is no error.
+func (r *Reply) Err() error {
+	if r.Error == "" {
+		return nil
+	}
+	if err := router.MatchReplyError(r.Error); err != nil {
+		return err
+	}
+	return errors.New(r.Error)
+}
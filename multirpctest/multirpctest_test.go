@@ -0,0 +1,49 @@
+package multirpctest
+
+import (
+	"testing"
+
+	"github.com/vocdoni/multirpc/router"
+	"github.com/vocdoni/multirpc/transports"
+)
+
+type testAPI struct {
+	ID        string `json:"request"`
+	Method    string `json:"method,omitempty"`
+	Timestamp int32  `json:"timestamp"`
+	Error     string `json:"error,omitempty"`
+	Reply     string `json:"reply,omitempty"`
+}
+
+func (ta *testAPI) GetID() string        { return ta.ID }
+func (ta *testAPI) SetID(id string)      { ta.ID = id }
+func (ta *testAPI) SetTimestamp(t int32) { ta.Timestamp = t }
+func (ta *testAPI) SetError(e string)    { ta.Error = e }
+func (ta *testAPI) GetMethod() string    { return ta.Method }
+
+func newTestAPI() transports.MessageAPI { return &testAPI{} }
+
+func TestHarness(t *testing.T) {
+	h := New(t, "/main", newTestAPI)
+	reply := func(rr router.RouterRequest) {
+		rr.Send(router.BuildReply(&testAPI{Reply: rr.Address.Hex()}, rr))
+	}
+	h.AddHandler("hello", reply, false, false)
+	h.AddHandler("secret", reply, true, false)
+
+	c := h.NewClient()
+	r := c.Request(&testAPI{Method: "hello"}).AssertOK()
+	if got, want := r.Message.(*testAPI).Reply, c.Signer.Address().Hex(); got != want {
+		t.Fatalf("got reply %q, want %q", got, want)
+	}
+	c.Request(&testAPI{Method: "secret"}).AssertSignatureValid().AssertIDMatches().
+		AssertError(router.ErrInvalidAuthentication)
+	c.Request(&testAPI{Method: "unknown"}).AssertError(router.ErrMethodNotValid)
+
+	h.Authorize(c)
+	c.Request(&testAPI{Method: "secret"}).AssertOK()
+
+	anon := h.NewClient()
+	anon.Signer = nil
+	anon.Request(&testAPI{Method: "hello"}).AssertError(router.ErrInvalidSignature)
+}
@@ -0,0 +1,162 @@
+package router
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/crypto"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+	"go.vocdoni.io/dvote/log"
+)
+
+// DefaultCallTimeout is the default time Call waits for the client reply
+const DefaultCallTimeout = 30 * time.Second
+
+// CallReply is the reply of a client to a request sent by the server
+type CallReply struct {
+	Message transports.MessageAPI
+	// Address is the signer of the reply
+	Address ethcommon.Address
+}
+
+// pendingCall is a request sent by Call, waiting for the reply of its client
+type pendingCall struct {
+	reply  chan []byte
+	msgCtx transports.MessageContext
+}
+
+// sameClient reports whether the messages of the contexts come from the same
+// client: the same websocket connection (session) or subpub peer
+func sameClient(a, b transports.MessageContext) bool {
+	if sa := connSession(a); sa != nil {
+		return sa == connSession(b)
+	}
+	pa, ok := a.(transports.PeerContext)
+	if !ok || pa.Peer() == "" {
+		return false
+	}
+	pb, ok := b.(transports.PeerContext)
+	return ok && a.ConnectionType() == b.ConnectionType() && pa.Peer() == pb.Peer()
+}
+
+// Call sends a signed request to the client of the message context (a
+// websocket or subpub connection) and waits for its signed reply, until ctx
+// is done or DefaultCallTimeout if ctx has no deadline. The request ID and
+// timestamp are set by the router. The reply is a ResponseMessage with the
+// same ID, and its inner message must hold it too. The replies received from
+// other clients are dropped.
+func (r *Router) Call(ctx context.Context, msgCtx transports.MessageContext, req transports.MessageAPI) (*CallReply, error) {
+	if connSession(msgCtx) == nil {
+		if pc, ok := msgCtx.(transports.PeerContext); !ok || pc.Peer() == "" {
+			return nil, fmt.Errorf("cannot call the %s client, its replies cannot be told apart", msgCtx.ConnectionType())
+		}
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultCallTimeout)
+		defer cancel()
+	}
+	rid := make([]byte, 16)
+	if _, err := rand.Read(rid); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(rid)
+	req.SetID(id)
+	req.SetTimestamp(int32(time.Now().Unix()))
+	reqOuter := &RequestMessage{ID: id}
+	var err error
+	if reqOuter.MessageAPI, err = crypto.SortedMarshalJSON(req); err != nil {
+		return nil, err
+	}
+	if reqOuter.Signature, err = r.signer.Sign(reqOuter.MessageAPI); err != nil {
+		return nil, fmt.Errorf("cannot sign request: %w", err)
+	}
+	data, err := json.Marshal(reqOuter)
+	if err != nil {
+		return nil, err
+	}
+
+	call := &pendingCall{reply: make(chan []byte, 1), msgCtx: msgCtx}
+	r.lock.Lock()
+	r.calls[id] = call
+	r.lock.Unlock()
+	defer func() {
+		r.lock.Lock()
+		delete(r.calls, id)
+		r.lock.Unlock()
+	}()
+
+	log.Debugf("calling %s client with request %s", msgCtx.ConnectionType(), id)
+	if err := msgCtx.Send(transports.Message{
+		TimeStamp: int32(time.Now().Unix()),
+		Context:   msgCtx,
+		Data:      data,
+	}); err != nil {
+		return nil, err
+	}
+	select {
+	case data = <-call.reply:
+	case <-ctx.Done():
+		return nil, fmt.Errorf("no reply for request %s: %w", id, ctx.Err())
+	}
+	return r.callReply(id, data)
+}
+
+// callReply verifies the client reply of the request id
+func (r *Router) callReply(id string, data []byte) (*CallReply, error) {
+	var respOuter ResponseMessage
+	if err := json.Unmarshal(data, &respOuter); err != nil {
+		return nil, err
+	}
+	if len(respOuter.Signature) != ethereum.SignatureLength {
+		return nil, ErrInvalidSignature
+	}
+	addr, err := ethereum.AddrFromSignature(respOuter.MessageAPI, respOuter.Signature)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	reply := &CallReply{Message: r.messageType(), Address: addr}
+	if err := json.Unmarshal(respOuter.MessageAPI, reply.Message); err != nil {
+		return nil, err
+	}
+	// The signed message must be the reply of this request
+	if reply.Message.GetID() != id {
+		return nil, fmt.Errorf("reply message ID %q does not match request ID %q", reply.Message.GetID(), id)
+	}
+	return reply, nil
+}
+
+// deliverReply passes the message to the Call waiting for it, if it is the
+// reply of a request sent by the router. The replies to the requests sent
+// to another client are dropped.
+func (r *Router) deliverReply(msg transports.Message) bool {
+	r.lock.RLock()
+	waiting := len(r.calls) > 0
+	r.lock.RUnlock()
+	if !waiting {
+		return false
+	}
+	var respOuter ResponseMessage
+	if err := json.Unmarshal(msg.Data, &respOuter); err != nil || len(respOuter.MessageAPI) == 0 {
+		return false
+	}
+	r.lock.Lock()
+	call, ok := r.calls[respOuter.ID]
+	if ok && !sameClient(call.msgCtx, msg.Context) {
+		r.lock.Unlock()
+		log.Warnf("dropping reply to request %s from another %s client", respOuter.ID, msg.Context.ConnectionType())
+		return true
+	}
+	delete(r.calls, respOuter.ID)
+	r.lock.Unlock()
+	if ok {
+		call.reply <- msg.Data
+	}
+	return ok
+}
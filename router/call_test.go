@@ -0,0 +1,141 @@
+package router
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// peerContext is the context of a message received from a peer, a new one
+// for each message as in subpub
+type peerContext struct {
+	*testContext
+	peer string
+}
+
+func (c *peerContext) ConnectionType() string { return "testPeer" }
+func (c *peerContext) Peer() string           { return c.peer }
+
+// callRequest reads the request sent by Call on ctx and returns its ID
+func callRequest(t *testing.T, ctx *testContext) string {
+	t.Helper()
+	select {
+	case msg := <-ctx.replies:
+		var req RequestMessage
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			t.Fatal(err)
+		}
+		return req.ID
+	case <-time.After(5 * time.Second):
+		t.Fatal("request not sent")
+	}
+	return ""
+}
+
+// callReply returns the reply to the request id signed by signer
+func callReply(t *testing.T, signer *ethereum.SignKeys, id, reply string) []byte {
+	t.Helper()
+	inner, err := json.Marshal(&testAPI{ID: id, Reply: reply, Timestamp: int32(time.Now().Unix())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := ResponseMessage{ID: id, MessageAPI: inner}
+	if resp.Signature, err = signer.Sign(inner); err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCall(t *testing.T) {
+	r := newTestRouter(t)
+	client := newSigner(t)
+
+	type result struct {
+		reply *CallReply
+		err   error
+	}
+	call := func(ctx context.Context, msgCtx transports.MessageContext) chan result {
+		done := make(chan result, 1)
+		go func() {
+			reply, err := r.Call(ctx, msgCtx, &testAPI{Method: "confirm"})
+			done <- result{reply, err}
+		}()
+		return done
+	}
+	expect := func(done chan result, want string) {
+		t.Helper()
+		select {
+		case res := <-done:
+			if res.err != nil {
+				t.Fatal(res.err)
+			}
+			if res.reply.Message.(*testAPI).Reply != want || res.reply.Address != client.Address() {
+				t.Fatalf("got reply %q from %s", res.reply.Message.(*testAPI).Reply, res.reply.Address.Hex())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("reply not delivered")
+		}
+	}
+
+	t.Run("Session", func(t *testing.T) {
+		target := newSessionContext()
+		done := call(context.Background(), target)
+		id := callRequest(t, target)
+		// The reply of another connection is dropped
+		other := newSessionContext()
+		r.inbound <- transports.Message{Data: callReply(t, client, id, "other"), Context: other}
+		// The replies are received on a new context of the same connection
+		same := &testContext{session: target.session, replies: target.replies}
+		r.inbound <- transports.Message{Data: callReply(t, client, id, "yes"), Context: same}
+		expect(done, "yes")
+		select {
+		case msg := <-other.replies:
+			t.Fatalf("reply of another connection routed as a request: %s", msg.Data)
+		default:
+		}
+	})
+
+	t.Run("Peer", func(t *testing.T) {
+		target := &peerContext{testContext: newTestContext(), peer: "peer1"}
+		done := call(context.Background(), target)
+		id := callRequest(t, target.testContext)
+		r.inbound <- transports.Message{
+			Data:    callReply(t, client, id, "other"),
+			Context: &peerContext{testContext: newTestContext(), peer: "peer2"},
+		}
+		r.inbound <- transports.Message{
+			Data:    callReply(t, client, id, "yes"),
+			Context: &peerContext{testContext: target.testContext, peer: "peer1"},
+		}
+		expect(done, "yes")
+	})
+
+	t.Run("Timeout", func(t *testing.T) {
+		target := newSessionContext()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		done := call(ctx, target)
+		callRequest(t, target)
+		if res := <-done; !errors.Is(res.err, context.DeadlineExceeded) {
+			t.Fatalf("expected deadline exceeded, got %v", res.err)
+		}
+	})
+
+	t.Run("Unsupported", func(t *testing.T) {
+		// The replies of a client without connection cannot be matched
+		_, err := r.Call(context.Background(), newTestContext(), &testAPI{Method: "confirm"})
+		if err == nil || !strings.Contains(err.Error(), "cannot call") {
+			t.Fatalf("expected call error, got %v", err)
+		}
+	})
+}
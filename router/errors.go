@@ -0,0 +1,44 @@
+package router
+
+import (
+	"errors"
+	"strings"
+)
+
+// Errors replied by the router to the client. The message of each one is the
+// prefix of the error string written in the reply, so clients can match them.
+var (
+	ErrEmptyPayload          = errors.New("empty payload")
+	ErrMethodEmpty           = errors.New("method is empty")
+	ErrMethodNotValid        = errors.New("method not valid")
+	ErrInvalidSignature      = errors.New("no signature provided or invalid lenght")
+	ErrInvalidAuthentication = errors.New("invalid authentication")
+	ErrSessionUnsupported    = errors.New("sessions not supported by the transport")
+	ErrInvalidChallenge      = errors.New("invalid session challenge")
+	ErrMethodNotReadOnly     = errors.New("method not read-only")
+	ErrInvalidQuery          = errors.New("invalid query")
+)
+
+// ReplyErrors is the list of the known errors the router might reply with.
+var ReplyErrors = []error{
+	ErrEmptyPayload,
+	ErrMethodEmpty,
+	ErrMethodNotValid,
+	ErrInvalidSignature,
+	ErrInvalidAuthentication,
+	ErrSessionUnsupported,
+	ErrInvalidChallenge,
+	ErrMethodNotReadOnly,
+	ErrInvalidQuery,
+}
+
+// MatchReplyError returns the known router error replied with the message msg,
+// or nil if it does not match any of them.
+func MatchReplyError(msg string) error {
+	for _, re := range ReplyErrors {
+		if strings.HasPrefix(msg, re.Error()) {
+			return re
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package router
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/crypto"
+	"go.vocdoni.io/dvote/log"
+)
+
+// SetReadOnly marks a public method without signature as read-only, so it can
+// also be called with a query (HTTP GET /namespace/method?param=value). The
+// parameters are set on the fields of the message type with the same JSON
+// name, and the method on the "method" field (or with SetMethod(string) if the
+// message type implements it). The replies can be cached for maxAge. It can
+// be called while routing.
+func (r *Router) SetReadOnly(namespace, method string, maxAge time.Duration) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	m, ok := r.methods[namespace+method]
+	if !ok {
+		return fmt.Errorf("method %s not found for namespace %s", method, namespace)
+	}
+	if !m.public || !m.skipSignature {
+		return fmt.Errorf("method %s of namespace %s is not public or requires signature", method, namespace)
+	}
+	m.readOnly = true
+	m.maxAge = maxAge
+	r.methods[namespace+method] = m
+	return nil
+}
+
+// getQueryRequest returns the request of a query to a read-only method
+func (r *Router) getQueryRequest(namespace, method string, params url.Values,
+	context transports.MessageContext) (request RouterRequest, err error) {
+	request.MessageContext = context
+	request.Signer = r.signer
+	// The equal queries have the same ID, so their replies are equal too
+	sum := sha256.Sum256([]byte(namespace + "/" + method + "?" + params.Encode()))
+	request.Id = hex.EncodeToString(sum[:16])
+	log.Debugf("got query: %s/%s?%s", namespace, method, params.Encode())
+
+	m, ok := r.method(namespace + method)
+	if !ok {
+		return request, fmt.Errorf("%w: (%s)", ErrMethodNotValid, method)
+	}
+	if !m.readOnly {
+		return request, fmt.Errorf("%w: (%s)", ErrMethodNotReadOnly, method)
+	}
+	request.Message = r.messageType()
+	if err := queryMessage(request.Message, method, params); err != nil {
+		return request, fmt.Errorf("%w: %v", ErrInvalidQuery, err)
+	}
+	request.Message.SetID(request.Id)
+	request.Method = method
+	request.CacheMaxAge = m.maxAge
+	return request, nil
+}
+
+// setCache sets the ETag and max-age of the reply to a query. The ETag is
+// computed without the reply timestamp, so it is a weak validator: the
+// replies with the same content have the same ETag, even if their bytes
+// (timestamp and signature) differ.
+func setCache(qc transports.QueryContext, response transports.MessageAPI, maxAge time.Duration) {
+	response.SetTimestamp(0)
+	data, err := crypto.SortedMarshalJSON(response)
+	if err != nil {
+		log.Warnf("cannot compute reply ETag: %v", err)
+		return
+	}
+	sum := sha256.Sum256(data)
+	qc.SetCache(hex.EncodeToString(sum[:16]), maxAge)
+}
+
+// queryMessage sets the method and the parameters of a query on msg
+func queryMessage(msg transports.MessageAPI, method string, params url.Values) error {
+	t := reflect.TypeOf(msg)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return fmt.Errorf("message type %s is not a struct", t)
+	}
+	fields := make(map[string]interface{})
+	for name, values := range params {
+		field, ok := jsonField(t, name)
+		if !ok {
+			return fmt.Errorf("unknown parameter %q", name)
+		}
+		value, err := queryValue(field.Type, values)
+		if err != nil {
+			return fmt.Errorf("parameter %q: %v", name, err)
+		}
+		fields[name] = value
+	}
+	fields["method"] = method
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return err
+	}
+	if ms, ok := msg.(interface{ SetMethod(string) }); ok {
+		ms.SetMethod(method)
+	}
+	if msg.GetMethod() != method {
+		return fmt.Errorf("message type %s has no method field", t)
+	}
+	return nil
+}
+
+// jsonField returns the exported field of t with the JSON name
+func jsonField(t reflect.Type, name string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")[0]
+		if tag == "-" {
+			continue
+		}
+		if tag == "" {
+			tag = f.Name
+		}
+		if tag == name {
+			return f, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// queryValue converts the query values to the JSON value of a field of type t
+func queryValue(t reflect.Type, values []string) (interface{}, error) {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() == reflect.Slice && t.Elem().Kind() != reflect.Uint8 {
+		list := make([]interface{}, len(values))
+		for i, v := range values {
+			value, err := queryValue(t.Elem(), []string{v})
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	}
+	if len(values) != 1 {
+		return nil, fmt.Errorf("repeated")
+	}
+	v := values[0]
+	switch t.Kind() {
+	case reflect.String:
+		return v, nil
+	case reflect.Bool:
+		return strconv.ParseBool(v)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.ParseInt(v, 10, t.Bits())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.ParseUint(v, 10, t.Bits())
+	case reflect.Float32, reflect.Float64:
+		return strconv.ParseFloat(v, t.Bits())
+	default:
+		// The other types (e.g. structs) are given as JSON
+		if !json.Valid([]byte(v)) {
+			return nil, fmt.Errorf("invalid JSON value")
+		}
+		return json.RawMessage(v), nil
+	}
+}
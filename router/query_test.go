@@ -0,0 +1,117 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+)
+
+// queryContext is the context of a query, as received with HTTP GET
+type queryContext struct {
+	*testContext
+	method string
+	params url.Values
+	etag   string
+	maxAge time.Duration
+}
+
+func (c *queryContext) Query() (string, url.Values, bool) { return c.method, c.params, true }
+
+func (c *queryContext) SetCache(etag string, maxAge time.Duration) {
+	c.etag = etag
+	c.maxAge = maxAge
+}
+
+// query sends the query of method and returns the context with the reply
+// cache validator, and the reply
+func (r *testRouter) query(t *testing.T, method, params string) (*queryContext, *testAPI, error) {
+	t.Helper()
+	values, err := url.ParseQuery(params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := &queryContext{testContext: newTestContext(), method: method, params: values}
+	r.inbound <- transports.Message{Namespace: "/main", Context: ctx}
+	var msg transports.Message
+	select {
+	case msg = <-ctx.replies:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("query %s not replied", method)
+	}
+	var resp ResponseMessage
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	reply := new(testAPI)
+	if err := json.Unmarshal(resp.MessageAPI, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error != "" {
+		if re := MatchReplyError(reply.Error); re != nil {
+			return ctx, reply, re
+		}
+		return ctx, reply, errors.New(reply.Error)
+	}
+	return ctx, reply, nil
+}
+
+func TestQuery(t *testing.T) {
+	r := newTestRouter(t)
+	// The methods can be added and set read-only while routing
+	status := func(rr RouterRequest) {
+		rr.Send(BuildReply(&testAPI{Reply: "status " + rr.Message.(*testAPI).Reply}, rr))
+	}
+	if err := r.AddHandler("status", "/main", status, false, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetReadOnly("/main", "status", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.SetReadOnly("/main", "hello", time.Minute); err == nil {
+		t.Fatal("method requiring signature set as read-only")
+	}
+	if err := r.SetReadOnly("/main", "unknown", time.Minute); err == nil {
+		t.Fatal("unknown method set as read-only")
+	}
+
+	ctx, reply, err := r.query(t, "status", "reply=ok")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Reply != "status ok" {
+		t.Fatalf("got reply %q", reply.Reply)
+	}
+	if ctx.etag == "" || ctx.maxAge != time.Minute {
+		t.Fatalf("got ETag %q and max age %s", ctx.etag, ctx.maxAge)
+	}
+	// The equal queries have the same ETag, the others a different one
+	if same, _, _ := r.query(t, "status", "reply=ok"); same.etag != ctx.etag {
+		t.Fatalf("got ETag %q for the same query, want %q", same.etag, ctx.etag)
+	}
+	if other, _, _ := r.query(t, "status", "reply=other"); other.etag == ctx.etag {
+		t.Fatal("same ETag for another query")
+	}
+
+	for _, tc := range []struct {
+		method, params string
+		err            error
+	}{
+		{"hello", "", ErrMethodNotReadOnly},
+		{"unknown", "", ErrMethodNotValid},
+		{"status", "foo=1", ErrInvalidQuery},
+		{"status", "timestamp=x", ErrInvalidQuery},
+		{"status", "reply=a&reply=b", ErrInvalidQuery},
+	} {
+		ctx, _, err := r.query(t, tc.method, tc.params)
+		if !errors.Is(err, tc.err) {
+			t.Fatalf("%s?%s: expected error %v, got %v", tc.method, tc.params, tc.err, err)
+		}
+		if ctx.etag != "" || ctx.maxAge != 0 {
+			t.Fatalf("%s?%s: error reply cached", tc.method, tc.params)
+		}
+	}
+}
@@ -4,6 +4,8 @@ package router
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -24,6 +26,16 @@ type RouterRequest struct {
 	SignaturePublicKey []byte
 	Private            bool
 	Signer             *ethereum.SignKeys
+	// Identity is the client identity verified by the transport (TLS client
+	// certificate), nil if the transport did not authenticate the client
+	Identity *transports.ClientIdentity
+	// Session is true if the request was not signed, and Address is the one
+	// authenticated by the session of the connection
+	Session bool
+	// CacheMaxAge is the time the reply to a query can be cached, see SetReadOnly
+	CacheMaxAge time.Duration
+
+	payload json.RawMessage
 }
 
 type RequestMessage struct {
@@ -43,6 +55,8 @@ type ResponseMessage struct {
 type registeredMethod struct {
 	public        bool
 	skipSignature bool
+	readOnly      bool
+	maxAge        time.Duration
 	handler       func(RouterRequest)
 }
 
@@ -53,6 +67,9 @@ type Router struct {
 	methods     map[string]registeredMethod
 	inbound     <-chan transports.Message
 	signer      *ethereum.SignKeys
+	identities  map[string]bool
+	calls       map[string]*pendingCall
+	lock        sync.RWMutex
 }
 
 // NewRouter creates a router multiplexer instance
@@ -60,6 +77,8 @@ func NewRouter(inbound <-chan transports.Message, transports map[string]transpor
 	signer *ethereum.SignKeys, messageTypeFunc func() transports.MessageAPI) *Router {
 	r := new(Router)
 	r.methods = make(map[string]registeredMethod)
+	r.identities = make(map[string]bool)
+	r.calls = make(map[string]*pendingCall)
 	r.inbound = inbound
 	r.Transports = transports
 	r.signer = signer
@@ -78,21 +97,27 @@ func (r *Router) AddHandler(method, namespace string, handler func(RouterRequest
 
 // Route routes requests through the Router object
 func (r *Router) Route() {
-	if len(r.methods) == 0 {
+	r.lock.RLock()
+	registered := len(r.methods)
+	r.lock.RUnlock()
+	if registered == 0 {
 		log.Warnf("router methods are not properly initialized")
 		return
 	}
 	for {
 		msg := <-r.inbound
+		if r.deliverReply(msg) {
+			continue
+		}
 		request, err := r.getRequest(msg.Namespace, msg.Data, msg.Context)
 		if err != nil {
 			go r.SendError(request, err.Error())
 			continue
 		}
 
-		method := r.methods[msg.Namespace+request.Method]
+		method, _ := r.method(msg.Namespace + request.Method)
 		if !method.skipSignature && !request.Authenticated {
-			go r.SendError(request, "invalid authentication")
+			go r.SendError(request, ErrInvalidAuthentication.Error())
 			continue
 		}
 		log.Infof("calling api method %s/%s", msg.Namespace, request.Method)
@@ -103,18 +128,24 @@ func (r *Router) Route() {
 func (r *Router) getRequest(namespace string, payload []byte, context transports.MessageContext) (request RouterRequest, err error) {
 	// In the case of errors, we need the context to reply too.
 	request.MessageContext = context
+	if qc, ok := context.(transports.QueryContext); ok {
+		if method, params, ok := qc.Query(); ok {
+			return r.getQueryRequest(namespace, method, params, context)
+		}
+	}
 
 	// First unmarshal the outer layer, to obtain the request ID, the signed
 	// request, and the signature.
 	log.Debugf("got request: %s", payload)
 	reqOuter := &RequestMessage{}
 	if len(payload) < 22 { // 22 = min num characters json_tags+method+request
-		return request, fmt.Errorf("empty payload")
+		return request, ErrEmptyPayload
 	}
 	if err := json.Unmarshal(payload, &reqOuter); err != nil {
 		return request, err
 	}
 	request.Id = reqOuter.ID
+	request.payload = reqOuter.MessageAPI
 	request.Message = r.messageType()
 	if err := json.Unmarshal(reqOuter.MessageAPI, request.Message); err != nil {
 		return request, err
@@ -123,17 +154,39 @@ func (r *Router) getRequest(namespace string, payload []byte, context transports
 	request.Method = request.Message.GetMethod()
 
 	if request.Method == "" {
-		return request, fmt.Errorf("method is empty")
+		return request, ErrMethodEmpty
 	}
 
-	method, ok := r.methods[namespace+request.Method]
+	method, ok := r.method(namespace + request.Method)
 	if !ok {
-		return request, fmt.Errorf("method not valid: (%s)", request.Method)
+		return request, fmt.Errorf("%w: (%s)", ErrMethodNotValid, request.Method)
+	}
+
+	// The clients authenticated by the transport with an authorized identity
+	// can call the private methods without signing the request
+	if ic, ok := context.(transports.IdentityContext); ok {
+		if request.Identity = ic.ClientIdentity(); request.Identity != nil {
+			log.Debugf("client identity: %s (%s)", request.Identity.Subject, request.Identity.Fingerprint)
+			request.Private = !method.public
+			request.Authenticated = r.identityAuthorized(request.Identity)
+		}
 	}
 
-	if !method.skipSignature {
+	// The requests without signature on a connection with an authenticated
+	// session come from the session address
+	if !method.skipSignature && !request.Authenticated && len(reqOuter.Signature) == 0 {
+		if addr, ok := sessionAddress(context); ok {
+			log.Debugf("session address: %s", addr.Hex())
+			request.Address = addr
+			request.Session = true
+			request.Private = !method.public
+			request.Authenticated = method.public || r.signer.Authorized[addr]
+		}
+	}
+
+	if !method.skipSignature && !((request.Authenticated || request.Session) && len(reqOuter.Signature) == 0) {
 		if len(reqOuter.Signature) != ethereum.SignatureLength {
-			return request, fmt.Errorf("no signature provided or invalid lenght")
+			return request, ErrInvalidSignature
 		}
 		var sigBytes []byte
 		if err = reqOuter.Signature.UnmarshalJSON(sigBytes); err != nil {
@@ -153,14 +206,9 @@ func (r *Router) getRequest(namespace string, payload []byte, context transports
 		log.Debugf("recovered signer address: %s", request.Address.Hex())
 		request.Private = !method.public
 
-		// If private method, check authentication
-		if method.public {
-			request.Authenticated = true
-		} else {
-			if r.signer.Authorized[request.Address] {
-				request.Authenticated = true
-			}
-		}
+		// If private method, check authentication. A signer must be
+		// authorized even if the client identity already is
+		request.Authenticated = method.public || r.signer.Authorized[request.Address]
 	}
 
 	// Add the signer for signing the reply
@@ -168,7 +216,17 @@ func (r *Router) getRequest(namespace string, payload []byte, context transports
 	return request, err
 }
 
+// method returns the registered method of the namespace+method key
+func (r *Router) method(key string) (registeredMethod, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	m, ok := r.methods[key]
+	return m, ok
+}
+
 func (r *Router) registerPrivate(namespace, method string, handler func(RouterRequest)) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if _, ok := r.methods[namespace+method]; ok {
 		return fmt.Errorf("duplicate method %s for namespace %s", method, namespace)
 	}
@@ -177,6 +235,8 @@ func (r *Router) registerPrivate(namespace, method string, handler func(RouterRe
 }
 
 func (r *Router) registerPublic(namespace, method string, handler func(RouterRequest), skipSignature bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
 	if _, ok := r.methods[namespace+method]; ok {
 		return fmt.Errorf("duplicate method %s for namespace %s", method, namespace)
 	}
@@ -249,13 +309,43 @@ func (r *Router) DelAuthKey(addr common.Address) {
 	delete(r.signer.Authorized, addr)
 }
 
+// AddAuthIdentity adds a client certificate fingerprint (hex encoded SHA-256)
+// that will have access to private methods
+func (r *Router) AddAuthIdentity(fingerprint string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.identities[strings.ToLower(fingerprint)] = true
+}
+
+// DelAuthIdentity deletes a client certificate fingerprint from the authorized list
+func (r *Router) DelAuthIdentity(fingerprint string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.identities, strings.ToLower(fingerprint))
+}
+
+func (r *Router) identityAuthorized(id *transports.ClientIdentity) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.identities[id.Fingerprint]
+}
+
 // BuildReply builds a response message (set ID, Timestamp and Signature)
 func BuildReply(response transports.MessageAPI, request RouterRequest) transports.Message {
-	var err error
-	respRequest := &ResponseMessage{ID: request.Id}
-
 	response.SetID(request.Id)
+	if qc, ok := request.MessageContext.(transports.QueryContext); ok {
+		if _, _, ok := qc.Query(); ok {
+			setCache(qc, response, request.CacheMaxAge)
+		}
+	}
 	response.SetTimestamp(int32(time.Now().Unix()))
+	return buildReply(response, request)
+}
+
+// buildReply signs the sorted JSON of response and wraps it in a ResponseMessage
+func buildReply(response interface{}, request RouterRequest) transports.Message {
+	var err error
+	respRequest := &ResponseMessage{ID: request.Id}
 	respRequest.MessageAPI, err = crypto.SortedMarshalJSON(response)
 	if err != nil {
 		// This should never happen. If it does, return a very simple
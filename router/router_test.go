@@ -0,0 +1,193 @@
+package router
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+type testAPI struct {
+	ID        string `json:"request"`
+	Method    string `json:"method,omitempty"`
+	Timestamp int32  `json:"timestamp"`
+	Error     string `json:"error,omitempty"`
+	Reply     string `json:"reply,omitempty"`
+	// Fields added by the session handlers
+	Challenge string `json:"challenge,omitempty"`
+	Address   string `json:"address,omitempty"`
+}
+
+func (ta *testAPI) GetID() string        { return ta.ID }
+func (ta *testAPI) SetID(id string)      { ta.ID = id }
+func (ta *testAPI) SetTimestamp(t int32) { ta.Timestamp = t }
+func (ta *testAPI) SetError(e string)    { ta.Error = e }
+func (ta *testAPI) GetMethod() string    { return ta.Method }
+
+func newTestAPI() transports.MessageAPI { return &testAPI{} }
+
+// testContext is the context of a client connection, with an optional
+// verified identity and session
+type testContext struct {
+	identity *transports.ClientIdentity
+	session  *transports.Session
+	replies  chan transports.Message
+}
+
+func newTestContext() *testContext {
+	return &testContext{replies: make(chan transports.Message, 16)}
+}
+
+func (c *testContext) ConnectionType() string { return "test" }
+
+func (c *testContext) Send(msg transports.Message) error {
+	c.replies <- msg
+	return nil
+}
+
+func (c *testContext) ClientIdentity() *transports.ClientIdentity { return c.identity }
+func (c *testContext) ConnSession() *transports.Session           { return c.session }
+
+func newSigner(t *testing.T) *ethereum.SignKeys {
+	t.Helper()
+	s := ethereum.NewSignKeys()
+	if err := s.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testRouter is a router serving /main with the session handlers, whose
+// handlers reply with the address of the request
+type testRouter struct {
+	*Router
+	inbound chan transports.Message
+	lastID  int
+}
+
+func newTestRouter(t *testing.T) *testRouter {
+	inbound := make(chan transports.Message)
+	r := &testRouter{Router: NewRouter(inbound, nil, newSigner(t), newTestAPI), inbound: inbound}
+	reply := func(rr RouterRequest) {
+		rr.Send(BuildReply(&testAPI{Reply: rr.Address.Hex()}, rr))
+	}
+	if err := r.AddHandler("hello", "/main", reply, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddHandler("secret", "/main", reply, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.AddSessionHandlers("/main"); err != nil {
+		t.Fatal(err)
+	}
+	go r.Route()
+	return r
+}
+
+// request sends the request fields, signed by signer if not nil, on ctx and
+// returns the reply. The error replied by the router is returned as an error.
+func (r *testRouter) request(t *testing.T, ctx *testContext, signer *ethereum.SignKeys,
+	fields map[string]interface{}) (*testAPI, error) {
+	t.Helper()
+	r.lastID++
+	id := fmt.Sprintf("%d", r.lastID)
+	fields["request"] = id
+	fields["timestamp"] = time.Now().Unix()
+	inner, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := RequestMessage{ID: id, MessageAPI: inner}
+	if signer != nil {
+		if req.Signature, err = signer.Sign(inner); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.inbound <- transports.Message{Data: data, Namespace: "/main", Context: ctx}
+
+	var msg transports.Message
+	select {
+	case msg = <-ctx.replies:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request %s not replied", fields["method"])
+	}
+	var resp ResponseMessage
+	if err := json.Unmarshal(msg.Data, &resp); err != nil {
+		t.Fatal(err)
+	}
+	reply := new(testAPI)
+	if err := json.Unmarshal(resp.MessageAPI, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Error != "" {
+		if re := MatchReplyError(reply.Error); re != nil {
+			return reply, re
+		}
+		return reply, errors.New(reply.Error)
+	}
+	return reply, nil
+}
+
+// call sends a request of method, signed by signer if not nil
+func (r *testRouter) call(t *testing.T, ctx *testContext, signer *ethereum.SignKeys, method string) (*testAPI, error) {
+	t.Helper()
+	return r.request(t, ctx, signer, map[string]interface{}{"method": method})
+}
+
+func TestIdentityAuth(t *testing.T) {
+	r := newTestRouter(t)
+	authorized := newSigner(t)
+	r.AddAuthKey(authorized.Address())
+	unauthorized := newSigner(t)
+
+	cert := newTestContext()
+	cert.identity = &transports.ClientIdentity{Subject: "CN=client", Fingerprint: "5c1de9a0"}
+
+	// The fingerprints are matched case insensitively
+	r.AddAuthIdentity("5C1DE9A0")
+	if _, err := r.call(t, cert, nil, "secret"); err != nil {
+		t.Fatalf("authorized identity: %v", err)
+	}
+	// A client with an authorized identity can also sign, the signer must be
+	// authorized too as the request comes from its address
+	if _, err := r.call(t, cert, unauthorized, "secret"); !errors.Is(err, ErrInvalidAuthentication) {
+		t.Fatalf("authorized identity and unauthorized address: expected invalid authentication, got %v", err)
+	}
+	reply, err := r.call(t, cert, authorized, "secret")
+	if err != nil {
+		t.Fatalf("authorized identity and address: %v", err)
+	}
+	if reply.Reply != authorized.Address().Hex() {
+		t.Fatalf("got address %s, want %s", reply.Reply, authorized.Address().Hex())
+	}
+
+	// Without an authorized identity, the client falls back to the signatures
+	r.DelAuthIdentity("5c1de9a0")
+	if _, err := r.call(t, cert, nil, "secret"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("unauthorized identity without signature: expected invalid signature, got %v", err)
+	}
+	if _, err := r.call(t, cert, unauthorized, "secret"); !errors.Is(err, ErrInvalidAuthentication) {
+		t.Fatalf("unauthorized identity and address: expected invalid authentication, got %v", err)
+	}
+	reply, err = r.call(t, cert, authorized, "secret")
+	if err != nil {
+		t.Fatalf("unauthorized identity and authorized address: %v", err)
+	}
+	if reply.Reply != authorized.Address().Hex() {
+		t.Fatalf("got address %s, want %s", reply.Reply, authorized.Address().Hex())
+	}
+
+	// A client without identity is not authenticated by the fingerprints
+	r.AddAuthIdentity("5c1de9a0")
+	if _, err := r.call(t, newTestContext(), nil, "secret"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("no identity: expected invalid signature, got %v", err)
+	}
+}
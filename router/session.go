@@ -0,0 +1,124 @@
+package router
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	ethcommon "github.com/ethereum/go-ethereum/common"
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/log"
+)
+
+// Methods of the session handshake. The client gets a challenge, and then
+// signs a request with it. The later requests on the same connection can be
+// sent without signature, they come from the signer address until the
+// connection is closed.
+const (
+	SessionChallengeMethod = "sessionChallenge"
+	SessionAuthMethod      = "sessionAuth"
+
+	sessionChallengeKey = "router.sessionChallenge"
+	sessionAddressKey   = "router.sessionAddress"
+)
+
+// AddSessionHandlers enables the session handshake on namespace. The challenge
+// is replied on the "challenge" field, and must be sent back on the
+// "challenge" field of the signed SessionAuthMethod request. Only the
+// transports keeping a session per connection (websockets) support it.
+func (r *Router) AddSessionHandlers(namespace string) error {
+	if err := r.registerPublic(namespace, SessionChallengeMethod, r.sessionChallenge, true); err != nil {
+		return err
+	}
+	return r.registerPublic(namespace, SessionAuthMethod, r.sessionAuth, false)
+}
+
+func (r *Router) sessionChallenge(request RouterRequest) {
+	session := connSession(request.MessageContext)
+	if session == nil {
+		r.SendError(request, ErrSessionUnsupported.Error())
+		return
+	}
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		r.SendError(request, err.Error())
+		return
+	}
+	session.Set(sessionChallengeKey, hex.EncodeToString(challenge))
+	r.sendSessionReply(request, "challenge", hex.EncodeToString(challenge))
+}
+
+func (r *Router) sessionAuth(request RouterRequest) {
+	session := connSession(request.MessageContext)
+	if session == nil {
+		r.SendError(request, ErrSessionUnsupported.Error())
+		return
+	}
+	// The session cannot be authenticated with itself or a client certificate
+	if request.Session || len(request.SignaturePublicKey) == 0 {
+		r.SendError(request, ErrInvalidSignature.Error())
+		return
+	}
+	var req struct {
+		Challenge string `json:"challenge"`
+	}
+	if err := json.Unmarshal(request.payload, &req); err != nil {
+		r.SendError(request, err.Error())
+		return
+	}
+	// The challenge can only be used once
+	challenge, ok := session.Get(sessionChallengeKey)
+	session.Delete(sessionChallengeKey)
+	if !ok || req.Challenge == "" ||
+		subtle.ConstantTimeCompare([]byte(req.Challenge), []byte(challenge.(string))) != 1 {
+		r.SendError(request, ErrInvalidChallenge.Error())
+		return
+	}
+	session.Set(sessionAddressKey, request.Address)
+	log.Infof("session authenticated for %s", request.Address.Hex())
+	r.sendSessionReply(request, "address", request.Address.Hex())
+}
+
+// sendSessionReply replies with a message of the router type with an additional field
+func (r *Router) sendSessionReply(request RouterRequest, field, value string) {
+	message := r.messageType()
+	message.SetID(request.Id)
+	message.SetTimestamp(int32(time.Now().Unix()))
+	data, err := json.Marshal(message)
+	if err != nil {
+		r.SendError(request, err.Error())
+		return
+	}
+	response := make(map[string]interface{})
+	if err := json.Unmarshal(data, &response); err != nil {
+		r.SendError(request, err.Error())
+		return
+	}
+	response[field] = value
+	if err := request.Send(buildReply(response, request)); err != nil {
+		log.Warn(err)
+	}
+}
+
+// connSession returns the session of the message connection, nil if it has none
+func connSession(ctx transports.MessageContext) *transports.Session {
+	if sc, ok := ctx.(transports.SessionContext); ok {
+		return sc.ConnSession()
+	}
+	return nil
+}
+
+// sessionAddress returns the address authenticated by the session of the message connection
+func sessionAddress(ctx transports.MessageContext) (ethcommon.Address, bool) {
+	session := connSession(ctx)
+	if session == nil {
+		return ethcommon.Address{}, false
+	}
+	addr, ok := session.Get(sessionAddressKey)
+	if !ok {
+		return ethcommon.Address{}, false
+	}
+	return addr.(ethcommon.Address), true
+}
@@ -0,0 +1,118 @@
+package router
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+// challenge asks for a session challenge on ctx
+func (r *testRouter) challenge(t *testing.T, ctx *testContext) string {
+	t.Helper()
+	reply, err := r.call(t, ctx, nil, SessionChallengeMethod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Challenge == "" {
+		t.Fatal("no challenge replied")
+	}
+	return reply.Challenge
+}
+
+// sessionAuth sends the challenge signed by signer, unsigned if nil
+func (r *testRouter) sessionAuth(t *testing.T, ctx *testContext, signer *ethereum.SignKeys, challenge string) error {
+	t.Helper()
+	_, err := r.request(t, ctx, signer, map[string]interface{}{"method": SessionAuthMethod, "challenge": challenge})
+	return err
+}
+
+func newSessionContext() *testContext {
+	ctx := newTestContext()
+	ctx.session = transports.NewSession()
+	return ctx
+}
+
+func TestSession(t *testing.T) {
+	r := newTestRouter(t)
+	authorized := newSigner(t)
+	r.AddAuthKey(authorized.Address())
+	guest := newSigner(t)
+
+	for _, signer := range []*ethereum.SignKeys{authorized, guest} {
+		ctx := newSessionContext()
+		// The requests are sent without signature
+		if _, err := r.call(t, ctx, nil, "hello"); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("expected invalid signature before the handshake, got %v", err)
+		}
+		if err := r.sessionAuth(t, ctx, signer, r.challenge(t, ctx)); err != nil {
+			t.Fatal(err)
+		}
+		reply, err := r.call(t, ctx, nil, "hello")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.Reply != signer.Address().Hex() {
+			t.Fatalf("got address %s, want %s", reply.Reply, signer.Address().Hex())
+		}
+		_, err = r.call(t, ctx, nil, "secret")
+		if signer == authorized && err != nil {
+			t.Fatalf("authorized session cannot call the private method: %v", err)
+		}
+		if signer == guest && !errors.Is(err, ErrInvalidAuthentication) {
+			t.Fatalf("unauthorized session: expected invalid authentication, got %v", err)
+		}
+		// The session cannot authenticate itself again without signature
+		if err := r.sessionAuth(t, ctx, nil, r.challenge(t, ctx)); !errors.Is(err, ErrInvalidSignature) {
+			t.Fatalf("unsigned session auth: expected invalid signature, got %v", err)
+		}
+	}
+
+	// The session is bound to the connection
+	if _, err := r.call(t, newSessionContext(), nil, "hello"); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("expected invalid signature on a new connection, got %v", err)
+	}
+
+	// A challenge is used only once, even if the authentication failed
+	ctx := newSessionContext()
+	challenge := r.challenge(t, ctx)
+	if err := r.sessionAuth(t, ctx, guest, "00"); !errors.Is(err, ErrInvalidChallenge) {
+		t.Fatalf("wrong challenge: expected invalid challenge, got %v", err)
+	}
+	if err := r.sessionAuth(t, ctx, guest, challenge); !errors.Is(err, ErrInvalidChallenge) {
+		t.Fatalf("challenge after a failed attempt: expected invalid challenge, got %v", err)
+	}
+	challenge = r.challenge(t, ctx)
+	if err := r.sessionAuth(t, ctx, guest, challenge); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.sessionAuth(t, ctx, guest, challenge); !errors.Is(err, ErrInvalidChallenge) {
+		t.Fatalf("reused challenge: expected invalid challenge, got %v", err)
+	}
+	// Nor on another connection
+	other := newSessionContext()
+	r.challenge(t, other)
+	if err := r.sessionAuth(t, other, guest, challenge); !errors.Is(err, ErrInvalidChallenge) {
+		t.Fatalf("challenge of another connection: expected invalid challenge, got %v", err)
+	}
+
+	// A client authenticated only by its certificate cannot open a session
+	cert := newSessionContext()
+	cert.identity = &transports.ClientIdentity{Subject: "CN=client", Fingerprint: "5c1de9a0"}
+	r.AddAuthIdentity("5c1de9a0")
+	if err := r.sessionAuth(t, cert, nil, r.challenge(t, cert)); !errors.Is(err, ErrInvalidSignature) {
+		t.Fatalf("cert-only session auth: expected invalid signature, got %v", err)
+	}
+	if _, err := r.call(t, cert, nil, "hello"); err != nil {
+		t.Fatalf("authorized identity: %v", err)
+	}
+	if _, ok := sessionAddress(cert); ok {
+		t.Fatal("session authenticated by a client certificate")
+	}
+
+	// The transports without sessions do not support the handshake
+	if _, err := r.call(t, newTestContext(), nil, SessionChallengeMethod); !errors.Is(err, ErrSessionUnsupported) {
+		t.Fatalf("expected session unsupported, got %v", err)
+	}
+}
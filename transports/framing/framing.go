@@ -0,0 +1,181 @@
+// Package framing provides the message framing used by the stream based
+// transports (unix sockets, TCP and stdio).
+package framing
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"sync"
+)
+
+// DefaultMaxFrameSize is the default maximum size of a read frame
+const DefaultMaxFrameSize = 1 << 20
+
+// Framing delimits the messages on a byte stream
+type Framing interface {
+	// ReadFrame reads the next message. Frames bigger than maxSize are rejected.
+	ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error)
+	// WriteFrame writes a message.
+	WriteFrame(w io.Writer, data []byte) error
+	// Name returns the framing name, as accepted by ByName.
+	Name() string
+}
+
+// Newline delimits each message with a newline character. The messages
+// must not contain newlines, which is the case of the compact JSON.
+var Newline Framing = newline{}
+
+// LengthPrefixed prefixes each message with its length as a 4 bytes big endian integer.
+var LengthPrefixed Framing = lengthPrefixed{}
+
+// ContentLength prefixes each message with a Content-Length header, as the
+// Language Server Protocol does.
+var ContentLength Framing = contentLength{}
+
+// ByName returns the framing identified by name: newline, length or content-length
+func ByName(name string) (Framing, error) {
+	for _, f := range []Framing{Newline, LengthPrefixed, ContentLength} {
+		if f.Name() == name {
+			return f, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown framing %q", name)
+}
+
+type newline struct{}
+
+func (newline) Name() string { return "newline" }
+
+func (newline) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	for {
+		var frame []byte
+		for {
+			line, isPrefix, err := r.ReadLine()
+			if err != nil {
+				return nil, err
+			}
+			if len(frame)+len(line) > maxSize {
+				return nil, fmt.Errorf("frame size exceeds the maximum of %d bytes", maxSize)
+			}
+			frame = append(frame, line...)
+			if !isPrefix {
+				break
+			}
+		}
+		// Skip the empty lines
+		if frame = bytes.TrimSpace(frame); len(frame) > 0 {
+			return frame, nil
+		}
+	}
+}
+
+func (newline) WriteFrame(w io.Writer, data []byte) error {
+	if bytes.IndexByte(data, '\n') >= 0 {
+		return fmt.Errorf("newline framed messages cannot contain newlines")
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	_, err := w.Write([]byte{'\n'})
+	return err
+}
+
+type lengthPrefixed struct{}
+
+func (lengthPrefixed) Name() string { return "length" }
+
+func (lengthPrefixed) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(size[:])
+	if uint64(n) > uint64(maxSize) {
+		return nil, fmt.Errorf("frame size %d exceeds the maximum of %d bytes", n, maxSize)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (lengthPrefixed) WriteFrame(w io.Writer, data []byte) error {
+	frame := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(frame, uint32(len(data)))
+	copy(frame[4:], data)
+	_, err := w.Write(frame)
+	return err
+}
+
+type contentLength struct{}
+
+func (contentLength) Name() string { return "content-length" }
+
+func (contentLength) ReadFrame(r *bufio.Reader, maxSize int) ([]byte, error) {
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid Content-Length header %q", header.Get("Content-Length"))
+	}
+	if n > maxSize {
+		return nil, fmt.Errorf("frame size %d exceeds the maximum of %d bytes", n, maxSize)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
+
+func (contentLength) WriteFrame(w io.Writer, data []byte) error {
+	frame := append([]byte(fmt.Sprintf("Content-Length: %d\r\n\r\n", len(data))), data...)
+	_, err := w.Write(frame)
+	return err
+}
+
+// Conn reads and writes framed messages on a stream. The writes are
+// serialized, so WriteFrame can be called concurrently.
+type Conn struct {
+	MaxFrameSize int
+
+	rw      io.ReadWriteCloser
+	r       *bufio.Reader
+	framing Framing
+	wlock   sync.Mutex
+}
+
+// NewConn creates a framed connection over rw
+func NewConn(rw io.ReadWriteCloser, f Framing) *Conn {
+	return &Conn{
+		MaxFrameSize: DefaultMaxFrameSize,
+		rw:           rw,
+		r:            bufio.NewReader(rw),
+		framing:      f,
+	}
+}
+
+// ReadFrame reads the next message. It must not be called concurrently.
+func (c *Conn) ReadFrame() ([]byte, error) {
+	return c.framing.ReadFrame(c.r, c.MaxFrameSize)
+}
+
+// WriteFrame writes a message
+func (c *Conn) WriteFrame(data []byte) error {
+	c.wlock.Lock()
+	defer c.wlock.Unlock()
+	return c.framing.WriteFrame(c.rw, data)
+}
+
+// Close closes the underlying stream
+func (c *Conn) Close() error {
+	return c.rw.Close()
+}
@@ -0,0 +1,50 @@
+package transports
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+)
+
+// ClientIdentity is the identity of a client authenticated by the transport
+// with a verified TLS client certificate
+type ClientIdentity struct {
+	Subject        string
+	CommonName     string
+	DNSNames       []string
+	EmailAddresses []string
+	URIs           []string
+	IPAddresses    []string
+	// Fingerprint is the hex encoded SHA-256 of the certificate (DER)
+	Fingerprint string
+
+	Certificate *x509.Certificate `json:"-"`
+}
+
+// IdentityContext is implemented by the message contexts able to carry the
+// identity of an authenticated client
+type IdentityContext interface {
+	// ClientIdentity returns the verified client identity, or nil if the
+	// client was not authenticated by the transport
+	ClientIdentity() *ClientIdentity
+}
+
+// NewClientIdentity returns the identity of a verified client certificate
+func NewClientIdentity(cert *x509.Certificate) *ClientIdentity {
+	sum := sha256.Sum256(cert.Raw)
+	id := &ClientIdentity{
+		Subject:        cert.Subject.String(),
+		CommonName:     cert.Subject.CommonName,
+		DNSNames:       cert.DNSNames,
+		EmailAddresses: cert.EmailAddresses,
+		Fingerprint:    hex.EncodeToString(sum[:]),
+		Certificate:    cert,
+	}
+	for _, u := range cert.URIs {
+		id.URIs = append(id.URIs, u.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		id.IPAddresses = append(id.IPAddresses, ip.String())
+	}
+	return id
+}
@@ -0,0 +1,340 @@
+// Package ipc provides a transport serving the router over a unix domain socket
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/framing"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// DefaultSocketMode is the default file mode of the socket, only the owner can connect
+	DefaultSocketMode os.FileMode = 0o600
+	// DefaultReplyTimeout is the default time a request is considered in flight without reply
+	DefaultReplyTimeout = 30 * time.Second
+)
+
+// IPCContext is the MessageContext of the messages received on the unix socket
+type IPCContext struct {
+	Conn   *framing.Conn
+	ConnID string
+
+	release func()
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (c *IPCContext) ConnectionType() string {
+	return "IPC"
+}
+
+// Send writes the message to the client connection which sent the request
+func (c *IPCContext) Send(msg transports.Message) error {
+	if c.release != nil {
+		defer c.release()
+	}
+	return c.Conn.WriteFrame(msg.Data)
+}
+
+// IPCHandle serves the router over a unix domain socket. The socket path is
+// taken from the Connection Address. The access is controlled by the socket
+// file permissions (SocketMode) and group (SocketGroup). A request not replied
+// after ReplyTimeout no longer counts as in flight, its reply can still be sent.
+type IPCHandle struct {
+	Conn         *transports.Connection
+	Framing      framing.Framing
+	SocketMode   os.FileMode
+	SocketGroup  *int // group ID owning the socket file, the default one if nil
+	MaxFrameSize int
+	ReplyTimeout time.Duration
+
+	listener         net.Listener
+	namespace        string
+	internalReceiver chan transports.Message
+	clients          map[string]*framing.Conn
+	lastID           uint64
+	closing          bool          // set when Close stops accepting requests
+	closed           chan struct{} // closed when the requests are no longer forwarded
+	closeOnce        sync.Once
+	inflight         sync.WaitGroup
+	lock             sync.RWMutex
+}
+
+// NewIPCHandle returns an IPC transport using the given framing
+func NewIPCHandle(f framing.Framing) *IPCHandle {
+	return &IPCHandle{Framing: f}
+}
+
+// Init creates the unix socket on the Connection Address path. A stale socket
+// file on the same path is removed, but not a socket some other process is
+// still serving on, nor any other kind of file. The socket is created in a
+// private directory and moved to the path once its mode and group are set.
+func (i *IPCHandle) Init(c *transports.Connection) error {
+	if c == nil || c.Address == "" {
+		return fmt.Errorf("ipc socket path not specified")
+	}
+	if i.Framing == nil {
+		i.Framing = framing.Newline
+	}
+	if i.SocketMode == 0 {
+		i.SocketMode = DefaultSocketMode
+	}
+	if i.MaxFrameSize == 0 {
+		i.MaxFrameSize = framing.DefaultMaxFrameSize
+	}
+	if i.ReplyTimeout == 0 {
+		i.ReplyTimeout = DefaultReplyTimeout
+	}
+	if fi, err := os.Stat(c.Address); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return fmt.Errorf("%s exists and is not a socket", c.Address)
+		}
+		if conn, err := net.Dial("unix", c.Address); err == nil {
+			conn.Close()
+			return fmt.Errorf("socket %s is in use", c.Address)
+		}
+		if err := os.Remove(c.Address); err != nil {
+			return err
+		}
+	}
+	dir, err := os.MkdirTemp(filepath.Dir(c.Address), ".ipc")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+	tmp := filepath.Join(dir, "s")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return err
+	}
+	// The socket file is removed by Close from its final path
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	fail := func(err error) error {
+		ln.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Chmod(tmp, i.SocketMode); err != nil {
+		return fail(err)
+	}
+	if i.SocketGroup != nil {
+		if err := os.Chown(tmp, -1, *i.SocketGroup); err != nil {
+			return fail(err)
+		}
+	}
+	if err := os.Rename(tmp, c.Address); err != nil {
+		return fail(err)
+	}
+	i.Conn = c
+	i.listener = ln
+	i.internalReceiver = make(chan transports.Message, 1)
+	i.clients = make(map[string]*framing.Conn)
+	i.closed = make(chan struct{})
+	log.Infof("ipc transport listening on %s (%s framing)", c.Address, i.Framing.Name())
+	return nil
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (i *IPCHandle) ConnectionType() string {
+	return "IPC"
+}
+
+// Listen accepts the client connections and writes their requests into the receiver channel
+func (i *IPCHandle) Listen(receiver chan<- transports.Message) {
+	go i.forward(receiver)
+	go i.accept()
+}
+
+// forward writes the requests into the receiver until the handle is closed,
+// after the in-flight requests are drained. The request left is released.
+func (i *IPCHandle) forward(receiver chan<- transports.Message) {
+	for {
+		select {
+		case msg := <-i.internalReceiver:
+			select {
+			case receiver <- msg:
+			case <-i.closed:
+				msg.Context.(*IPCContext).release()
+				return
+			}
+		case <-i.closed:
+			return
+		}
+	}
+}
+
+func (i *IPCHandle) accept() {
+	for {
+		conn, err := i.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warnf("ipc accept error: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Debugf("ipc listener closed: %v", err)
+			return
+		}
+		go i.handleConn(conn)
+	}
+}
+
+// handleConn reads the requests of a client until the connection is closed
+func (i *IPCHandle) handleConn(conn net.Conn) {
+	fc := framing.NewConn(conn, i.Framing)
+	fc.MaxFrameSize = i.MaxFrameSize
+	i.lock.Lock()
+	i.lastID++
+	id := fmt.Sprintf("ipc-%d", i.lastID)
+	i.clients[id] = fc
+	i.lock.Unlock()
+	defer func() {
+		i.lock.Lock()
+		delete(i.clients, id)
+		i.lock.Unlock()
+		fc.Close()
+	}()
+	log.Debugf("ipc client %s connected", id)
+	for {
+		data, err := fc.ReadFrame()
+		if err != nil {
+			log.Debugf("ipc client %s disconnected: %v", id, err)
+			return
+		}
+		i.lock.RLock()
+		namespace := i.namespace
+		if i.closing {
+			// The requests received while closing are dropped
+			i.lock.RUnlock()
+			return
+		}
+		i.inflight.Add(1)
+		i.lock.RUnlock()
+		var once sync.Once
+		free := func() { once.Do(i.inflight.Done) }
+		timer := time.AfterFunc(i.ReplyTimeout, func() {
+			log.Debugf("request of ipc client %s not replied after %s", id, i.ReplyTimeout)
+			free()
+		})
+		release := func() {
+			timer.Stop()
+			free()
+		}
+		select {
+		case i.internalReceiver <- transports.Message{
+			Data:      data,
+			TimeStamp: int32(time.Now().Unix()),
+			Namespace: namespace,
+			Context:   &IPCContext{Conn: fc, ConnID: id, release: release},
+		}:
+		case <-i.closed:
+			release()
+			return
+		}
+	}
+}
+
+// Send replies to the client of the message context. If the message has no
+// context, it is sent to all the connected clients.
+func (i *IPCHandle) Send(msg transports.Message) error {
+	if msg.Context != nil {
+		ic, ok := msg.Context.(*IPCContext)
+		if !ok {
+			return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+		}
+		return ic.Send(msg)
+	}
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	for id, c := range i.clients {
+		if err := c.WriteFrame(msg.Data); err != nil {
+			log.Debugf("cannot send message to ipc client %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// SendUnicast sends the message to the client connection identified by address
+func (i *IPCHandle) SendUnicast(address string, msg transports.Message) error {
+	i.lock.RLock()
+	c, ok := i.clients[address]
+	i.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no ipc client with address %s", address)
+	}
+	return c.WriteFrame(msg.Data)
+}
+
+// AddNamespace sets the namespace of the received messages. A unix socket
+// serves a single namespace.
+func (i *IPCHandle) AddNamespace(namespace string) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.namespace != "" && i.namespace != namespace {
+		return fmt.Errorf("ipc transport already serves namespace %s", i.namespace)
+	}
+	i.namespace = namespace
+	return nil
+}
+
+// Address returns the socket path
+func (i *IPCHandle) Address() string {
+	return i.Conn.Address
+}
+
+func (i *IPCHandle) SetBootnodes(bootnodes []string) {
+	// No bootnodes on ipc handler
+}
+
+func (i *IPCHandle) AddPeer(peer string) error {
+	// No peers on ipc handler
+	return nil
+}
+
+// Close stops accepting connections, waits until ctx is done for the replies
+// of the in-flight requests, closes the connected clients and removes the
+// socket file.
+func (i *IPCHandle) Close(ctx context.Context) error {
+	var err error
+	i.closeOnce.Do(func() {
+		i.lock.Lock()
+		i.closing = true
+		i.lock.Unlock()
+		err = i.listener.Close()
+		if rerr := os.Remove(i.Conn.Address); rerr != nil && err == nil {
+			err = rerr
+		}
+
+		drained := make(chan struct{})
+		go func() {
+			i.inflight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		close(i.closed)
+
+		i.lock.Lock()
+		defer i.lock.Unlock()
+		for _, c := range i.clients {
+			c.Close()
+		}
+	})
+	return err
+}
+
+func (i *IPCHandle) String() string {
+	i.lock.RLock()
+	defer i.lock.RUnlock()
+	return fmt.Sprintf("unix://%s clients:%d", i.Conn.Address, len(i.clients))
+}
@@ -0,0 +1,307 @@
+package ipc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/framing"
+	"github.com/vocdoni/multirpc/transports/transporttest"
+)
+
+type conformanceConn struct {
+	*framing.Conn
+	frames chan []byte
+}
+
+func (c *conformanceConn) Write(ctx context.Context, data []byte) error {
+	return c.WriteFrame(data)
+}
+
+func (c *conformanceConn) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case data, ok := <-c.frames:
+		if !ok {
+			return nil, fmt.Errorf("connection closed")
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	for _, f := range []framing.Framing{framing.Newline, framing.LengthPrefixed} {
+		f := f
+		t.Run(f.Name(), func(t *testing.T) {
+			transporttest.Run(t, transporttest.Config{
+				New: func(t *testing.T) transports.Transport {
+					ih := NewIPCHandle(f)
+					conn := &transports.Connection{Address: filepath.Join(t.TempDir(), "multirpc.sock")}
+					if err := ih.Init(conn); err != nil {
+						t.Fatal(err)
+					}
+					return ih
+				},
+				Dial: func(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+					conn, err := net.Dial("unix", tr.Address())
+					if err != nil {
+						t.Fatal(err)
+					}
+					c := &conformanceConn{Conn: framing.NewConn(conn, f), frames: make(chan []byte, 16)}
+					go func() {
+						defer close(c.frames)
+						for {
+							data, err := c.ReadFrame()
+							if err != nil {
+								return
+							}
+							c.frames <- data
+						}
+					}()
+					return c
+				},
+				Namespace: "/main",
+			})
+		})
+	}
+}
+
+func TestSocketMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "multirpc.sock")
+	ih := NewIPCHandle(nil)
+	ih.SocketMode = 0o660
+	if err := ih.Init(&transports.Connection{Address: path}); err != nil {
+		t.Fatal(err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 || fi.Mode().Perm() != 0o660 {
+		t.Fatalf("unexpected socket file mode %v", fi.Mode())
+	}
+}
+
+func TestSocketGroup(t *testing.T) {
+	gid := func(path string) int {
+		t.Helper()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return int(fi.Sys().(*syscall.Stat_t).Gid)
+	}
+	groups, err := os.Getgroups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	group := os.Getegid()
+	for _, g := range groups {
+		if g != group {
+			group = g
+			break
+		}
+	}
+	for _, tc := range []struct {
+		name  string
+		group *int
+		want  int
+	}{
+		// The zero value keeps the default group
+		{"default", nil, os.Getegid()},
+		{"group", &group, group},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "multirpc.sock")
+			ih := &IPCHandle{SocketGroup: tc.group}
+			if err := ih.Init(&transports.Connection{Address: path}); err != nil {
+				t.Fatal(err)
+			}
+			if g := gid(path); g != tc.want {
+				t.Fatalf("socket group %d, want %d", g, tc.want)
+			}
+			// The private directory where the socket was created is removed
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 {
+				t.Fatalf("got %d files, want only the socket", len(entries))
+			}
+			if err := ih.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("socket file not removed: %v", err)
+			}
+		})
+	}
+}
+
+func TestStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := NewIPCHandle(nil).Init(&transports.Connection{Address: file}); err == nil {
+		t.Fatal("a regular file was replaced by the socket")
+	}
+
+	live := filepath.Join(dir, "live.sock")
+	ih := NewIPCHandle(nil)
+	if err := ih.Init(&transports.Connection{Address: live}); err != nil {
+		t.Fatal(err)
+	}
+	ih.Listen(make(chan transports.Message))
+	defer ih.Close(context.Background())
+	if err := NewIPCHandle(nil).Init(&transports.Connection{Address: live}); err == nil {
+		t.Fatal("a socket in use was replaced")
+	}
+
+	stale := filepath.Join(dir, "stale.sock")
+	ln, err := net.Listen("unix", stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+	ih = NewIPCHandle(nil)
+	if err := ih.Init(&transports.Connection{Address: stale}); err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	ih.Close(context.Background())
+}
+
+func TestCloseDrain(t *testing.T) {
+	ih := NewIPCHandle(nil)
+	if err := ih.Init(&transports.Connection{Address: filepath.Join(t.TempDir(), "multirpc.sock")}); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	ih.Listen(receiver)
+	conn, err := net.Dial("unix", ih.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := framing.NewConn(conn, framing.Newline)
+	defer fc.Close()
+	if err := fc.WriteFrame([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-receiver
+
+	closed := make(chan error, 1)
+	go func() { closed <- ih.Close(context.Background()) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the in-flight request was replied: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	msg.Data = []byte(`{"reply":"late"}`)
+	if err := ih.Send(msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	data, err := fc.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(msg.Data) {
+		t.Fatalf("got reply %q, want %q", data, msg.Data)
+	}
+}
+
+func TestCloseQueued(t *testing.T) {
+	ih := NewIPCHandle(nil)
+	if err := ih.Init(&transports.Connection{Address: filepath.Join(t.TempDir(), "multirpc.sock")}); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	ih.Listen(receiver)
+	conn, err := net.Dial("unix", ih.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := framing.NewConn(conn, framing.Newline)
+	defer fc.Close()
+
+	// The router is busy with the first request, the second one is queued
+	if err := fc.WriteFrame([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	first := <-receiver
+	if err := fc.WriteFrame([]byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- ih.Close(context.Background()) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the queued request was replied: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The queued request is still forwarded while Close drains
+	var queued transports.Message
+	select {
+	case queued = <-receiver:
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued request dropped on Close")
+	}
+	for _, msg := range []transports.Message{first, queued} {
+		if err := ih.Send(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "queued"} {
+		data, err := fc.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("got reply %q, want %q", data, want)
+		}
+	}
+}
+
+func TestNoReply(t *testing.T) {
+	ih := &IPCHandle{ReplyTimeout: 50 * time.Millisecond}
+	if err := ih.Init(&transports.Connection{Address: filepath.Join(t.TempDir(), "multirpc.sock")}); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	ih.Listen(receiver)
+	conn, err := net.Dial("unix", ih.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := framing.NewConn(conn, framing.Newline)
+	defer fc.Close()
+	if err := fc.WriteFrame([]byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	<-receiver
+
+	// A request not replied after the timeout does not hold Close
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := ih.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
@@ -0,0 +1,293 @@
+// Package memory provides an in-process transport connecting clients and
+// routers through channels. It does not need the network, so it is useful
+// for testing handlers.
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/log"
+)
+
+// DefaultInboxSize is the default number of undelivered notifications a client can hold
+const DefaultInboxSize = 64
+
+// MemoryContext is the MessageContext of the messages sent by an in-process client
+type MemoryContext struct {
+	Client *Client
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (mc *MemoryContext) ConnectionType() string {
+	return "Memory"
+}
+
+// Send delivers the message to the client that sent the request
+func (mc *MemoryContext) Send(msg transports.Message) error {
+	return mc.Client.deliver(msg.Data)
+}
+
+// MemoryHandle is a transports.Transport connecting in-process clients to a router
+type MemoryHandle struct {
+	Conn      *transports.Connection
+	InboxSize int
+
+	internalReceiver chan transports.Message
+	namespaces       map[string]bool
+	clients          map[string]*Client
+	lastID           uint64
+	closed           chan struct{}
+	closeOnce        sync.Once
+	lock             sync.RWMutex
+}
+
+// Init initializes the transport. The connection Address is used as the transport address.
+func (m *MemoryHandle) Init(c *transports.Connection) error {
+	if c == nil {
+		c = new(transports.Connection)
+	}
+	if c.Address == "" {
+		c.Address = "memory"
+	}
+	if m.InboxSize == 0 {
+		m.InboxSize = DefaultInboxSize
+	}
+	m.Conn = c
+	m.internalReceiver = make(chan transports.Message, 1)
+	m.namespaces = map[string]bool{"": true}
+	m.clients = make(map[string]*Client)
+	m.closed = make(chan struct{})
+	return nil
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (m *MemoryHandle) ConnectionType() string {
+	return "Memory"
+}
+
+// Listen forwards the requests of the clients to the receiver channel
+func (m *MemoryHandle) Listen(receiver chan<- transports.Message) {
+	go func() {
+		for {
+			select {
+			case msg := <-m.internalReceiver:
+				select {
+				case receiver <- msg:
+				case <-m.closed:
+					return
+				}
+			case <-m.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Send replies to the client of the message context. If the message has no
+// context, it is broadcasted to all the clients of the message namespace
+// (or to all the clients if the namespace is empty).
+func (m *MemoryHandle) Send(msg transports.Message) error {
+	if msg.Context != nil {
+		mc, ok := msg.Context.(*MemoryContext)
+		if !ok {
+			return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+		}
+		return mc.Send(msg)
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, c := range m.clients {
+		if msg.Namespace != "" && c.Namespace != msg.Namespace {
+			continue
+		}
+		if err := c.deliver(msg.Data); err != nil {
+			log.Debugf("cannot broadcast to memory client %s: %v", c.ID, err)
+		}
+	}
+	return nil
+}
+
+// SendUnicast sends the message to the client identified by address
+func (m *MemoryHandle) SendUnicast(address string, msg transports.Message) error {
+	m.lock.RLock()
+	c, ok := m.clients[address]
+	m.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no memory client with address %s", address)
+	}
+	return c.deliver(msg.Data)
+}
+
+// AddNamespace allows the clients to connect to namespace
+func (m *MemoryHandle) AddNamespace(namespace string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.namespaces[namespace] = true
+	return nil
+}
+
+// Address returns the transport address
+func (m *MemoryHandle) Address() string {
+	return m.Conn.Address
+}
+
+// SetBootnodes does nothing, there are no bootnodes on the memory transport
+func (m *MemoryHandle) SetBootnodes(bootnodes []string) {
+	// No bootnodes on memory handler
+}
+
+// AddPeer does nothing, there are no peers on the memory transport
+func (m *MemoryHandle) AddPeer(peer string) error {
+	// No peers on memory handler
+	return nil
+}
+
+// String returns a human readable string representation of the transport state
+func (m *MemoryHandle) String() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return fmt.Sprintf("%s namespaces:%d clients:%d", m.Conn.Address, len(m.namespaces), len(m.clients))
+}
+
+// Close disconnects all the clients and stops forwarding their requests
+func (m *MemoryHandle) Close(ctx context.Context) error {
+	m.closeOnce.Do(func() {
+		close(m.closed)
+		m.lock.Lock()
+		clients := make([]*Client, 0, len(m.clients))
+		for _, c := range m.clients {
+			clients = append(clients, c)
+		}
+		m.lock.Unlock()
+		for _, c := range clients {
+			c.Close()
+		}
+	})
+	return nil
+}
+
+// Dial connects a new in-process client to namespace
+func (m *MemoryHandle) Dial(namespace string) (*Client, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	select {
+	case <-m.closed:
+		return nil, fmt.Errorf("memory transport is closed")
+	default:
+	}
+	if !m.namespaces[namespace] {
+		return nil, fmt.Errorf("namespace %q not found", namespace)
+	}
+	m.lastID++
+	c := &Client{
+		ID:        fmt.Sprintf("%s/%d", m.Conn.Address, m.lastID),
+		Namespace: namespace,
+		Inbox:     make(chan []byte, m.InboxSize),
+		handle:    m,
+		pending:   make(map[string]chan []byte),
+	}
+	m.clients[c.ID] = c
+	return c, nil
+}
+
+// Client is an in-process client of a MemoryHandle. The replies to its
+// requests are matched by ID, any other message is delivered to Inbox.
+// Client implements the client.Transport interface.
+type Client struct {
+	ID        string
+	Namespace string
+	Inbox     chan []byte
+
+	handle  *MemoryHandle
+	pending map[string]chan []byte
+	closed  int32
+	lock    sync.Mutex
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (c *Client) ConnectionType() string {
+	return "Memory"
+}
+
+// Write sends a raw request to the router without waiting for the reply
+func (c *Client) Write(data []byte) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return fmt.Errorf("memory client %s is closed", c.ID)
+	}
+	select {
+	case c.handle.internalReceiver <- transports.Message{
+		Data:      data,
+		TimeStamp: int32(time.Now().Unix()),
+		Namespace: c.Namespace,
+		Context:   &MemoryContext{Client: c},
+	}:
+		return nil
+	case <-c.handle.closed:
+		return fmt.Errorf("memory transport is closed")
+	}
+}
+
+// Request sends the request identified by id and waits for its reply
+func (c *Client) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	c.lock.Lock()
+	c.pending[id] = ch
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pending, id)
+		c.lock.Unlock()
+	}()
+	if err := c.Write(data); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// deliver routes a message to the pending request with the same ID or to the Inbox
+func (c *Client) deliver(data []byte) error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return fmt.Errorf("memory client %s is closed", c.ID)
+	}
+	var reply struct {
+		ID string `json:"id"`
+	}
+	// Messages which are not JSON are delivered to the Inbox
+	_ = json.Unmarshal(data, &reply)
+	c.lock.Lock()
+	ch, ok := c.pending[reply.ID]
+	delete(c.pending, reply.ID)
+	c.lock.Unlock()
+	if ok {
+		ch <- data
+		return nil
+	}
+	select {
+	case c.Inbox <- data:
+		return nil
+	default:
+		return fmt.Errorf("inbox of memory client %s is full", c.ID)
+	}
+}
+
+// Close disconnects the client from the transport
+func (c *Client) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	c.handle.lock.Lock()
+	delete(c.handle.clients, c.ID)
+	c.handle.lock.Unlock()
+	return nil
+}
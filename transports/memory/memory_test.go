@@ -0,0 +1,138 @@
+package memory
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/client"
+	"github.com/vocdoni/multirpc/router"
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/transporttest"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+type testAPI struct {
+	ID        string `json:"request"`
+	Method    string `json:"method,omitempty"`
+	Timestamp int32  `json:"timestamp"`
+	Error     string `json:"error,omitempty"`
+	Reply     string `json:"reply,omitempty"`
+}
+
+func (ta *testAPI) GetID() string        { return ta.ID }
+func (ta *testAPI) SetID(id string)      { ta.ID = id }
+func (ta *testAPI) SetTimestamp(t int32) { ta.Timestamp = t }
+func (ta *testAPI) SetError(e string)    { ta.Error = e }
+func (ta *testAPI) GetMethod() string    { return ta.Method }
+
+func newTestAPI() transports.MessageAPI { return &testAPI{} }
+
+func TestMemoryTransport(t *testing.T) {
+	server := ethereum.NewSignKeys()
+	if err := server.Generate(); err != nil {
+		t.Fatal(err)
+	}
+	mh := new(MemoryHandle)
+	if err := mh.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	listener := make(chan transports.Message)
+	mh.Listen(listener)
+	r := router.NewRouter(listener, map[string]transports.Transport{"memory": mh}, server, newTestAPI)
+	if err := r.Transports["memory"].AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	hello := func(rr router.RouterRequest) {
+		rr.Send(router.BuildReply(&testAPI{Reply: "hello"}, rr))
+	}
+	if err := r.AddHandler("hello", "/main", hello, false, true); err != nil {
+		t.Fatal(err)
+	}
+	go r.Route()
+
+	if _, err := mh.Dial("/other"); err == nil {
+		t.Fatal("expected error dialing an unknown namespace")
+	}
+	mc1, err := mh.Dial("/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mc2, err := mh.Dial("/main")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := client.New(mc1, nil, newTestAPI)
+	c.PinServerAddress(server.Address())
+	resp, err := c.Request(ctx, &testAPI{Method: "hello"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.(*testAPI).Reply; got != "hello" {
+		t.Fatalf("got reply %q, want hello", got)
+	}
+
+	// Broadcast to the namespace and unicast to a single client
+	if err := mh.Send(transports.Message{Data: []byte("broadcast"), Namespace: "/main"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := mh.SendUnicast(mc2.ID, transports.Message{Data: []byte("unicast")}); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []struct {
+		client *Client
+		data   string
+	}{{mc1, "broadcast"}, {mc2, "broadcast"}, {mc2, "unicast"}} {
+		select {
+		case data := <-want.client.Inbox:
+			if string(data) != want.data {
+				t.Fatalf("client %s got %q, want %q", want.client.ID, data, want.data)
+			}
+		case <-ctx.Done():
+			t.Fatalf("client %s did not receive %q", want.client.ID, want.data)
+		}
+	}
+
+	mc2.Close()
+	if err := mh.SendUnicast(mc2.ID, transports.Message{Data: []byte("unicast")}); err == nil {
+		t.Fatal("expected error sending to a closed client")
+	}
+}
+
+type conformanceConn struct{ *Client }
+
+func (c conformanceConn) Write(ctx context.Context, data []byte) error {
+	return c.Client.Write(data)
+}
+
+func (c conformanceConn) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-c.Inbox:
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func TestConformance(t *testing.T) {
+	transporttest.Run(t, transporttest.Config{
+		New: func(t *testing.T) transports.Transport {
+			mh := new(MemoryHandle)
+			if err := mh.Init(nil); err != nil {
+				t.Fatal(err)
+			}
+			return mh
+		},
+		Dial: func(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+			c, err := tr.(*MemoryHandle).Dial(namespace)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return conformanceConn{c}
+		},
+		Namespace: "/main",
+	})
+}
@@ -0,0 +1,162 @@
+package mhttp
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"time"
+
+	"go.vocdoni.io/dvote/log"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// DefaultACMERetryInterval is the default time between the certificate
+// requests while the fallback certificate is served
+const DefaultACMERetryInterval = time.Minute
+
+// ACMEConfig configures how the certificates of the letsencrypt domain are
+// obtained. The zero value uses the Let's Encrypt production directory with
+// the TLS-ALPN-01 challenge, and fails if the certificate cannot be obtained.
+type ACMEConfig struct {
+	// DirectoryURL is the ACME directory, Let's Encrypt production if empty.
+	// Set it to the staging directory or to a local Pebble for testing.
+	DirectoryURL string
+	// HTTPClient is used for the requests to the ACME server, e.g. to trust
+	// the Pebble root certificate
+	HTTPClient *http.Client
+	// Email is the contact address of the ACME account
+	Email string
+	// Domains are the certificate domains, in addition to the Connection TLSdomain
+	Domains []string
+	// HTTPChallengeAddr enables the HTTP-01 challenge, served on this
+	// address (usually :80). The other requests are redirected to HTTPS.
+	HTTPChallengeAddr string
+
+	// NonFatal starts the proxy even if the certificates cannot be
+	// obtained, serving FallbackCertificate while they are requested again
+	// every RetryInterval (DefaultACMERetryInterval if 0)
+	NonFatal      bool
+	RetryInterval time.Duration
+	// FallbackCertificate is a self-signed certificate of the domains if nil
+	FallbackCertificate *tls.Certificate
+}
+
+// domains returns the letsencrypt domains of the proxy
+func (p *Proxy) domains() []string {
+	var domains []string
+	if p.Conn.TLSdomain != "" {
+		domains = append(domains, p.Conn.TLSdomain)
+	}
+	if p.ACME != nil {
+		for _, d := range p.ACME.Domains {
+			if d != "" && d != p.Conn.TLSdomain {
+				domains = append(domains, d)
+			}
+		}
+	}
+	return domains
+}
+
+// obtainCertificates requests the certificate of each domain
+func (p *Proxy) obtainCertificates(m *autocert.Manager) error {
+	for _, domain := range p.domains() {
+		certs, err := getCertificates(domain, m)
+		if err != nil {
+			return err
+		}
+		if len(certs) == 0 {
+			return fmt.Errorf("no certificate for %s", domain)
+		}
+	}
+	return nil
+}
+
+// retryCertificates requests the certificates until they are obtained or the proxy is closed
+func (p *Proxy) retryCertificates(m *autocert.Manager, interval time.Duration) {
+	if interval == 0 {
+		interval = DefaultACMERetryInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := p.obtainCertificates(m); err != nil {
+				log.Warnf("cannot get letsencrypt TLS certificate, serving the fallback one: %v", err)
+				continue
+			}
+			log.Infof("letsencrypt TLS certificates obtained for %v", p.domains())
+			return
+		case <-p.acmeStop:
+			return
+		}
+	}
+}
+
+// fallbackGetCertificate serves the fallback certificate when the ACME one cannot be obtained
+func fallbackGetCertificate(m *autocert.Manager, fallback *tls.Certificate) func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		cert, err := m.GetCertificate(hello)
+		if err != nil {
+			log.Debugf("serving fallback TLS certificate to %q: %v", hello.ServerName, err)
+			return fallback, nil
+		}
+		return cert, nil
+	}
+}
+
+// serveHTTPChallenge serves the ACME HTTP-01 challenge on addr
+func (p *Proxy) serveHTTPChallenge(addr string, m *autocert.Manager) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	p.acmeHTTP = &http.Server{
+		Handler:           m.HTTPHandler(nil),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		log.Infof("serving ACME HTTP-01 challenge on %s", ln.Addr())
+		if err := p.acmeHTTP.Serve(ln); err != nil && err != http.ErrServerClosed {
+			log.Errorf("ACME HTTP-01 server stopped: %v", err)
+		}
+	}()
+	return nil
+}
+
+// selfSignedCertificate returns a certificate of domains valid for a year
+func selfSignedCertificate(domains []string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: domains[0], Organization: []string{"multirpc fallback"}},
+		DNSNames:     domains,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}, nil
+}
@@ -0,0 +1,79 @@
+package mhttp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// TestACMEFallback checks the proxy starts with the fallback certificate when
+// the ACME directory cannot be reached, and fails if NonFatal is not set.
+func TestACMEFallback(t *testing.T) {
+	directory := httptest.NewServer(http.NotFoundHandler())
+	defer directory.Close()
+	newProxy := func(nonFatal bool) *Proxy {
+		pxy := NewProxy()
+		pxy.Conn.Address = "127.0.0.1"
+		pxy.Conn.TLSdomain = "rpc.example.test"
+		pxy.Conn.TLScertDir = t.TempDir()
+		pxy.ACME = &ACMEConfig{
+			DirectoryURL:      directory.URL,
+			Domains:           []string{"api.example.test"},
+			HTTPChallengeAddr: "127.0.0.1:0",
+			NonFatal:          nonFatal,
+			RetryInterval:     50 * time.Millisecond,
+		}
+		return pxy
+	}
+
+	// The failing Init shuts down the HTTPS and the HTTP-01 challenge servers
+	ports := make([]int, 2)
+	for i := range ports {
+		free, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports[i] = free.Addr().(*net.TCPAddr).Port
+		free.Close()
+	}
+	pxy := newProxy(false)
+	pxy.Conn.Port = int32(ports[0])
+	pxy.ACME.HTTPChallengeAddr = fmt.Sprintf("127.0.0.1:%d", ports[1])
+	if err := pxy.Init(); err == nil {
+		t.Fatal("expected error without the ACME certificate")
+	}
+	for _, port := range ports {
+		ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+		if err != nil {
+			t.Fatalf("port kept by the failing Init: %v", err)
+		}
+		ln.Close()
+	}
+
+	pxy = newProxy(true)
+	if err := pxy.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer pxy.Close(context.Background())
+	for _, domain := range []string{"rpc.example.test", "api.example.test"} {
+		conn, err := tls.Dial("tcp", pxy.Addr.String(), &tls.Config{ServerName: domain, InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert := conn.ConnectionState().PeerCertificates[0]
+		conn.Close()
+		if len(cert.Subject.Organization) != 1 || cert.Subject.Organization[0] != "multirpc fallback" {
+			t.Fatalf("got certificate %s, want the fallback one", cert.Subject)
+		}
+		if err := cert.VerifyHostname(domain); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Let the retries run
+	time.Sleep(150 * time.Millisecond)
+}
@@ -0,0 +1,114 @@
+package mhttp
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.vocdoni.io/dvote/log"
+)
+
+// DefaultCertReloadInterval is the default time between the checks of the certificate files
+const DefaultCertReloadInterval = 30 * time.Second
+
+// CertReloader serves a TLS certificate loaded from PEM files. The files are
+// checked every interval and the certificate is reloaded when they change, so
+// it can be renewed without restarting the server. If the new files cannot be
+// loaded (e.g. the key is not yet written), the current certificate is kept.
+type CertReloader struct {
+	CertFile string
+	KeyFile  string
+
+	cert    *tls.Certificate
+	certMod time.Time
+	keyMod  time.Time
+	stop    chan struct{}
+	once    sync.Once
+	lock    sync.RWMutex
+}
+
+// NewCertReloader loads the certificate files and starts watching them
+func NewCertReloader(certFile, keyFile string, interval time.Duration) (*CertReloader, error) {
+	if interval == 0 {
+		interval = DefaultCertReloadInterval
+	}
+	c := &CertReloader{CertFile: certFile, KeyFile: keyFile, stop: make(chan struct{})}
+	if _, err := c.reload(); err != nil {
+		return nil, err
+	}
+	go c.watch(interval)
+	return c, nil
+}
+
+func (c *CertReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reloaded, err := c.reload()
+			if err != nil {
+				log.Warnf("cannot reload TLS certificate, keeping the current one: %v", err)
+			} else if reloaded {
+				log.Infof("TLS certificate reloaded from %s, expires %s", c.CertFile, c.NotAfter())
+			}
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+// reload loads the files if they changed since the last successful load
+func (c *CertReloader) reload() (bool, error) {
+	certInfo, err := os.Stat(c.CertFile)
+	if err != nil {
+		return false, err
+	}
+	keyInfo, err := os.Stat(c.KeyFile)
+	if err != nil {
+		return false, err
+	}
+	c.lock.RLock()
+	changed := c.cert == nil || !certInfo.ModTime().Equal(c.certMod) || !keyInfo.ModTime().Equal(c.keyMod)
+	c.lock.RUnlock()
+	if !changed {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return false, fmt.Errorf("cannot parse TLS certificate: %w", err)
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	c.certMod = certInfo.ModTime()
+	c.keyMod = keyInfo.ModTime()
+	return true, nil
+}
+
+// GetCertificate returns the current certificate, it is meant to be used as tls.Config.GetCertificate
+func (c *CertReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// NotAfter returns the expiry of the current certificate
+func (c *CertReloader) NotAfter() time.Time {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert.Leaf.NotAfter
+}
+
+// Close stops watching the files
+func (c *CertReloader) Close() {
+	c.once.Do(func() { close(c.stop) })
+}
@@ -0,0 +1,113 @@
+package mhttp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate with serial and its key as PEM files
+func writeCert(t *testing.T, dir string, serial int64, mod time.Time) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "multirpc"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Duration(serial) * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for file, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDer},
+	} {
+		if err := ioutil.WriteFile(file, pem.EncodeToMemory(block), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return certFile, keyFile
+}
+
+// TestCertFiles checks the proxy serves the certificate files and reloads them
+func TestCertFiles(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	certFile, keyFile := writeCert(t, dir, 1, now.Add(-time.Minute))
+	pxy := NewProxy()
+	pxy.Conn.Address = "127.0.0.1"
+	pxy.TLSCertFile = certFile
+	pxy.TLSKeyFile = keyFile
+	pxy.CertReloadInterval = 20 * time.Millisecond
+	if err := pxy.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer pxy.Close(context.Background())
+
+	serial := func() int64 {
+		t.Helper()
+		conn, err := tls.Dial("tcp", pxy.Addr.String(), &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if s := serial(); s != 1 {
+		t.Fatalf("served certificate %d, want 1", s)
+	}
+
+	// A half written renewal keeps the current certificate
+	if err := ioutil.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s := serial(); s != 1 {
+		t.Fatalf("served certificate %d after a broken renewal, want 1", s)
+	}
+
+	writeCert(t, dir, 2, now)
+	deadline := time.Now().Add(5 * time.Second)
+	for serial() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("certificate not reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if got, want := pxy.Certs.NotAfter().Unix(), now.Add(2*time.Hour).Unix(); got < want-5 || got > want+5 {
+		t.Errorf("certificate expiry %d, want about %d", got, want)
+	}
+
+	pxy = NewProxy()
+	pxy.Conn.TLSdomain = "example.com"
+	pxy.TLSCertFile = certFile
+	pxy.TLSKeyFile = keyFile
+	if err := pxy.Init(); err == nil {
+		t.Fatal("certificate files with a letsencrypt domain must fail")
+	}
+}
@@ -0,0 +1,336 @@
+package mhttp
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/transporttest"
+	"nhooyr.io/websocket"
+)
+
+type proxied interface {
+	transports.Transport
+	SetProxy(p *Proxy)
+}
+
+func newProxied(tr proxied) func(t *testing.T) transports.Transport {
+	return func(t *testing.T) transports.Transport {
+		pxy := NewProxy()
+		pxy.Conn.Address = "127.0.0.1"
+		if err := pxy.Init(); err != nil {
+			t.Fatal(err)
+		}
+		if err := tr.Init(new(transports.Connection)); err != nil {
+			t.Fatal(err)
+		}
+		tr.SetProxy(pxy)
+		return tr
+	}
+}
+
+func TestHandlerAddress(t *testing.T) {
+	for _, tr := range []proxied{new(HttpHandler), new(WebsocketHandle), new(HttpWsHandler)} {
+		t.Run(tr.ConnectionType(), func(t *testing.T) {
+			pxy := NewProxy()
+			pxy.Conn.Address = "127.0.0.1"
+			if err := pxy.Init(); err != nil {
+				t.Fatal(err)
+			}
+			defer pxy.Close(context.Background())
+			if err := tr.Init(new(transports.Connection)); err != nil {
+				t.Fatal(err)
+			}
+			tr.SetProxy(pxy)
+			if got, want := tr.Address(), pxy.Addr.String(); got != want {
+				t.Fatalf("got address %q, want the proxy address %q", got, want)
+			}
+		})
+	}
+}
+
+// httpConn is a client doing a POST request on each Write, the response
+// body is returned by the next Read.
+type httpConn struct {
+	url     string
+	replies chan []byte
+}
+
+func (c *httpConn) Write(ctx context.Context, data []byte) error {
+	// The request outlives the Write call, so ctx is not used.
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			c.replies <- nil
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		c.replies <- body
+	}()
+	return nil
+}
+
+func (c *httpConn) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case data := <-c.replies:
+		if data == nil {
+			return nil, fmt.Errorf("http request failed")
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *httpConn) Close() error { return nil }
+
+func dialHTTP(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+	return &httpConn{url: fmt.Sprintf("http://%s%s", tr.String(), namespace), replies: make(chan []byte, 16)}
+}
+
+type wsConn struct {
+	conn *websocket.Conn
+}
+
+func (c *wsConn) Write(ctx context.Context, data []byte) error {
+	return c.conn.Write(ctx, websocket.MessageText, data)
+}
+
+func (c *wsConn) Read(ctx context.Context) ([]byte, error) {
+	_, data, err := c.conn.Read(ctx)
+	return data, err
+}
+
+func (c *wsConn) Close() error { return c.conn.Close(websocket.StatusNormalClosure, "") }
+
+func dialWebsocket(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+	conn, _, err := websocket.Dial(context.Background(), fmt.Sprintf("ws://%s%s", tr.String(), namespace), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &wsConn{conn: conn}
+}
+
+// sseConn posts the requests on a session and reads the replies from its event stream
+type sseConn struct {
+	url     string
+	session string
+	body    interface{ Close() error }
+	events  chan []byte
+}
+
+func (c *sseConn) Write(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(SSESessionHeader, c.session)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *sseConn) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case data, ok := <-c.events:
+		if !ok {
+			return nil, fmt.Errorf("event stream closed")
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *sseConn) Close() error { return c.body.Close() }
+
+// readEvents sends the data of the message events to the channel
+func readEvents(r *bufio.Reader, events chan<- []byte, session chan<- string) {
+	defer close(events)
+	var event string
+	var data []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			data = append(data, strings.TrimPrefix(line, "data: "))
+		case line == "" && event != "":
+			if event == "session" {
+				session <- strings.Join(data, "\n")
+			} else {
+				events <- []byte(strings.Join(data, "\n"))
+			}
+			event, data = "", nil
+		}
+	}
+}
+
+func dialSSE(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+	url := fmt.Sprintf("http://%s%s", tr.String(), namespace)
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type %s", ct)
+	}
+	c := &sseConn{url: url, body: resp.Body, events: make(chan []byte, 16)}
+	session := make(chan string, 1)
+	go readEvents(bufio.NewReader(resp.Body), c.events, session)
+	c.session = <-session
+	return c
+}
+
+// pollConn posts the requests on a session and polls their replies
+type pollConn struct {
+	url     string
+	session string
+	cursor  uint64
+	pending [][]byte
+}
+
+func (c *pollConn) Write(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url+"?session="+c.session, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+func (c *pollConn) poll(ctx context.Context, url string) (*PollReply, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	reply := new(PollReply)
+	return reply, json.NewDecoder(resp.Body).Decode(reply)
+}
+
+func (c *pollConn) Read(ctx context.Context) ([]byte, error) {
+	for len(c.pending) == 0 {
+		reply, err := c.poll(ctx, fmt.Sprintf("%s?session=%s&cursor=%d", c.url, c.session, c.cursor))
+		if err != nil {
+			return nil, err
+		}
+		c.cursor = reply.Cursor
+		for _, m := range reply.Messages {
+			c.pending = append(c.pending, m)
+		}
+	}
+	data := c.pending[0]
+	c.pending = c.pending[1:]
+	return data, nil
+}
+
+func (c *pollConn) Close() error { return nil }
+
+func dialPoll(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+	c := &pollConn{url: fmt.Sprintf("http://%s%s", tr.String(), namespace)}
+	reply, err := c.poll(context.Background(), c.url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.session = reply.Session
+	return c
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("HTTP", func(t *testing.T) {
+		transporttest.Run(t, transporttest.Config{
+			New:              func(t *testing.T) transports.Transport { return newProxied(new(HttpHandler))(t) },
+			Dial:             dialHTTP,
+			Namespace:        "/main",
+			InvalidNamespace: "main",
+		})
+	})
+	t.Run("Websocket", func(t *testing.T) {
+		transporttest.Run(t, transporttest.Config{
+			New:              func(t *testing.T) transports.Transport { return newProxied(new(WebsocketHandle))(t) },
+			Dial:             dialWebsocket,
+			Namespace:        "/main",
+			InvalidNamespace: "main",
+		})
+	})
+	for name, dial := range map[string]func(*testing.T, transports.Transport, string) transporttest.Conn{
+		"SSE/Stream": dialSSE,
+		"SSE/HTTP":   dialHTTP,
+	} {
+		dial := dial
+		t.Run(name, func(t *testing.T) {
+			transporttest.Run(t, transporttest.Config{
+				New:              func(t *testing.T) transports.Transport { return newProxied(new(SSEHandler))(t) },
+				Dial:             dial,
+				Namespace:        "/main",
+				InvalidNamespace: "main",
+			})
+		})
+	}
+	for name, dial := range map[string]func(*testing.T, transports.Transport, string) transporttest.Conn{
+		"LongPoll/Poll": dialPoll,
+		"LongPoll/HTTP": dialHTTP,
+	} {
+		dial := dial
+		t.Run(name, func(t *testing.T) {
+			transporttest.Run(t, transporttest.Config{
+				New:              func(t *testing.T) transports.Transport { return newProxied(new(LongPollHandler))(t) },
+				Dial:             dial,
+				Namespace:        "/main",
+				InvalidNamespace: "main",
+			})
+		})
+	}
+	for name, dial := range map[string]func(*testing.T, transports.Transport, string) transporttest.Conn{
+		"HTTPWS/HTTP":      dialHTTP,
+		"HTTPWS/Websocket": dialWebsocket,
+	} {
+		dial := dial
+		t.Run(name, func(t *testing.T) {
+			transporttest.Run(t, transporttest.Config{
+				New:              func(t *testing.T) transports.Transport { return newProxied(new(HttpWsHandler))(t) },
+				Dial:             dial,
+				Namespace:        "/main",
+				InvalidNamespace: "main",
+			})
+		})
+	}
+}
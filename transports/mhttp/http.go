@@ -1,11 +1,15 @@
 package mhttp
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"github.com/go-chi/chi"
 	"github.com/vocdoni/multirpc/transports"
 	"go.vocdoni.io/dvote/log"
 )
@@ -13,17 +17,23 @@ import (
 type HttpHandler struct {
 	Proxy            *Proxy // proxy where the ws will be associated
 	internalReceiver chan transports.Message
+	lc               *lifecycle
 }
 
 type HttpContext struct {
 	Writer  http.ResponseWriter
 	Request *http.Request
 
-	sent chan struct{}
+	sent   chan struct{}
+	query  bool
+	method string
+	etag   string
+	maxAge time.Duration
 }
 
 func (h *HttpHandler) Init(c *transports.Connection) error {
 	h.internalReceiver = make(chan transports.Message, 1)
+	h.lc = newLifecycle()
 	return nil
 }
 
@@ -31,38 +41,118 @@ func (h *HttpHandler) SetProxy(p *Proxy) {
 	h.Proxy = p
 }
 
-func getHTTPhandler(path string, receiver chan transports.Message) func(w http.ResponseWriter, r *http.Request) {
+func getHTTPhandler(path string, receiver chan transports.Message, lc *lifecycle) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		defer r.Body.Close()
+		if !lc.begin() {
+			unavailable(w)
+			return
+		}
+		defer lc.end()
 		respBody, err := ioutil.ReadAll(r.Body)
 		if err != nil {
 			log.Warnf("HTTP connection closed: (%s)", err)
 			return
 		}
 		hc := &HttpContext{Request: r, Writer: w, sent: make(chan struct{})}
-		msg := transports.Message{
-			Data:      respBody,
-			TimeStamp: int32(time.Now().Unix()),
-			Context:   hc,
-			Namespace: path,
+		dispatch(path, respBody, hc, receiver)
+	}
+}
+
+// getQueryHandler returns the handler of the GET path/method?param=value
+// queries, mapped by the router to the read-only methods
+func getQueryHandler(path string, receiver chan transports.Message, lc *lifecycle) func(w http.ResponseWriter, r *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !lc.begin() {
+			unavailable(w)
+			return
+		}
+		defer lc.end()
+		hc := &HttpContext{
+			Request: r,
+			Writer:  w,
+			sent:    make(chan struct{}),
+			query:   true,
+			method:  chi.URLParam(r, "method"),
 		}
-		receiver <- msg
+		dispatch(path, nil, hc, receiver)
+	}
+}
 
-		// The contract is that every handled request must send a
-		// response, even when they fail or time out.
-		<-hc.sent
+// dispatch passes the request to the receiver and waits for the reply
+func dispatch(path string, data []byte, hc *HttpContext, receiver chan transports.Message) {
+	receiver <- transports.Message{
+		Data:      data,
+		TimeStamp: int32(time.Now().Unix()),
+		Context:   hc,
+		Namespace: path,
 	}
+	// The contract is that every handled request must send a
+	// response, even when they fail or time out.
+	<-hc.sent
 }
 
 // AddProxyHandler adds the current websocket handler into the Proxy
 func (h *HttpHandler) AddProxyHandler(path string) {
-	h.Proxy.AddHandler(path, getHTTPhandler(path, h.internalReceiver))
+	h.Proxy.AddHandler(path, getHTTPhandler(path, h.internalReceiver, h.lc))
+	h.Proxy.AddQueryHandler(path, getQueryHandler(path, h.internalReceiver, h.lc))
 }
 
 func (h *HttpContext) ConnectionType() string {
 	return "HTTP"
 }
 
+// ClientIdentity returns the identity of the verified TLS client certificate, if any
+func (h *HttpContext) ClientIdentity() *transports.ClientIdentity {
+	return requestIdentity(h.Request)
+}
+
+// requestIdentity returns the identity of the verified client certificate of r
+func requestIdentity(r *http.Request) *transports.ClientIdentity {
+	if r == nil || r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return transports.NewClientIdentity(r.TLS.VerifiedChains[0][0])
+}
+
+// Query returns the method and parameters of a GET path/method?param=value request
+func (h *HttpContext) Query() (string, url.Values, bool) {
+	if !h.query {
+		return "", nil, false
+	}
+	return h.method, h.Request.URL.Query(), true
+}
+
+// SetCache sets the ETag and the Cache-Control max-age of the reply to a query
+func (h *HttpContext) SetCache(etag string, maxAge time.Duration) {
+	h.etag = etag
+	h.maxAge = maxAge
+}
+
+// cacheHeaders writes the cache headers of a query reply, and returns true
+// if the client already has it (If-None-Match)
+func (h *HttpContext) cacheHeaders() bool {
+	if h.maxAge > 0 {
+		h.Writer.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(h.maxAge.Seconds())))
+	} else {
+		h.Writer.Header().Set("Cache-Control", "no-store")
+	}
+	if h.etag == "" {
+		return false
+	}
+	// The replies of a query are equal but for their timestamp and
+	// signature, so the ETag is weak and compared weakly
+	etag := `"` + h.etag + `"`
+	h.Writer.Header().Set("ETag", "W/"+etag)
+	for _, tag := range strings.Split(h.Request.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *HttpContext) Send(msg transports.Message) error {
 	defer func() {
 		if r := recover(); r != nil {
@@ -76,6 +166,10 @@ func (h *HttpContext) Send(msg transports.Message) error {
 		// The connection was closed, so don't try to write to it.
 		return fmt.Errorf("connection is closed")
 	}
+	if h.query && h.cacheHeaders() {
+		h.Writer.WriteHeader(http.StatusNotModified)
+		return nil
+	}
 	h.Writer.Header().Set("Content-Length", fmt.Sprintf("%d", len(msg.Data)+1))
 	h.Writer.Header().Set("Content-Type", "application/json")
 	if _, err := h.Writer.Write(msg.Data); err != nil {
@@ -90,11 +184,11 @@ func (h *HttpHandler) ConnectionType() string {
 	return "HTTP"
 }
 
+// Listen forwards the received requests to receiver from a background
+// goroutine and returns, as the other mhttp handlers do. The callers running
+// it on its own goroutine are not affected.
 func (h *HttpHandler) Listen(receiver chan<- transports.Message) {
-	for {
-		msg := <-h.internalReceiver
-		receiver <- msg
-	}
+	go h.lc.forward(h.internalReceiver, receiver)
 }
 
 func (h *HttpHandler) SendUnicast(address string, msg transports.Message) error {
@@ -103,8 +197,11 @@ func (h *HttpHandler) SendUnicast(address string, msg transports.Message) error
 }
 
 func (h *HttpHandler) Send(msg transports.Message) error {
-	// TODO(mvdan): this extra abstraction layer is probably useless
-	return msg.Context.(*HttpContext).Send(msg)
+	hc, ok := msg.Context.(*HttpContext)
+	if !ok {
+		return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+	}
+	return hc.Send(msg)
 }
 
 func (h *HttpHandler) SetBootnodes(bootnodes []string) {
@@ -125,10 +222,17 @@ func (h *HttpHandler) AddNamespace(namespace string) error {
 	return nil
 }
 
+// Address returns the listening address of the proxy
 func (h *HttpHandler) Address() string {
 	return h.String()
 }
 
+// Close stops accepting requests and waits for the in-flight ones until ctx
+// is done. The proxy is not closed, since it might be shared.
+func (h *HttpHandler) Close(ctx context.Context) error {
+	return h.lc.close(ctx)
+}
+
 func (h *HttpHandler) String() string {
 	return h.Proxy.Addr.String()
 }
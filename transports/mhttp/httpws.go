@@ -1,6 +1,7 @@
 package mhttp
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/vocdoni/multirpc/transports"
@@ -11,8 +12,13 @@ type HttpWsHandler struct {
 	Proxy       *Proxy                 // proxy where the ws will be associated
 	Connection  *transports.Connection // the ws connection
 	WsReadLimit int64
+	Keepalive   WsKeepalive
+	// Subprotocols are the negotiated websocket subprotocols, DefaultWsSubprotocols if nil
+	Subprotocols []string
 
 	internalReceiver chan transports.Message
+	lc               *lifecycle
+	ws               *wsServer
 }
 
 func (h *HttpWsHandler) Init(c *transports.Connection) error {
@@ -20,7 +26,13 @@ func (h *HttpWsHandler) Init(c *transports.Connection) error {
 		h.WsReadLimit = 32768 // default
 	}
 
+	h.Keepalive.setDefaults()
 	h.internalReceiver = make(chan transports.Message, 1)
+	h.lc = newLifecycle()
+	if h.Subprotocols == nil {
+		h.Subprotocols = DefaultWsSubprotocols
+	}
+	h.ws = &wsServer{receiver: h.internalReceiver, lc: h.lc, keepalive: h.Keepalive}
 	return nil
 }
 
@@ -30,10 +42,27 @@ func (h *HttpWsHandler) SetProxy(p *Proxy) {
 
 // AddProxyHandler adds the current websocket handler into the Proxy
 func (h *HttpWsHandler) AddProxyHandler(path string) {
-	h.Proxy.AddMixedHandler(path,
-		getHTTPhandler(path, h.internalReceiver),
-		getWsHandler(path, h.internalReceiver),
-		h.WsReadLimit)
+	h.Proxy.AddMixedRequestHandler(path,
+		getHTTPhandler(path, h.internalReceiver, h.lc),
+		h.ws.handler(path),
+		h.WsReadLimit,
+		h.Subprotocols...)
+	h.Proxy.AddQueryHandler(path, getQueryHandler(path, h.internalReceiver, h.lc))
+}
+
+// WsStats returns the counters of the websocket connections
+func (h *HttpWsHandler) WsStats() *WsStats {
+	return &h.ws.stats
+}
+
+// WsConnection returns the live websocket connection identified by id
+func (h *HttpWsHandler) WsConnection(id string) (*WsConn, bool) {
+	return h.ws.connection(id)
+}
+
+// WsConnections returns the live websocket connections of namespace, all of them if it is empty
+func (h *HttpWsHandler) WsConnections(namespace string) []*WsConn {
+	return h.ws.connections(namespace)
 }
 
 func (h *HttpWsHandler) ConnectionType() string {
@@ -41,22 +70,28 @@ func (h *HttpWsHandler) ConnectionType() string {
 }
 
 func (h *HttpWsHandler) Listen(receiver chan<- transports.Message) {
-	go func() {
-		for {
-			msg := <-h.internalReceiver
-			receiver <- msg
-		}
-	}()
+	go h.lc.forward(h.internalReceiver, receiver)
 }
 
+// SendUnicast sends the message to the websocket connection identified by address
 func (h *HttpWsHandler) SendUnicast(address string, msg transports.Message) error {
-	// WebSocket is not p2p so sendUnicast makes the same of Send()
-	return h.Send(msg)
+	return h.ws.sendTo(address, msg)
 }
 
+// Send replies to the message context. If the message has no context, it is
+// broadcast to all the websocket connections of its namespace.
 func (h *HttpWsHandler) Send(msg transports.Message) error {
-	// TODO(mvdan): this extra abstraction layer is probably useless
-	return msg.Context.(*HttpContext).Send(msg)
+	switch ctx := msg.Context.(type) {
+	case *HttpContext:
+		return ctx.Send(msg)
+	case *WebsocketContext:
+		return ctx.Send(msg)
+	case nil:
+		h.ws.broadcast(msg)
+		return nil
+	default:
+		return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+	}
 }
 
 func (h *HttpWsHandler) SetBootnodes(bootnodes []string) {
@@ -77,10 +112,18 @@ func (h *HttpWsHandler) AddNamespace(namespace string) error {
 	return nil
 }
 
+// Address returns the listening address of the proxy
 func (h *HttpWsHandler) Address() string {
 	return h.String()
 }
 
+// Close stops accepting requests, waits for the in-flight HTTP requests
+// until ctx is done and closes the websockets. The proxy is not closed,
+// since it might be shared.
+func (h *HttpWsHandler) Close(ctx context.Context) error {
+	return h.lc.close(ctx)
+}
+
 func (h *HttpWsHandler) String() string {
 	return h.Proxy.Addr.String()
 }
@@ -0,0 +1,125 @@
+package mhttp
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"go.vocdoni.io/dvote/log"
+	"nhooyr.io/websocket"
+)
+
+const (
+	// DefaultWsPingInterval is the default time between the pings sent to the websocket clients
+	DefaultWsPingInterval = 30 * time.Second
+	// DefaultWsPongTimeout is the default time a websocket client has to answer a ping
+	DefaultWsPongTimeout = 10 * time.Second
+)
+
+// WsKeepalive configures the liveness checks of the websocket connections,
+// so the half-open connections (e.g. dropped by a NAT) are closed.
+type WsKeepalive struct {
+	// PingInterval is the time between pings, DefaultWsPingInterval if 0.
+	// A negative value disables the pings.
+	PingInterval time.Duration
+	// PongTimeout is the time to wait for the pong, DefaultWsPongTimeout if 0.
+	// The connection is dropped if it is not received.
+	PongTimeout time.Duration
+	// IdleTimeout closes the connections without messages from the client
+	// for this time (the pongs do not count). 0 disables it.
+	IdleTimeout time.Duration
+	// MaxLifetime closes the connections open for longer, so the clients
+	// reconnect and get balanced again. 0 disables it.
+	MaxLifetime time.Duration
+}
+
+func (k *WsKeepalive) setDefaults() {
+	if k.PingInterval == 0 {
+		k.PingInterval = DefaultWsPingInterval
+	}
+	if k.PongTimeout == 0 {
+		k.PongTimeout = DefaultWsPongTimeout
+	}
+}
+
+// WsStats counts the websocket connections of a handler, it is safe for concurrent use
+type WsStats struct {
+	open                int64
+	pingTimeouts        int64
+	idleTimeouts        int64
+	lifetimeExpirations int64
+}
+
+// Open returns the number of open connections
+func (s *WsStats) Open() int64 { return atomic.LoadInt64(&s.open) }
+
+// PingTimeouts returns the number of connections dropped for not answering a ping
+func (s *WsStats) PingTimeouts() int64 { return atomic.LoadInt64(&s.pingTimeouts) }
+
+// IdleTimeouts returns the number of connections closed for being idle
+func (s *WsStats) IdleTimeouts() int64 { return atomic.LoadInt64(&s.idleTimeouts) }
+
+// LifetimeExpirations returns the number of connections closed for exceeding their lifetime
+func (s *WsStats) LifetimeExpirations() int64 { return atomic.LoadInt64(&s.lifetimeExpirations) }
+
+// watch pings the connection and closes it when idle or too old, until ctx is done.
+// lastRead is the unix nano time of the last message received.
+func (s *wsServer) watch(ctx context.Context, conn *websocket.Conn, lastRead *int64) {
+	ka := s.keepalive
+	var ping, idle, lifetime <-chan time.Time
+	if ka.PingInterval > 0 {
+		t := time.NewTicker(ka.PingInterval)
+		defer t.Stop()
+		ping = t.C
+	}
+	var idleTimer *time.Timer
+	if ka.IdleTimeout > 0 {
+		idleTimer = time.NewTimer(ka.IdleTimeout)
+		defer idleTimer.Stop()
+		idle = idleTimer.C
+	}
+	if ka.MaxLifetime > 0 {
+		t := time.NewTimer(ka.MaxLifetime)
+		defer t.Stop()
+		lifetime = t.C
+	}
+	for {
+		select {
+		case <-ping:
+			// A ping whose context expires drops the connection without a
+			// close frame, so the pong timeout is handled here
+			pong := make(chan error, 1)
+			go func() { pong <- conn.Ping(ctx) }()
+			timeout := time.NewTimer(ka.PongTimeout)
+			select {
+			case err := <-pong:
+				timeout.Stop()
+				if err != nil {
+					return
+				}
+			case <-timeout.C:
+				atomic.AddInt64(&s.stats.pingTimeouts, 1)
+				log.Debugf("websocket client did not answer the ping, closing connection")
+				conn.Close(websocket.StatusPolicyViolation, "ping timeout")
+				return
+			}
+		case <-idle:
+			since := time.Since(time.Unix(0, atomic.LoadInt64(lastRead)))
+			if since < ka.IdleTimeout {
+				idleTimer.Reset(ka.IdleTimeout - since)
+				continue
+			}
+			atomic.AddInt64(&s.stats.idleTimeouts, 1)
+			log.Debugf("closing idle websocket connection")
+			conn.Close(websocket.StatusGoingAway, "idle timeout")
+			return
+		case <-lifetime:
+			atomic.AddInt64(&s.stats.lifetimeExpirations, 1)
+			log.Debugf("closing websocket connection, maximum lifetime exceeded")
+			conn.Close(websocket.StatusTryAgainLater, "maximum connection lifetime exceeded")
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
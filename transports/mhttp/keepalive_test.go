@@ -0,0 +1,86 @@
+package mhttp
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"nhooyr.io/websocket"
+)
+
+func TestWsKeepalive(t *testing.T) {
+	start := func(t *testing.T, ka WsKeepalive) (*WebsocketHandle, transports.Transport) {
+		h := &WebsocketHandle{Keepalive: ka}
+		tr := newProxied(h)(t)
+		if err := tr.AddNamespace("/main"); err != nil {
+			t.Fatal(err)
+		}
+		receiver := make(chan transports.Message, 16)
+		tr.Listen(receiver)
+		return h, tr
+	}
+	waitFor := func(t *testing.T, what string, cond func() bool) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for !cond() {
+			if time.Now().After(deadline) {
+				t.Fatalf("timeout waiting for %s", what)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	t.Run("PingTimeout", func(t *testing.T) {
+		h, tr := start(t, WsKeepalive{PingInterval: 50 * time.Millisecond, PongTimeout: 50 * time.Millisecond})
+		// The client does not read, so the pings are not answered
+		c := dialWebsocket(t, tr, "/main").(*wsConn)
+		waitFor(t, "the ping timeout", func() bool { return h.WsStats().PingTimeouts() == 1 })
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err := c.Read(ctx)
+		if status := websocket.CloseStatus(err); status != websocket.StatusPolicyViolation {
+			t.Fatalf("closed with %v, want policy violation", err)
+		}
+		waitFor(t, "the connection to be closed", func() bool { return h.WsStats().Open() == 0 })
+	})
+
+	t.Run("Idle", func(t *testing.T) {
+		h, tr := start(t, WsKeepalive{PingInterval: 20 * time.Millisecond, IdleTimeout: 200 * time.Millisecond})
+		c := dialWebsocket(t, tr, "/main").(*wsConn)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// Reading answers the pings, but they do not count as activity
+		_, err := c.Read(ctx)
+		if status := websocket.CloseStatus(err); status != websocket.StatusGoingAway {
+			t.Fatalf("closed with %v, want going away", err)
+		}
+		if h.WsStats().IdleTimeouts() != 1 || h.WsStats().PingTimeouts() != 0 {
+			t.Fatalf("unexpected stats %+v", h.WsStats())
+		}
+	})
+
+	t.Run("MaxLifetime", func(t *testing.T) {
+		h, tr := start(t, WsKeepalive{IdleTimeout: 100 * time.Millisecond, MaxLifetime: 300 * time.Millisecond})
+		c := dialWebsocket(t, tr, "/main").(*wsConn)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// The messages keep the connection active until its lifetime is exceeded
+		go func() {
+			for ctx.Err() == nil {
+				if c.Write(ctx, []byte("{}")) != nil {
+					return
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+		}()
+		_, err := c.Read(ctx)
+		if status := websocket.CloseStatus(err); status != websocket.StatusTryAgainLater {
+			t.Fatalf("closed with %v, want try again later", err)
+		}
+		waitFor(t, "the connection to be closed", func() bool { return h.WsStats().Open() == 0 })
+		if h.WsStats().LifetimeExpirations() != 1 || h.WsStats().IdleTimeouts() != 0 {
+			t.Fatalf("unexpected stats %+v", h.WsStats())
+		}
+	})
+}
@@ -0,0 +1,142 @@
+package mhttp
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"nhooyr.io/websocket"
+)
+
+// wsCloseTimeout is the time the websocket close handshakes are waited for
+// on close. The peers which do not answer are left behind, the library drops
+// them after its own timeout.
+const wsCloseTimeout = time.Second
+
+// lifecycle tracks the in-flight HTTP requests and the open websockets of a
+// handler, so they are drained and closed when the handler is closed.
+type lifecycle struct {
+	done     chan struct{} // closed when the handler stops accepting requests
+	stopped  chan struct{} // closed when the messages are no longer forwarded
+	inflight sync.WaitGroup
+	closing  bool
+	ws       map[*websocket.Conn]struct{}
+	lock     sync.Mutex
+	once     sync.Once
+	err      error
+}
+
+func newLifecycle() *lifecycle {
+	return &lifecycle{
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		ws:      make(map[*websocket.Conn]struct{}),
+	}
+}
+
+// begin registers an in-flight request, it returns false if the handler is closing
+func (l *lifecycle) begin() bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closing {
+		return false
+	}
+	l.inflight.Add(1)
+	return true
+}
+
+// end unregisters an in-flight request
+func (l *lifecycle) end() {
+	l.inflight.Done()
+}
+
+// addWs registers an open websocket, it returns false if the handler is closing
+func (l *lifecycle) addWs(conn *websocket.Conn) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.closing {
+		return false
+	}
+	l.ws[conn] = struct{}{}
+	return true
+}
+
+func (l *lifecycle) removeWs(conn *websocket.Conn) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	delete(l.ws, conn)
+}
+
+// forward writes the messages of the handler into the receiver until the handler is closed
+func (l *lifecycle) forward(internal <-chan transports.Message, receiver chan<- transports.Message) {
+	for {
+		select {
+		case msg := <-internal:
+			select {
+			case receiver <- msg:
+			case <-l.stopped:
+				return
+			}
+		case <-l.stopped:
+			return
+		}
+	}
+}
+
+// unavailable replies to the requests received while the handler is closing
+func unavailable(w http.ResponseWriter) {
+	http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+}
+
+// close rejects the new requests, waits for the in-flight ones until ctx is
+// done and closes the websockets with the going away code.
+func (l *lifecycle) close(ctx context.Context) error {
+	l.once.Do(func() {
+		l.lock.Lock()
+		l.closing = true
+		l.lock.Unlock()
+		close(l.done)
+
+		drained := make(chan struct{})
+		go func() {
+			l.inflight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			l.err = ctx.Err()
+		}
+
+		l.lock.Lock()
+		conns := make([]*websocket.Conn, 0, len(l.ws))
+		for conn := range l.ws {
+			conns = append(conns, conn)
+		}
+		l.lock.Unlock()
+		var wg sync.WaitGroup
+		for _, conn := range conns {
+			wg.Add(1)
+			go func(conn *websocket.Conn) {
+				defer wg.Done()
+				conn.Close(websocket.StatusGoingAway, "server is shutting down")
+			}(conn)
+		}
+		closed := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(closed)
+		}()
+		timeout := time.NewTimer(wsCloseTimeout)
+		defer timeout.Stop()
+		select {
+		case <-closed:
+		case <-timeout.C:
+		case <-ctx.Done():
+		}
+		close(l.stopped)
+	})
+	return l.err
+}
@@ -0,0 +1,67 @@
+package mhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"nhooyr.io/websocket"
+)
+
+// TestGracefulClose checks Close waits for the in-flight requests, closes the
+// websockets with the going away code and rejects the new requests.
+func TestGracefulClose(t *testing.T) {
+	tr := newProxied(new(HttpWsHandler))(t)
+	if err := tr.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	tr.Listen(receiver)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	ws := dialWebsocket(t, tr, "/main").(*wsConn)
+	wsClosed := make(chan error, 1)
+	go func() {
+		_, err := ws.Read(ctx)
+		wsClosed <- err
+	}()
+	inflight := dialHTTP(t, tr, "/main")
+	if err := inflight.Write(ctx, []byte(`{"request":"ping"}`)); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-receiver
+
+	closed := make(chan error, 1)
+	go func() { closed <- tr.Close(ctx) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned with a request in flight: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	resp, err := http.Post(fmt.Sprintf("http://%s/main", tr.String()), "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("request while closing got status %d", resp.StatusCode)
+	}
+
+	if err := msg.Context.Send(transports.Message{Data: []byte(`{"reply":"pong"}`), Context: msg.Context}); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := inflight.Read(ctx); err != nil || strings.TrimSpace(string(data)) != `{"reply":"pong"}` {
+		t.Fatalf("in-flight request got %q: %v", data, err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if status := websocket.CloseStatus(<-wsClosed); status != websocket.StatusGoingAway {
+		t.Errorf("websocket closed with status %d, want %d", status, websocket.StatusGoingAway)
+	}
+}
@@ -0,0 +1,407 @@
+package mhttp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// DefaultPollTimeout is the default time a poll waits for new messages.
+	// It must be shorter than the Proxy request timeout.
+	DefaultPollTimeout = 20 * time.Second
+	// DefaultPollSessionTimeout is the default time a session is kept without being polled
+	DefaultPollSessionTimeout = 2 * time.Minute
+	// DefaultPollMessageTTL is the default time a queued message waits to be polled
+	DefaultPollMessageTTL = time.Minute
+	// DefaultPollQueueSize is the default number of messages a session can hold
+	DefaultPollQueueSize = 256
+)
+
+// PollReply is the body of the poll replies
+type PollReply struct {
+	Session  string            `json:"session"`
+	Cursor   uint64            `json:"cursor"`
+	Messages []json.RawMessage `json:"messages"`
+}
+
+type queuedMessage struct {
+	seq     uint64
+	expires time.Time
+	msg     transports.Message
+}
+
+// LongPollSession holds the messages of a client until it polls them
+type LongPollSession struct {
+	ID        string
+	Namespace string
+
+	queue    []queuedMessage
+	seq      uint64
+	lastPoll time.Time
+	notify   chan struct{}
+	lock     sync.Mutex
+}
+
+func (s *LongPollSession) enqueue(msg transports.Message, ttl time.Duration, size int) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.expire()
+	if len(s.queue) >= size {
+		return fmt.Errorf("long-poll session %s queue is full", s.ID)
+	}
+	s.seq++
+	s.queue = append(s.queue, queuedMessage{seq: s.seq, expires: time.Now().Add(ttl), msg: msg})
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// expire drops the expired messages, the lock must be held
+func (s *LongPollSession) expire() {
+	now := time.Now()
+	for len(s.queue) > 0 && now.After(s.queue[0].expires) {
+		log.Debugf("long-poll session %s message %d expired", s.ID, s.queue[0].seq)
+		s.queue = s.queue[1:]
+	}
+}
+
+// after acknowledges the messages up to cursor and returns the following ones
+func (s *LongPollSession) after(cursor uint64) PollReply {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.lastPoll = time.Now()
+	s.expire()
+	for len(s.queue) > 0 && s.queue[0].seq <= cursor {
+		s.queue = s.queue[1:]
+	}
+	reply := PollReply{Session: s.ID, Cursor: cursor, Messages: []json.RawMessage{}}
+	for _, q := range s.queue {
+		data := json.RawMessage(q.msg.Data)
+		if !json.Valid(data) {
+			data, _ = json.Marshal(string(q.msg.Data))
+		}
+		reply.Messages = append(reply.Messages, data)
+		reply.Cursor = q.seq
+	}
+	return reply
+}
+
+// LongPollContext is the MessageContext of the requests posted on a
+// long-poll session, the replies are queued until the client polls them.
+type LongPollContext struct {
+	Session *LongPollSession
+	Request *http.Request
+
+	handler *LongPollHandler
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (c *LongPollContext) ConnectionType() string {
+	return "LongPoll"
+}
+
+// Send queues the message on the session
+func (c *LongPollContext) Send(msg transports.Message) error {
+	return c.Session.enqueue(msg, c.handler.MessageTTL, c.handler.QueueSize)
+}
+
+// LongPollHandler serves the namespaces for the clients which can use
+// neither websockets nor server-sent events:
+//
+//   - GET <namespace> creates a session and returns its ID.
+//   - POST <namespace> with the X-Session-ID header (or the session query
+//     parameter) queues a request, its reply is returned by a later poll.
+//   - GET <namespace>?session=<id>&cursor=<n> acknowledges the messages up
+//     to cursor and waits up to PollTimeout for the following ones.
+//
+// The polls return a PollReply whose cursor must be sent on the next poll,
+// so the messages of a lost poll reply are returned again. The POST requests
+// without session are replied synchronously, as the HTTP transport does.
+type LongPollHandler struct {
+	Proxy          *Proxy
+	PollTimeout    time.Duration
+	SessionTimeout time.Duration
+	MessageTTL     time.Duration
+	QueueSize      int
+
+	internalReceiver chan transports.Message
+	sessions         map[string]*LongPollSession
+	lc               *lifecycle
+	lock             sync.RWMutex
+}
+
+func (h *LongPollHandler) Init(c *transports.Connection) error {
+	if h.PollTimeout == 0 {
+		h.PollTimeout = DefaultPollTimeout
+	}
+	if h.SessionTimeout == 0 {
+		h.SessionTimeout = DefaultPollSessionTimeout
+	}
+	if h.MessageTTL == 0 {
+		h.MessageTTL = DefaultPollMessageTTL
+	}
+	if h.QueueSize == 0 {
+		h.QueueSize = DefaultPollQueueSize
+	}
+	h.internalReceiver = make(chan transports.Message, 1)
+	h.sessions = make(map[string]*LongPollSession)
+	h.lc = newLifecycle()
+	go h.reap()
+	return nil
+}
+
+func (h *LongPollHandler) SetProxy(p *Proxy) {
+	h.Proxy = p
+}
+
+// AddProxyHandler adds the long-poll handler of path into the Proxy
+func (h *LongPollHandler) AddProxyHandler(path string) {
+	httpHandler := getHTTPhandler(path, h.internalReceiver, h.lc)
+	h.Proxy.AddHandler(path, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && sessionID(r) == "":
+			h.open(path, w)
+		case r.Method == http.MethodGet:
+			h.poll(path, w, r)
+		case sessionID(r) != "":
+			h.post(path, w, r)
+		default:
+			httpHandler(w, r)
+		}
+	})
+	h.Proxy.AddQueryHandler(path, getQueryHandler(path, h.internalReceiver, h.lc))
+}
+
+func (h *LongPollHandler) session(id, namespace string) *LongPollSession {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if s, ok := h.sessions[id]; ok && s.Namespace == namespace {
+		return s
+	}
+	return nil
+}
+
+// reap removes the expired sessions every SessionTimeout, until the handler is closed
+func (h *LongPollHandler) reap() {
+	ticker := time.NewTicker(h.SessionTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.expire()
+		case <-h.lc.done:
+			return
+		}
+	}
+}
+
+// expire removes the sessions not polled for longer than SessionTimeout
+func (h *LongPollHandler) expire() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for sid, old := range h.sessions {
+		old.lock.Lock()
+		expired := time.Since(old.lastPoll) > h.SessionTimeout
+		old.lock.Unlock()
+		if expired {
+			delete(h.sessions, sid)
+			log.Debugf("long-poll session %s expired", sid)
+		}
+	}
+}
+
+// open creates a session
+func (h *LongPollHandler) open(path string, w http.ResponseWriter) {
+	select {
+	case <-h.lc.done:
+		unavailable(w)
+		return
+	default:
+	}
+	id, err := newSessionID()
+	if err != nil {
+		http.Error(w, "cannot create session", http.StatusInternalServerError)
+		return
+	}
+	s := &LongPollSession{
+		ID:        id,
+		Namespace: path,
+		lastPoll:  time.Now(),
+		notify:    make(chan struct{}, 1),
+	}
+	h.lock.Lock()
+	h.sessions[id] = s
+	h.lock.Unlock()
+	writePollReply(w, s.after(0))
+}
+
+// poll returns the messages following the cursor, waiting for them if there are none
+func (h *LongPollHandler) poll(path string, w http.ResponseWriter, r *http.Request) {
+	s := h.session(sessionID(r), path)
+	if s == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	var cursor uint64
+	if c := r.URL.Query().Get("cursor"); c != "" {
+		var err error
+		if cursor, err = strconv.ParseUint(c, 10, 64); err != nil {
+			http.Error(w, "invalid cursor", http.StatusBadRequest)
+			return
+		}
+	}
+	// The poll outlives the server write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(h.PollTimeout + 5*time.Second)); err != nil {
+		log.Debugf("cannot extend long-poll write deadline: %v", err)
+	}
+	timeout := time.NewTimer(h.PollTimeout)
+	defer timeout.Stop()
+	for {
+		reply := s.after(cursor)
+		if len(reply.Messages) > 0 {
+			writePollReply(w, reply)
+			return
+		}
+		select {
+		case <-s.notify:
+		case <-timeout.C:
+			writePollReply(w, reply)
+			return
+		case <-h.lc.done:
+			writePollReply(w, reply)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func writePollReply(w http.ResponseWriter, reply PollReply) {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		http.Error(w, "cannot encode messages", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(append(data, '\n'))
+}
+
+// post queues a request of a session, its reply is returned by a later poll
+func (h *LongPollHandler) post(path string, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !h.lc.begin() {
+		unavailable(w)
+		return
+	}
+	defer h.lc.end()
+	s := h.session(sessionID(r), path)
+	if s == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Warnf("HTTP connection closed: (%s)", err)
+		return
+	}
+	h.internalReceiver <- transports.Message{
+		Data:      body,
+		TimeStamp: int32(time.Now().Unix()),
+		Context:   &LongPollContext{Session: s, Request: r, handler: h},
+		Namespace: path,
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *LongPollHandler) ConnectionType() string {
+	return "LongPoll"
+}
+
+func (h *LongPollHandler) Listen(receiver chan<- transports.Message) {
+	go h.lc.forward(h.internalReceiver, receiver)
+}
+
+// Send replies to the message context. If the message has no context, it is
+// queued on all the sessions of the message namespace.
+func (h *LongPollHandler) Send(msg transports.Message) error {
+	switch ctx := msg.Context.(type) {
+	case *LongPollContext:
+		return ctx.Send(msg)
+	case *HttpContext:
+		return ctx.Send(msg)
+	case nil:
+		h.lock.RLock()
+		defer h.lock.RUnlock()
+		for _, s := range h.sessions {
+			if msg.Namespace != "" && s.Namespace != msg.Namespace {
+				continue
+			}
+			if err := s.enqueue(msg, h.MessageTTL, h.QueueSize); err != nil {
+				log.Debugf("cannot broadcast: %v", err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+	}
+}
+
+// SendUnicast queues the message on the session identified by address
+func (h *LongPollHandler) SendUnicast(address string, msg transports.Message) error {
+	h.lock.RLock()
+	s, ok := h.sessions[address]
+	h.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no long-poll session %s", address)
+	}
+	return s.enqueue(msg, h.MessageTTL, h.QueueSize)
+}
+
+func (h *LongPollHandler) SetBootnodes(bootnodes []string) {
+	// No bootnodes on long-poll handler
+}
+
+func (h *LongPollHandler) AddPeer(peer string) error {
+	// No peers on long-poll handler
+	return nil
+}
+
+// AddNamespace adds a new namespace to the transport
+func (h *LongPollHandler) AddNamespace(namespace string) error {
+	if len(namespace) == 0 || namespace[0] != '/' {
+		return fmt.Errorf("namespace on long-poll must start with /")
+	}
+	h.AddProxyHandler(namespace)
+	return nil
+}
+
+func (h *LongPollHandler) Address() string {
+	return h.String()
+}
+
+// Close stops accepting requests, waits for the in-flight ones until ctx is
+// done and ends the pending polls. The proxy is not closed, since it might
+// be shared.
+func (h *LongPollHandler) Close(ctx context.Context) error {
+	err := h.lc.close(ctx)
+	h.lock.Lock()
+	h.sessions = make(map[string]*LongPollSession)
+	h.lock.Unlock()
+	return err
+}
+
+func (h *LongPollHandler) String() string {
+	return h.Proxy.Addr.String()
+}
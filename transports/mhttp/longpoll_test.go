@@ -0,0 +1,71 @@
+package mhttp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+)
+
+// TestLongPollCursor checks the messages are polled again until the cursor
+// acknowledges them, and the expired ones are dropped.
+func TestLongPollCursor(t *testing.T) {
+	h := &LongPollHandler{PollTimeout: 100 * time.Millisecond, MessageTTL: 200 * time.Millisecond}
+	tr := newProxied(h)(t)
+	if err := tr.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := dialPoll(t, tr, "/main").(*pollConn)
+	for _, data := range []string{`"one"`, `"two"`} {
+		if err := tr.SendUnicast(c.session, transports.Message{Data: []byte(data)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	poll := func(cursor uint64) *PollReply {
+		reply, err := c.poll(ctx, fmt.Sprintf("%s?session=%s&cursor=%d", c.url, c.session, cursor))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+	// The reply is lost, the same messages are polled again
+	if reply := poll(0); len(reply.Messages) != 2 || reply.Cursor != 2 {
+		t.Fatalf("got %d messages and cursor %d", len(reply.Messages), reply.Cursor)
+	}
+	reply := poll(0)
+	if len(reply.Messages) != 2 {
+		t.Fatalf("got %d messages, want them polled again", len(reply.Messages))
+	}
+	// Acknowledge the first one
+	if reply := poll(1); len(reply.Messages) != 1 || string(reply.Messages[0]) != `"two"` {
+		t.Fatalf("unexpected poll reply %+v", reply)
+	}
+	// The second one expires, the poll times out without messages
+	time.Sleep(300 * time.Millisecond)
+	if reply := poll(1); len(reply.Messages) != 0 || reply.Cursor != 1 {
+		t.Fatalf("unexpected poll reply %+v", reply)
+	}
+}
+
+// TestLongPollExpire checks the sessions not polled are removed after the
+// session timeout, even if no other session is opened.
+func TestLongPollExpire(t *testing.T) {
+	h := &LongPollHandler{SessionTimeout: 50 * time.Millisecond}
+	tr := newProxied(h)(t)
+	if err := tr.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	c := dialPoll(t, tr, "/main").(*pollConn)
+	deadline := time.Now().Add(5 * time.Second)
+	for h.session(c.session, "/main") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expired session not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,144 @@
+package mhttp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"nhooyr.io/websocket"
+)
+
+// clientCert returns a CA pool and a client certificate signed by its CA
+func clientCert(t *testing.T) (*x509.CertPool, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "multirpc ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: "backend", Organization: []string{"vocdoni"}},
+		DNSNames:       []string{"backend.internal"},
+		URIs:           []*url.URL{{Scheme: "spiffe", Host: "vocdoni", Path: "/backend"}},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		AuthorityKeyId: ca.SubjectKeyId,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	return pool, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// TestClientCertificate checks the verified client identity is exposed on
+// the HTTP and websocket contexts, and the clients without a valid
+// certificate are rejected if it is required.
+func TestClientCertificate(t *testing.T) {
+	pool, cert := clientCert(t)
+	pxy := NewProxy()
+	pxy.Conn.Address = "127.0.0.1"
+	pxy.TLSConfig = &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	pxy.ClientCAs = pool
+	pxy.ClientAuth = tls.RequireAndVerifyClientCert
+	if err := pxy.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer pxy.Close(context.Background())
+	h := new(HttpWsHandler)
+	if err := h.Init(new(transports.Connection)); err != nil {
+		t.Fatal(err)
+	}
+	h.SetProxy(pxy)
+	if err := h.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	h.Listen(receiver)
+	identities := make(chan *transports.ClientIdentity, 1)
+	go func() {
+		for msg := range receiver {
+			identities <- msg.Context.(transports.IdentityContext).ClientIdentity()
+			h.Send(transports.Message{Data: msg.Data, Context: msg.Context})
+		}
+	}()
+	checkIdentity := func(id *transports.ClientIdentity) {
+		t.Helper()
+		if id == nil {
+			t.Fatal("missing client identity")
+		}
+		if id.CommonName != "backend" || !strings.Contains(id.Subject, "O=vocdoni") ||
+			len(id.DNSNames) != 1 || id.DNSNames[0] != "backend.internal" ||
+			len(id.URIs) != 1 || id.URIs[0] != "spiffe://vocdoni/backend" ||
+			id.Fingerprint != transports.NewClientIdentity(id.Certificate).Fingerprint || len(id.Fingerprint) != 64 {
+			t.Fatalf("unexpected client identity %+v", id)
+		}
+	}
+	url := fmt.Sprintf("https://%s/main", pxy.Addr)
+
+	// Without a client certificate the handshake fails
+	anon := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	if resp, err := anon.Post(url, "application/json", strings.NewReader("{}")); err == nil {
+		resp.Body.Close()
+		t.Fatal("request without client certificate must fail")
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}}
+	c := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+	resp, err := c.Post(url, "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	checkIdentity(<-identities)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	ws, _, err := websocket.Dial(ctx, "wss://"+strings.TrimPrefix(url, "https://"), &websocket.DialOptions{
+		HTTPClient: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close(websocket.StatusNormalClosure, "")
+	if err := ws.Write(ctx, websocket.MessageText, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+	checkIdentity(<-identities)
+}
@@ -4,15 +4,18 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	reuse "github.com/libp2p/go-reuseport"
 	"github.com/p4u/recws"
+	"github.com/quic-go/quic-go/http3"
 	"github.com/vocdoni/multirpc/transports"
 	"go.uber.org/zap"
 	"go.vocdoni.io/dvote/log"
@@ -32,12 +35,164 @@ const desiredSoMaxConn = 4096
 // ProxyWsHandler function signature required to add a handler in the net/http Server
 type ProxyWsHandler func(c *websocket.Conn)
 
+// ProxyWsRequestHandler is a ProxyWsHandler which also gets the upgrade request
+type ProxyWsRequestHandler func(c *websocket.Conn, r *http.Request)
+
+// Disabled disables a timeout or a limit of the ProxyConfig
+const Disabled = -1
+
+// NoHeartbeat is the ProxyConfig HeartbeatPath disabling the heartbeat handler
+const NoHeartbeat = "-"
+
+// ProxyConfig holds the HTTP server settings of the proxy. The fields left to
+// their zero value take the default one, so a partial config can be given.
+// The timeouts, ThrottleLimit and ThrottleBacklog are disabled with a negative
+// value (Disabled), and the heartbeat handler with NoHeartbeat.
+type ProxyConfig struct {
+	// ReadTimeout, WriteTimeout, IdleTimeout and ReadHeaderTimeout are the
+	// timeouts of the underlying http.Server
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	ReadHeaderTimeout time.Duration
+
+	// ThrottleLimit is the maximum number of requests processed at once,
+	// up to ThrottleBacklog requests wait ThrottleTimeout for their turn
+	ThrottleLimit   int
+	ThrottleBacklog int
+	ThrottleTimeout time.Duration
+
+	// RequestTimeout cancels the context of the requests taking longer.
+	// The streaming handlers (SSE, long-polling) must fit into it.
+	RequestTimeout time.Duration
+
+	// AllowedOrigins is the list of origins allowed for the cross-domain
+	// requests and the websockets, they can contain a wildcard
+	// (https://*.example.com). If empty, any origin is allowed.
+	AllowedOrigins []string
+	// AllowedHeaders is the list of headers the cross-domain requests can use
+	AllowedHeaders []string
+	// DisallowCredentials forbids the cross-domain requests to send cookies
+	// and client certificates
+	DisallowCredentials bool
+
+	// HeartbeatPath is the path replying to the health checks
+	HeartbeatPath string
+}
+
+// DefaultProxyConfig returns the default settings of the proxy serving
+// without letsencrypt domain
+func DefaultProxyConfig() *ProxyConfig {
+	return &ProxyConfig{
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      10 * time.Second,
+		IdleTimeout:       10 * time.Second,
+		ReadHeaderTimeout: 3 * time.Second,
+		ThrottleLimit:     5000,
+		ThrottleBacklog:   40000,
+		ThrottleTimeout:   30 * time.Second,
+		RequestTimeout:    30 * time.Second,
+		AllowedHeaders:    []string{"Content-Type"},
+		HeartbeatPath:     "/ping",
+	}
+}
+
+// DefaultTLSProxyConfig returns the default settings of the proxy serving
+// the letsencrypt domain, with longer read and write timeouts
+func DefaultTLSProxyConfig() *ProxyConfig {
+	c := DefaultProxyConfig()
+	c.ReadTimeout = 20 * time.Second
+	c.WriteTimeout = 15 * time.Second
+	c.ReadHeaderTimeout = 5 * time.Second
+	return c
+}
+
+// withDefaults returns a copy of c where the zero fields take the value of d,
+// and the disabled ones are set to zero
+func (c *ProxyConfig) withDefaults(d *ProxyConfig) *ProxyConfig {
+	if c == nil {
+		return d
+	}
+	r := *c
+	for _, f := range []struct{ v, d *time.Duration }{
+		{&r.ReadTimeout, &d.ReadTimeout},
+		{&r.WriteTimeout, &d.WriteTimeout},
+		{&r.IdleTimeout, &d.IdleTimeout},
+		{&r.ReadHeaderTimeout, &d.ReadHeaderTimeout},
+		{&r.ThrottleTimeout, &d.ThrottleTimeout},
+		{&r.RequestTimeout, &d.RequestTimeout},
+	} {
+		if *f.v == 0 {
+			*f.v = *f.d
+		} else if *f.v < 0 {
+			*f.v = 0
+		}
+	}
+	for _, f := range []struct{ v, d *int }{
+		{&r.ThrottleLimit, &d.ThrottleLimit},
+		{&r.ThrottleBacklog, &d.ThrottleBacklog},
+	} {
+		if *f.v == 0 {
+			*f.v = *f.d
+		} else if *f.v < 0 {
+			*f.v = 0
+		}
+	}
+	if r.AllowedHeaders == nil {
+		r.AllowedHeaders = d.AllowedHeaders
+	}
+	switch r.HeartbeatPath {
+	case "":
+		r.HeartbeatPath = d.HeartbeatPath
+	case NoHeartbeat:
+		r.HeartbeatPath = ""
+	}
+	return &r
+}
+
 // Proxy represents a proxy
 type Proxy struct {
 	Conn      *transports.Connection
 	Server    *chi.Mux
 	Addr      net.Addr
 	TLSConfig *tls.Config
+	// Config holds the server settings. Its zero fields take the value of
+	// DefaultTLSProxyConfig when serving a letsencrypt domain, of
+	// DefaultProxyConfig otherwise.
+	Config *ProxyConfig
+
+	// ClientCAs enables the TLS client certificates authentication, the
+	// certificates are verified against this pool. It requires TLS, either
+	// the letsencrypt domain or a TLSConfig with certificates.
+	ClientCAs *x509.CertPool
+	// ClientAuth is the client certificates policy used if ClientCAs is set,
+	// tls.VerifyClientCertIfGiven if left as tls.NoClientCert
+	ClientAuth tls.ClientAuthType
+
+	// TLSCertFile and TLSKeyFile are the PEM files of the server certificate,
+	// as an alternative to the letsencrypt domain. They are reloaded when they
+	// change, checked every CertReloadInterval (DefaultCertReloadInterval if 0).
+	TLSCertFile        string
+	TLSKeyFile         string
+	CertReloadInterval time.Duration
+	// Certs serves the certificate of TLSCertFile and TLSKeyFile, set by Init
+	Certs *CertReloader
+
+	// ACME configures the letsencrypt certificates of Conn.TLSdomain
+	ACME     *ACMEConfig
+	acmeHTTP *http.Server
+	acmeStop chan struct{}
+	fallback *tls.Certificate
+
+	// HTTP3 enables HTTP/3 over QUIC on the same port (UDP). It requires TLS,
+	// either the letsencrypt domain or a TLSConfig with certificates.
+	HTTP3 bool
+	// H3Addr is the UDP address serving HTTP/3
+	H3Addr net.Addr
+	h3     *http3.Server
+
+	server    *http.Server
+	wsOrigins []string // origin patterns of the websocket upgrades
 }
 
 // NewProxy creates a new proxy instance
@@ -72,8 +227,47 @@ func (l stdLogger) Print(v ...interface{}) { l.log.Debug(v...) }
 // When it returns, the server is ready. The returned address is useful if the
 // port was left as 0, to retrieve the randomly allocated port.
 func (p *Proxy) Init() error {
+	if p.TLSCertFile != "" || p.TLSKeyFile != "" {
+		if len(p.domains()) > 0 {
+			return fmt.Errorf("TLS certificate files cannot be used with a letsencrypt domain")
+		}
+		certs, err := NewCertReloader(p.TLSCertFile, p.TLSKeyFile, p.CertReloadInterval)
+		if err != nil {
+			return err
+		}
+		if p.TLSConfig == nil {
+			p.TLSConfig = &tls.Config{}
+		} else {
+			p.TLSConfig = p.TLSConfig.Clone()
+		}
+		p.TLSConfig.Certificates = nil
+		p.TLSConfig.GetCertificate = certs.GetCertificate
+		p.Certs = certs
+		log.Infof("using TLS certificate %s, expires %s", p.TLSCertFile, certs.NotAfter())
+	}
+	// Without letsencrypt domain, TLS is served only with a TLSConfig
+	// certificate, which HTTP/3 and the client certificates require
+	hasCert := p.TLSConfig != nil && (len(p.TLSConfig.Certificates) > 0 || p.TLSConfig.GetCertificate != nil)
+	if len(p.domains()) == 0 && !hasCert {
+		var err error
+		if p.HTTP3 {
+			err = fmt.Errorf("http3 requires a TLS certificate")
+		} else if p.ClientCAs != nil {
+			err = fmt.Errorf("client certificates authentication requires a TLS certificate")
+		}
+		if err != nil {
+			if p.Certs != nil {
+				p.Certs.Close()
+			}
+			return err
+		}
+	}
+
 	ln, err := reuse.Listen("tcp", fmt.Sprintf("%s:%d", p.Conn.Address, p.Conn.Port))
 	if err != nil {
+		if p.Certs != nil {
+			p.Certs.Close()
+		}
 		return err
 	}
 
@@ -82,6 +276,11 @@ func (p *Proxy) Init() error {
 			"Consider increasing it: echo %d | sudo tee /proc/sys/net/core/somaxconn", n, desiredSoMaxConn)
 	}
 
+	cfg := p.Config.withDefaults(DefaultProxyConfig())
+	if len(p.domains()) > 0 {
+		cfg = p.Config.withDefaults(DefaultTLSProxyConfig())
+	}
+	p.wsOrigins = wsOriginPatterns(cfg.AllowedOrigins)
 	p.Server = chi.NewRouter()
 	p.Server.Use(middleware.RealIP)
 	// If we want rich logging (e.g. with fields), we could implement our
@@ -91,76 +290,248 @@ func (p *Proxy) Init() error {
 		NoColor: true,
 	}))
 	p.Server.Use(middleware.Recoverer)
-	p.Server.Use(middleware.Heartbeat("/ping"))
-	p.Server.Use(middleware.ThrottleBacklog(5000, 40000, 30*time.Second))
-	p.Server.Use(middleware.Timeout(30 * time.Second))
-	cors := cors.New(cors.Options{
-		AllowOriginFunc: func(r *http.Request, origin string) bool {
-			return true
-		}, // Kind of equivalent to AllowedOrigin: []string{"*"} but it returns the origin as allowed origin.
+	if cfg.HeartbeatPath != "" {
+		p.Server.Use(middleware.Heartbeat(cfg.HeartbeatPath))
+	}
+	if cfg.ThrottleLimit > 0 {
+		p.Server.Use(middleware.ThrottleBacklog(cfg.ThrottleLimit, cfg.ThrottleBacklog, cfg.ThrottleTimeout))
+	}
+	if cfg.RequestTimeout > 0 {
+		p.Server.Use(middleware.Timeout(cfg.RequestTimeout))
+	}
+	corsOptions := cors.Options{
+		AllowedOrigins:   cfg.AllowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "OPTIONS"},
-		AllowedHeaders:   []string{"Content-Type"},
-		AllowCredentials: true,
+		AllowedHeaders:   cfg.AllowedHeaders,
+		AllowCredentials: !cfg.DisallowCredentials,
 		MaxAge:           300, // Maximum value not ignored by any of major browsers
-	})
-	p.Server.Use(cors.Handler)
+	}
+	if len(cfg.AllowedOrigins) == 0 {
+		// Kind of equivalent to AllowedOrigin: []string{"*"} but it returns the origin as allowed origin.
+		corsOptions.AllowOriginFunc = func(r *http.Request, origin string) bool {
+			return true
+		}
+	}
+	p.Server.Use(cors.New(corsOptions).Handler)
+	if p.HTTP3 {
+		p.h3 = &http3.Server{Handler: p.Server}
+		p.Server.Use(p.altSvc)
+	}
 
-	if len(p.Conn.TLSdomain) > 0 {
-		log.Infof("fetching letsencrypt TLS certificate for %s", p.Conn.TLSdomain)
+	if domains := p.domains(); len(domains) > 0 {
+		acmeConfig := p.ACME
+		if acmeConfig == nil {
+			acmeConfig = new(ACMEConfig)
+		}
+		// stop shuts down what has been started when Init fails
+		stop := func() {
+			if p.acmeStop != nil {
+				close(p.acmeStop)
+				p.acmeStop = nil
+			}
+			if p.acmeHTTP != nil {
+				p.acmeHTTP.Close()
+				p.acmeHTTP = nil
+			}
+			if p.server != nil {
+				p.server.Close()
+				p.server = nil
+			}
+			ln.Close()
+		}
+		if acmeConfig.NonFatal {
+			if p.fallback = acmeConfig.FallbackCertificate; p.fallback == nil {
+				if p.fallback, err = selfSignedCertificate(domains); err != nil {
+					stop()
+					return fmt.Errorf("cannot create fallback TLS certificate: %w", err)
+				}
+			}
+		}
+		log.Infof("fetching letsencrypt TLS certificate for %v", domains)
 		s, m := p.GenerateSSLCertificate(p.TLSConfig)
-		s.ReadTimeout = 20 * time.Second
-		s.WriteTimeout = 15 * time.Second
-		s.IdleTimeout = 10 * time.Second
-		s.ReadHeaderTimeout = 5 * time.Second
+		p.acmeStop = make(chan struct{})
+		if acmeConfig.HTTPChallengeAddr != "" {
+			if err := p.serveHTTPChallenge(acmeConfig.HTTPChallengeAddr, m); err != nil {
+				stop()
+				return fmt.Errorf("cannot serve ACME HTTP-01 challenge: %w", err)
+			}
+		}
+		p.clientAuth(s.TLSConfig)
+		s.ReadTimeout = cfg.ReadTimeout
+		s.WriteTimeout = cfg.WriteTimeout
+		s.IdleTimeout = cfg.IdleTimeout
+		s.ReadHeaderTimeout = cfg.ReadHeaderTimeout
 		s.Handler = p.Server
 		if err := http2.ConfigureServer(s, nil); err != nil {
+			stop()
 			return err
 		}
+		p.server = s
 		go func() {
 			log.Info("starting go-chi https server")
-			log.Fatal(s.ServeTLS(ln, "", ""))
+			if err := s.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+				log.Errorf("https server stopped: %v", err)
+			}
 		}()
-		certs, err := getCertificates(p.Conn.TLSdomain, m)
-		if len(certs) == 0 || err != nil {
+		if err := p.obtainCertificates(m); err != nil {
 			log.Warnf(`letsencrypt TLS certificate cannot be obtained. Maybe port 443 is not accessible or domain name is wrong.
 							You might want to redirect port 443 with iptables using the following command:
 							sudo iptables -t nat -I PREROUTING -p tcp --dport 443 -j REDIRECT --to-ports %d`, p.Conn.Port)
-			return fmt.Errorf("cannot get letsencrypt TLS certificate: (%s)", err)
+			if !acmeConfig.NonFatal {
+				stop()
+				return fmt.Errorf("cannot get letsencrypt TLS certificate: (%s)", err)
+			}
+			log.Warnf("serving a fallback TLS certificate until the letsencrypt one is obtained")
+			go p.retryCertificates(m, acmeConfig.RetryInterval)
 		}
 		log.Infof("proxy ready at https://%s", ln.Addr())
+		if p.HTTP3 {
+			if err := p.serveHTTP3(s.TLSConfig, ln.Addr()); err != nil {
+				stop()
+				return err
+			}
+		}
 
 	} else {
-		log.Info("starting go-chi http server")
 		s := &http.Server{
-			ReadTimeout:       10 * time.Second,
-			WriteTimeout:      10 * time.Second,
-			IdleTimeout:       10 * time.Second,
-			ReadHeaderTimeout: 3 * time.Second,
+			ReadTimeout:       cfg.ReadTimeout,
+			WriteTimeout:      cfg.WriteTimeout,
+			IdleTimeout:       cfg.IdleTimeout,
+			ReadHeaderTimeout: cfg.ReadHeaderTimeout,
 			Handler:           p.Server,
 		}
+		if hasCert {
+			s.TLSConfig = p.TLSConfig.Clone()
+			p.clientAuth(s.TLSConfig)
+		}
 		if err := http2.ConfigureServer(s, nil); err != nil {
+			ln.Close()
 			return err
 		}
-		go func() {
-			log.Fatal(s.Serve(ln))
-		}()
-		log.Infof("proxy ready at http://%s", ln.Addr())
+		p.server = s
+		if hasCert {
+			log.Info("starting go-chi https server")
+			go func() {
+				if err := s.ServeTLS(ln, "", ""); err != nil && err != http.ErrServerClosed {
+					log.Errorf("https server stopped: %v", err)
+				}
+			}()
+			log.Infof("proxy ready at https://%s", ln.Addr())
+		} else {
+			log.Info("starting go-chi http server")
+			go func() {
+				if err := s.Serve(ln); err != nil && err != http.ErrServerClosed {
+					log.Errorf("http server stopped: %v", err)
+				}
+			}()
+			log.Infof("proxy ready at http://%s", ln.Addr())
+		}
+		if p.HTTP3 {
+			if err := p.serveHTTP3(s.TLSConfig, ln.Addr()); err != nil {
+				s.Close()
+				return err
+			}
+		}
 	}
 	p.Addr = ln.Addr()
 	return nil
 }
 
+// clientAuth enables the client certificates verification on c if ClientCAs is set
+func (p *Proxy) clientAuth(c *tls.Config) {
+	if p.ClientCAs == nil {
+		return
+	}
+	c.ClientCAs = p.ClientCAs
+	c.ClientAuth = p.ClientAuth
+	if c.ClientAuth == tls.NoClientCert {
+		c.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+}
+
+// serveHTTP3 starts the HTTP/3 server on the UDP port matching the TCP
+// listener. Each request is served on its own QUIC stream and the
+// connections survive the client network changes (connection migration).
+func (p *Proxy) serveHTTP3(tlsConfig *tls.Config, addr net.Addr) error {
+	udp, err := net.ListenPacket("udp", addr.String())
+	if err != nil {
+		return fmt.Errorf("cannot listen for http3: %w", err)
+	}
+	p.h3.TLSConfig = tlsConfig.Clone()
+	p.H3Addr = udp.LocalAddr()
+	go func() {
+		log.Info("starting http3 server")
+		if err := p.h3.Serve(udp); err != nil && err != http.ErrServerClosed {
+			log.Errorf("http3 server stopped: %v", err)
+		}
+	}()
+	log.Infof("http3 ready at https://%s", p.H3Addr)
+	return nil
+}
+
+// Close gracefully shuts down the proxy: the listeners are closed and the
+// in-flight requests are drained until ctx is done. The websockets are
+// hijacked connections, so they must be closed by their handlers.
+func (p *Proxy) Close(ctx context.Context) error {
+	var err error
+	if p.Certs != nil {
+		p.Certs.Close()
+	}
+	if p.acmeStop != nil {
+		select {
+		case <-p.acmeStop:
+		default:
+			close(p.acmeStop)
+		}
+	}
+	// The first error is returned, the other servers are shut down anyway
+	keep := func(e error) {
+		if err == nil {
+			err = e
+		}
+	}
+	if p.acmeHTTP != nil {
+		keep(p.acmeHTTP.Shutdown(ctx))
+	}
+	if p.h3 != nil {
+		keep(p.h3.Shutdown(ctx))
+	}
+	if p.server != nil {
+		keep(p.server.Shutdown(ctx))
+	}
+	return err
+}
+
+// altSvc advertises the HTTP/3 endpoint to the HTTP/1 and HTTP/2 clients
+func (p *Proxy) altSvc(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			if err := p.h3.SetQUICHeaders(w.Header()); err != nil {
+				log.Debugf("cannot set Alt-Svc header: %v", err)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 // GenerateSSLCertificate generates a SSL certificated for the proxy
 func (p *Proxy) GenerateSSLCertificate(tlsConfig *tls.Config) (*http.Server, *autocert.Manager) {
 	m := autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(p.Conn.TLSdomain),
+		HostPolicy: autocert.HostWhitelist(p.domains()...),
 		Cache:      autocert.DirCache(p.Conn.TLScertDir),
 	}
+	if p.ACME != nil {
+		m.Email = p.ACME.Email
+		m.Client = &acme.Client{DirectoryURL: p.ACME.DirectoryURL, HTTPClient: p.ACME.HTTPClient}
+	}
 	if tlsConfig == nil {
 		tlsConfig = &tls.Config{}
 	}
 	tlsConfig.GetCertificate = m.GetCertificate
+	if p.fallback != nil {
+		tlsConfig.GetCertificate = fallbackGetCertificate(&m, p.fallback)
+	}
 	serverConfig := &http.Server{
 		Addr:      fmt.Sprintf("%s:%d", p.Conn.Address, p.Conn.Port), // 443 tls
 		TLSConfig: tlsConfig,
@@ -172,9 +543,15 @@ func (p *Proxy) GenerateSSLCertificate(tlsConfig *tls.Config) (*http.Server, *au
 
 // AddWsHandler adds a websocket handler in the proxy
 func (p *Proxy) AddWsHandler(path string, handler ProxyWsHandler, readLimit int64) {
+	p.AddWsRequestHandler(path, func(c *websocket.Conn, r *http.Request) { handler(c) }, readLimit)
+}
+
+// AddWsRequestHandler adds a websocket handler getting the upgrade request in
+// the proxy, negotiating one of subprotocols if given
+func (p *Proxy) AddWsRequestHandler(path string, handler ProxyWsRequestHandler, readLimit int64, subprotocols ...string) {
 	p.Server.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Upgrade") == "websocket" {
-			wshandler(w, r, handler, readLimit)
+			wshandler(w, r, handler, readLimit, subprotocols, p.wsOrigins)
 		} else {
 			log.Warn("receied a non upgrade websockets connection to a only WS endpoint")
 		}
@@ -183,15 +560,27 @@ func (p *Proxy) AddWsHandler(path string, handler ProxyWsHandler, readLimit int6
 
 // AddMixedHandler adds a mixed (websockets and HTTP) handler in the proxy
 func (p *Proxy) AddMixedHandler(path string, HTTPhandler http.HandlerFunc, WShandler ProxyWsHandler, WSreadLimit int64) {
+	p.AddMixedRequestHandler(path, HTTPhandler, func(c *websocket.Conn, r *http.Request) { WShandler(c) }, WSreadLimit)
+}
+
+// AddMixedRequestHandler adds a mixed (websockets and HTTP) handler in the
+// proxy, the websocket handler gets the upgrade request and one of
+// subprotocols is negotiated if given
+func (p *Proxy) AddMixedRequestHandler(path string, HTTPhandler http.HandlerFunc, WShandler ProxyWsRequestHandler, WSreadLimit int64, subprotocols ...string) {
 	p.Server.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get("Upgrade") == "websocket" {
-			wshandler(w, r, WShandler, WSreadLimit)
+			wshandler(w, r, WShandler, WSreadLimit, subprotocols, p.wsOrigins)
 		} else {
 			HTTPhandler(w, r)
 		}
 	})
 }
 
+// AddQueryHandler adds the HTTP handler of the GET path/{method} queries in the proxy
+func (p *Proxy) AddQueryHandler(path string, handler http.HandlerFunc) {
+	p.Server.Get(strings.TrimSuffix(path, "/")+"/{method}", handler)
+}
+
 // AddHandler adds a HTTP handler in the proxy
 func (p *Proxy) AddHandler(path string, handler http.HandlerFunc) {
 	p.Server.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,206 @@
+package mhttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go/http3"
+	"github.com/vocdoni/multirpc/transports"
+	"nhooyr.io/websocket"
+)
+
+// selfSigned returns a server certificate for 127.0.0.1
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "multirpc"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHTTP3(t *testing.T) {
+	// HTTP/3 is not advertised from a plain HTTP origin, and the failing
+	// Init does not keep the port
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := free.Addr().(*net.TCPAddr).Port
+	free.Close()
+	pxy := NewProxy()
+	pxy.Conn.Address = "127.0.0.1"
+	pxy.Conn.Port = int32(port)
+	pxy.HTTP3 = true
+	if err := pxy.Init(); err == nil {
+		t.Fatal("expected error enabling http3 without a certificate")
+	}
+	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("port kept by the failing Init: %v", err)
+	}
+	ln.Close()
+
+	pxy = NewProxy()
+	pxy.Conn.Address = "127.0.0.1"
+	pxy.HTTP3 = true
+	pxy.TLSConfig = &tls.Config{Certificates: []tls.Certificate{selfSigned(t)}}
+	if err := pxy.Init(); err != nil {
+		t.Fatal(err)
+	}
+	h := new(HttpHandler)
+	if err := h.Init(new(transports.Connection)); err != nil {
+		t.Fatal(err)
+	}
+	h.SetProxy(pxy)
+	if err := h.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	h.Listen(receiver)
+	go func() {
+		for msg := range receiver {
+			h.Send(transports.Message{Data: msg.Data, Context: msg.Context})
+		}
+	}()
+
+	// The HTTP/1 and HTTP/2 responses advertise the HTTP/3 endpoint
+	tc := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	resp, err := tc.Post(fmt.Sprintf("https://%s/main", pxy.Addr), "application/json", bytes.NewReader([]byte("tcp")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Alt-Svc") == "" {
+		t.Fatal("missing Alt-Svc header")
+	}
+
+	rt := &http3.RoundTripper{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	defer rt.Close()
+	c := &http.Client{Transport: rt, Timeout: 5 * time.Second}
+	resp, err = c.Post(fmt.Sprintf("https://%s/main", pxy.H3Addr), "application/json", bytes.NewReader([]byte("quic")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.ProtoMajor != 3 || string(bytes.TrimSpace(body)) != "quic" {
+		t.Fatalf("got %q over %s, want quic over HTTP/3", body, resp.Proto)
+	}
+}
+
+func TestProxyConfig(t *testing.T) {
+	pxy := NewProxy()
+	pxy.Conn.Address = "127.0.0.1"
+	// The unset fields take the defaults
+	pxy.Config = &ProxyConfig{
+		AllowedOrigins: []string{"https://*.example.com"},
+		AllowedHeaders: []string{"Content-Type", "X-Session-ID"},
+		HeartbeatPath:  "/health",
+	}
+	if err := pxy.Init(); err != nil {
+		t.Fatal(err)
+	}
+	defer pxy.Close(context.Background())
+	pxy.AddHandler("/main", func(w http.ResponseWriter, r *http.Request) {})
+
+	for path, status := range map[string]int{"/health": http.StatusOK, "/ping": http.StatusNotFound} {
+		resp, err := http.Get(fmt.Sprintf("http://%s%s", pxy.Addr, path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			t.Errorf("GET %s got status %d, want %d", path, resp.StatusCode, status)
+		}
+	}
+
+	preflight := func(origin string) http.Header {
+		req, err := http.NewRequest(http.MethodOptions, fmt.Sprintf("http://%s/main", pxy.Addr), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "X-Session-ID")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.Header
+	}
+	if h := preflight("https://app.example.com"); h.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		h.Get("Access-Control-Allow-Credentials") != "true" {
+		t.Errorf("allowed origin got headers %v", h)
+	}
+	if h := preflight("https://evil.org"); h.Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("disallowed origin got headers %v", h)
+	}
+
+	// The websocket upgrades are restricted to the same origins
+	pxy.AddWsHandler("/ws", func(c *websocket.Conn) { c.Close(websocket.StatusNormalClosure, "") }, 0)
+	for origin, allowed := range map[string]bool{"https://app.example.com": true, "https://evil.org": false} {
+		h := http.Header{}
+		h.Set("Origin", origin)
+		conn, _, err := websocket.Dial(context.Background(), fmt.Sprintf("ws://%s/ws", pxy.Addr),
+			&websocket.DialOptions{HTTPHeader: h})
+		if err == nil {
+			conn.Close(websocket.StatusNormalClosure, "")
+		}
+		if allowed != (err == nil) {
+			t.Errorf("websocket from origin %s: allowed %v, got error %v", origin, allowed, err)
+		}
+	}
+}
+
+func TestProxyConfigDefaults(t *testing.T) {
+	if c := (*ProxyConfig)(nil).withDefaults(DefaultTLSProxyConfig()); c.ReadTimeout != 20*time.Second ||
+		c.WriteTimeout != 15*time.Second || c.ReadHeaderTimeout != 5*time.Second {
+		t.Errorf("unexpected letsencrypt defaults %+v", c)
+	}
+	c := (&ProxyConfig{
+		WriteTimeout:    30 * time.Second,
+		RequestTimeout:  Disabled,
+		ThrottleLimit:   Disabled,
+		ThrottleBacklog: Disabled,
+		HeartbeatPath:   NoHeartbeat,
+	}).withDefaults(DefaultProxyConfig())
+	d := DefaultProxyConfig()
+	if c.ReadTimeout != d.ReadTimeout || c.IdleTimeout != d.IdleTimeout || c.ThrottleTimeout != d.ThrottleTimeout ||
+		len(c.AllowedHeaders) != len(d.AllowedHeaders) || c.DisallowCredentials {
+		t.Errorf("unset fields did not take the defaults: %+v", c)
+	}
+	if c.WriteTimeout != 30*time.Second {
+		t.Errorf("got write timeout %s, want 30s", c.WriteTimeout)
+	}
+	if c.RequestTimeout != 0 || c.ThrottleLimit != 0 || c.ThrottleBacklog != 0 || c.HeartbeatPath != "" {
+		t.Errorf("disabled fields not cleared: %+v", c)
+	}
+}
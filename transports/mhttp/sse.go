@@ -0,0 +1,427 @@
+package mhttp
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// SSESessionHeader is the header identifying the session of a POST request
+	SSESessionHeader = "X-Session-ID"
+	// DefaultSSEKeepAlive is the default interval of the keepalive comments sent on the streams
+	DefaultSSEKeepAlive = 15 * time.Second
+	// DefaultSSEStreamDuration is the default duration of a stream before the
+	// server closes it and the client reconnects. It must be shorter than the
+	// Proxy request timeout.
+	DefaultSSEStreamDuration = 25 * time.Second
+	// DefaultSSESessionTimeout is the default time a session is kept without any stream attached
+	DefaultSSESessionTimeout = 2 * time.Minute
+	// DefaultSSEQueueSize is the default number of messages a session can hold
+	DefaultSSEQueueSize = 256
+)
+
+// SSESession holds the messages of a client until they are written on its
+// event stream. The session outlives the streams, so the client can
+// reconnect without losing messages.
+type SSESession struct {
+	ID        string
+	Namespace string
+
+	queue    chan []byte
+	seq      uint64
+	attached bool
+	lastSeen time.Time
+	closed   bool
+	lock     sync.Mutex
+}
+
+func (s *SSESession) enqueue(data []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf("sse session %s is closed", s.ID)
+	}
+	select {
+	case s.queue <- data:
+		return nil
+	default:
+		return fmt.Errorf("sse session %s queue is full", s.ID)
+	}
+}
+
+// SSEContext is the MessageContext of the requests posted on a SSE session,
+// the replies are written on the session event stream.
+type SSEContext struct {
+	Session *SSESession
+	Request *http.Request
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (c *SSEContext) ConnectionType() string {
+	return "SSE"
+}
+
+// Send queues the message on the session event stream
+func (c *SSEContext) Send(msg transports.Message) error {
+	return c.Session.enqueue(msg.Data)
+}
+
+// SSEHandler serves the namespaces for the clients which cannot use
+// websockets. A GET request opens a text/event-stream, whose first event
+// ("session") carries the session ID. The requests are POSTed to the same
+// path with the session ID on the X-Session-ID header (or the session query
+// parameter), and their replies and the notifications are sent as events on
+// the stream. The POST requests without session are replied synchronously,
+// as the HTTP transport does.
+//
+// The event IDs are <session>/<sequence>, so the browsers EventSource resume
+// the session when reconnecting (using the Last-Event-ID header).
+type SSEHandler struct {
+	Proxy          *Proxy
+	KeepAlive      time.Duration
+	StreamDuration time.Duration
+	SessionTimeout time.Duration
+	QueueSize      int
+
+	internalReceiver chan transports.Message
+	sessions         map[string]*SSESession
+	lc               *lifecycle
+	lock             sync.RWMutex
+}
+
+func (h *SSEHandler) Init(c *transports.Connection) error {
+	if h.KeepAlive == 0 {
+		h.KeepAlive = DefaultSSEKeepAlive
+	}
+	if h.StreamDuration == 0 {
+		h.StreamDuration = DefaultSSEStreamDuration
+	}
+	if h.SessionTimeout == 0 {
+		h.SessionTimeout = DefaultSSESessionTimeout
+	}
+	if h.QueueSize == 0 {
+		h.QueueSize = DefaultSSEQueueSize
+	}
+	h.internalReceiver = make(chan transports.Message, 1)
+	h.sessions = make(map[string]*SSESession)
+	h.lc = newLifecycle()
+	go h.reap()
+	return nil
+}
+
+func (h *SSEHandler) SetProxy(p *Proxy) {
+	h.Proxy = p
+}
+
+// AddProxyHandler adds the SSE handler of path into the Proxy
+func (h *SSEHandler) AddProxyHandler(path string) {
+	httpHandler := getHTTPhandler(path, h.internalReceiver, h.lc)
+	h.Proxy.AddHandler(path, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet:
+			h.stream(path, w, r)
+		case sessionID(r) != "":
+			h.post(path, w, r)
+		default:
+			httpHandler(w, r)
+		}
+	})
+	h.Proxy.AddQueryHandler(path, getQueryHandler(path, h.internalReceiver, h.lc))
+}
+
+// newSessionID returns a random session identifier
+func newSessionID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// sessionID returns the session of a request, from the header, the query or
+// the EventSource Last-Event-ID header.
+func sessionID(r *http.Request) string {
+	if id := r.Header.Get(SSESessionHeader); id != "" {
+		return id
+	}
+	if id := r.URL.Query().Get("session"); id != "" {
+		return id
+	}
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		return strings.SplitN(id, "/", 2)[0]
+	}
+	return ""
+}
+
+func (h *SSEHandler) session(id, namespace string) *SSESession {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if s, ok := h.sessions[id]; ok && s.Namespace == namespace {
+		return s
+	}
+	return nil
+}
+
+// newSession creates a session
+func (h *SSEHandler) newSession(namespace string) (*SSESession, error) {
+	id, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	s := &SSESession{
+		ID:        id,
+		Namespace: namespace,
+		queue:     make(chan []byte, h.QueueSize),
+		lastSeen:  time.Now(),
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.sessions[s.ID] = s
+	return s, nil
+}
+
+// reap removes the expired sessions every SessionTimeout, until the handler is closed
+func (h *SSEHandler) reap() {
+	ticker := time.NewTicker(h.SessionTimeout)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			h.expire()
+		case <-h.lc.done:
+			return
+		}
+	}
+}
+
+// expire removes the sessions without stream for longer than SessionTimeout
+func (h *SSEHandler) expire() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for sid, old := range h.sessions {
+		old.lock.Lock()
+		if !old.attached && time.Since(old.lastSeen) > h.SessionTimeout {
+			old.closed = true
+			delete(h.sessions, sid)
+			log.Debugf("sse session %s expired", sid)
+		}
+		old.lock.Unlock()
+	}
+}
+
+// stream writes the session events until the client disconnects or the
+// stream duration is reached
+func (h *SSEHandler) stream(path string, w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-h.lc.done:
+		unavailable(w)
+		return
+	default:
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	s := h.session(sessionID(r), path)
+	if s == nil {
+		var err error
+		if s, err = h.newSession(path); err != nil {
+			http.Error(w, "cannot create session", http.StatusInternalServerError)
+			return
+		}
+	}
+	s.lock.Lock()
+	if s.attached {
+		s.lock.Unlock()
+		http.Error(w, "session already has a stream", http.StatusConflict)
+		return
+	}
+	s.attached = true
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		s.attached = false
+		s.lastSeen = time.Now()
+		s.lock.Unlock()
+	}()
+
+	// The stream outlives the server write timeout
+	if err := http.NewResponseController(w).SetWriteDeadline(time.Now().Add(h.StreamDuration + h.KeepAlive)); err != nil {
+		log.Debugf("cannot extend sse write deadline: %v", err)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	if err := h.writeEvent(w, s, "session", []byte(s.ID)); err != nil {
+		return
+	}
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(h.KeepAlive)
+	defer keepAlive.Stop()
+	end := time.NewTimer(h.StreamDuration)
+	defer end.Stop()
+	for {
+		select {
+		case data := <-s.queue:
+			if err := h.writeEvent(w, s, "message", data); err != nil {
+				// The message is lost with the stream, but the session remains
+				log.Debugf("sse stream of session %s closed: %v", s.ID, err)
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		case <-end.C:
+			return
+		case <-h.lc.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// writeEvent writes an event, each line of data on its own data field
+func (h *SSEHandler) writeEvent(w http.ResponseWriter, s *SSESession, event string, data []byte) error {
+	s.lock.Lock()
+	s.seq++
+	seq := s.seq
+	s.lock.Unlock()
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "id: %s/%d\nevent: %s\n", s.ID, seq, event)
+	for _, line := range bytes.Split(bytes.TrimRight(data, "\n"), []byte("\n")) {
+		fmt.Fprintf(&buf, "data: %s\n", line)
+	}
+	buf.WriteByte('\n')
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// post queues a request of a session, its reply is sent on the event stream
+func (h *SSEHandler) post(path string, w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+	if !h.lc.begin() {
+		unavailable(w)
+		return
+	}
+	defer h.lc.end()
+	s := h.session(sessionID(r), path)
+	if s == nil {
+		http.Error(w, "session not found", http.StatusNotFound)
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		log.Warnf("HTTP connection closed: (%s)", err)
+		return
+	}
+	h.internalReceiver <- transports.Message{
+		Data:      body,
+		TimeStamp: int32(time.Now().Unix()),
+		Context:   &SSEContext{Session: s, Request: r},
+		Namespace: path,
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (h *SSEHandler) ConnectionType() string {
+	return "SSE"
+}
+
+func (h *SSEHandler) Listen(receiver chan<- transports.Message) {
+	go h.lc.forward(h.internalReceiver, receiver)
+}
+
+// Send replies to the message context. If the message has no context, it is
+// sent to all the sessions of the message namespace.
+func (h *SSEHandler) Send(msg transports.Message) error {
+	switch ctx := msg.Context.(type) {
+	case *SSEContext:
+		return ctx.Send(msg)
+	case *HttpContext:
+		return ctx.Send(msg)
+	case nil:
+		h.lock.RLock()
+		defer h.lock.RUnlock()
+		for _, s := range h.sessions {
+			if msg.Namespace != "" && s.Namespace != msg.Namespace {
+				continue
+			}
+			if err := s.enqueue(msg.Data); err != nil {
+				log.Debugf("cannot broadcast: %v", err)
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+	}
+}
+
+// SendUnicast sends the message to the session identified by address
+func (h *SSEHandler) SendUnicast(address string, msg transports.Message) error {
+	h.lock.RLock()
+	s, ok := h.sessions[address]
+	h.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no sse session %s", address)
+	}
+	return s.enqueue(msg.Data)
+}
+
+func (h *SSEHandler) SetBootnodes(bootnodes []string) {
+	// No bootnodes on sse handler
+}
+
+func (h *SSEHandler) AddPeer(peer string) error {
+	// No peers on sse handler
+	return nil
+}
+
+// AddNamespace adds a new namespace to the transport
+func (h *SSEHandler) AddNamespace(namespace string) error {
+	if len(namespace) == 0 || namespace[0] != '/' {
+		return fmt.Errorf("namespace on sse must start with /")
+	}
+	h.AddProxyHandler(namespace)
+	return nil
+}
+
+func (h *SSEHandler) Address() string {
+	return h.String()
+}
+
+// Close stops accepting requests, waits for the in-flight ones until ctx is
+// done and ends the event streams. The proxy is not closed, since it might
+// be shared.
+func (h *SSEHandler) Close(ctx context.Context) error {
+	err := h.lc.close(ctx)
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for id, s := range h.sessions {
+		s.lock.Lock()
+		s.closed = true
+		s.lock.Unlock()
+		delete(h.sessions, id)
+	}
+	return err
+}
+
+func (h *SSEHandler) String() string {
+	return h.Proxy.Addr.String()
+}
@@ -0,0 +1,93 @@
+package mhttp
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+)
+
+// TestSSEResume checks the messages queued while the stream is closed are
+// delivered when the client reconnects to the session.
+func TestSSEResume(t *testing.T) {
+	h := &SSEHandler{StreamDuration: 100 * time.Millisecond}
+	tr := newProxied(h)(t)
+	if err := tr.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	url := fmt.Sprintf("http://%s/main", tr.String())
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan []byte, 1)
+	session := make(chan string, 1)
+	go readEvents(bufio.NewReader(resp.Body), events, session)
+	id := <-session
+	// The server closes the stream after StreamDuration
+	if _, ok := <-events; ok {
+		t.Fatal("unexpected event")
+	}
+	resp.Body.Close()
+
+	if err := tr.SendUnicast(id, transports.Message{Data: []byte(`{"event":"queued"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", id+"/1")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events = make(chan []byte, 1)
+	go readEvents(bufio.NewReader(resp.Body), events, session)
+	if got := <-session; got != id {
+		t.Fatalf("resumed session %s, want %s", got, id)
+	}
+	select {
+	case data := <-events:
+		if string(data) != `{"event":"queued"}` {
+			t.Fatalf("got event %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queued message not delivered")
+	}
+}
+
+// TestSSEExpire checks the sessions without stream are removed after the
+// session timeout, even if no other session is opened.
+func TestSSEExpire(t *testing.T) {
+	h := &SSEHandler{StreamDuration: 50 * time.Millisecond, SessionTimeout: 50 * time.Millisecond}
+	tr := newProxied(h)(t)
+	if err := tr.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(fmt.Sprintf("http://%s/main", tr.String()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	events := make(chan []byte, 1)
+	session := make(chan string, 1)
+	go readEvents(bufio.NewReader(resp.Body), events, session)
+	id := <-session
+	// The server closes the stream after StreamDuration
+	if _, ok := <-events; ok {
+		t.Fatal("unexpected event")
+	}
+	resp.Body.Close()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.session(id, "/main") != nil {
+		if time.Now().After(deadline) {
+			t.Fatal("expired session not removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -20,22 +22,62 @@ type WebsocketHandle struct {
 	Connection *transports.Connection // the ws connection
 	WsProxy    *Proxy                 // proxy where the ws will be associated
 	ReadLimit  int64
+	Keepalive  WsKeepalive
+	// Subprotocols are the negotiated subprotocols, DefaultWsSubprotocols if nil
+	Subprotocols []string
 
 	internalReceiver chan transports.Message
+	lc               *lifecycle
+	ws               *wsServer
 }
 
 type WebsocketContext struct {
 	Conn *websocket.Conn
+	// Request is the upgrade request of the connection
+	Request *http.Request
+	// ConnID identifies the connection on the handler registry
+	ConnID string
+	// Subprotocol is the negotiated subprotocol, empty if none
+	Subprotocol string
+
+	codec   WsCodec
+	msgType websocket.MessageType
+	wc      *WsConn
 }
 
 func (c WebsocketContext) ConnectionType() string {
 	return "Websocket"
 }
 
+// ClientIdentity returns the identity of the verified TLS client certificate, if any
+func (c *WebsocketContext) ClientIdentity() *transports.ClientIdentity {
+	return requestIdentity(c.Request)
+}
+
+// ConnSession returns the session of the connection, nil if the context is
+// not bound to a registered connection
+func (c *WebsocketContext) ConnSession() *transports.Session {
+	if c.wc == nil {
+		return nil
+	}
+	return c.wc.ConnSession()
+}
+
+// Codec returns the codec of the negotiated subprotocol, nil if none
+func (c *WebsocketContext) Codec() WsCodec {
+	return c.codec
+}
+
+// Send replies with the frame type of the subprotocol. Without subprotocol,
+// the reply has the frame type of the request.
 func (c *WebsocketContext) Send(msg transports.Message) error {
+	typ, frame, err := wsFrame(c.codec, c.msgType, msg.Data)
+	if err != nil {
+		return err
+	}
 	tctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
 	defer cancel()
-	return c.Conn.Write(tctx, websocket.MessageBinary, msg.Data)
+	return c.Conn.Write(tctx, typ, frame)
 }
 
 // SetProxy sets the proxy for the ws
@@ -55,35 +97,104 @@ func (w *WebsocketHandle) Init(c *transports.Connection) error {
 		w.ReadLimit = 32768 // default by ws client
 	}
 
+	w.Keepalive.setDefaults()
 	w.internalReceiver = make(chan transports.Message, 1)
+	w.lc = newLifecycle()
+	if w.Subprotocols == nil {
+		w.Subprotocols = DefaultWsSubprotocols
+	}
+	w.ws = &wsServer{receiver: w.internalReceiver, lc: w.lc, keepalive: w.Keepalive}
 	return nil
 }
 
-func getWsHandler(path string, receiver chan transports.Message) func(conn *websocket.Conn) {
-	return func(conn *websocket.Conn) {
+// wsServer holds the state shared by the websocket connections of a handler
+type wsServer struct {
+	receiver  chan transports.Message
+	lc        *lifecycle
+	keepalive WsKeepalive
+	stats     WsStats
+	conns     map[string]*WsConn
+	lastID    uint64
+	lock      sync.RWMutex
+}
+
+func (s *wsServer) handler(path string) ProxyWsRequestHandler {
+	return func(conn *websocket.Conn, r *http.Request) {
+		if !s.lc.addWs(conn) {
+			conn.Close(websocket.StatusGoingAway, "server is shutting down")
+			return
+		}
+		defer s.lc.removeWs(conn)
+		wc := s.register(path, conn, r)
+		defer s.unregister(wc.ID)
+		codec := wsCodec(conn.Subprotocol())
+		atomic.AddInt64(&s.stats.open, 1)
+		defer atomic.AddInt64(&s.stats.open, -1)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		lastRead := time.Now().UnixNano()
+		go s.watch(ctx, conn, &lastRead)
 		// Read websocket messages until the connection is closed. HTTP
 		// handlers are run in new goroutines, so we don't need to spawn
 		// another goroutine.
 		for {
-			_, payload, err := conn.Read(context.TODO())
+			msgType, payload, err := conn.Read(ctx)
 			if err != nil {
-				conn.Close(websocket.StatusAbnormalClosure, "ws closed by client")
+				// If the client or the keepalive closed the connection,
+				// the close handshake is already done and this is a no-op
+				conn.Close(websocket.StatusNormalClosure, "")
 				break
 			}
+			atomic.StoreInt64(&lastRead, time.Now().UnixNano())
+			if codec != nil {
+				if payload, err = codec.Decode(payload); err != nil {
+					log.Debugf("cannot decode %s message: %v", conn.Subprotocol(), err)
+					conn.Close(websocket.StatusInvalidFramePayloadData, "cannot decode message")
+					break
+				}
+			}
 			msg := transports.Message{
 				Data:      payload,
 				TimeStamp: int32(time.Now().Unix()),
-				Context:   &WebsocketContext{Conn: conn},
+				Context: &WebsocketContext{
+					Conn:        conn,
+					Request:     r,
+					ConnID:      wc.ID,
+					Subprotocol: conn.Subprotocol(),
+					codec:       codec,
+					msgType:     msgType,
+					wc:          wc,
+				},
 				Namespace: path,
 			}
-			receiver <- msg
+			select {
+			case s.receiver <- msg:
+			case <-s.lc.done:
+				// The connection is closed by the handler shutdown
+				return
+			}
 		}
 	}
 }
 
 // AddProxyHandler adds the current websocket handler into the Proxy
 func (w *WebsocketHandle) AddProxyHandler(path string) {
-	w.WsProxy.AddWsHandler(path, getWsHandler(path, w.internalReceiver), w.ReadLimit)
+	w.WsProxy.AddWsRequestHandler(path, w.ws.handler(path), w.ReadLimit, w.Subprotocols...)
+}
+
+// WsStats returns the counters of the websocket connections
+func (w *WebsocketHandle) WsStats() *WsStats {
+	return &w.ws.stats
+}
+
+// WsConnection returns the live connection identified by id
+func (w *WebsocketHandle) WsConnection(id string) (*WsConn, bool) {
+	return w.ws.connection(id)
+}
+
+// WsConnections returns the live connections of namespace, all of them if it is empty
+func (w *WebsocketHandle) WsConnections(namespace string) []*WsConn {
+	return w.ws.connections(namespace)
 }
 
 // ConnectionType returns a string identifying the transport connection type
@@ -93,12 +204,7 @@ func (w *WebsocketHandle) ConnectionType() string {
 
 // Listen will listen the websockets handler and write the received data into the channel
 func (w *WebsocketHandle) Listen(receiver chan<- transports.Message) {
-	go func() {
-		for {
-			msg := <-w.internalReceiver
-			receiver <- msg
-		}
-	}()
+	go w.lc.forward(w.internalReceiver, receiver)
 }
 
 // Listen will listen the websockets handler and write the received data into the channel
@@ -110,15 +216,23 @@ func (w *WebsocketHandle) AddNamespace(namespace string) error {
 	return nil
 }
 
-// Send sends the response given a message
+// Send replies to the connection of the message context. If the message has
+// no context, it is broadcast to all the connections of its namespace.
 func (w *WebsocketHandle) Send(msg transports.Message) error {
-	// TODO(mvdan): this extra abstraction layer is probably useless
-	return msg.Context.(*WebsocketContext).Send(msg)
+	switch ctx := msg.Context.(type) {
+	case *WebsocketContext:
+		return ctx.Send(msg)
+	case nil:
+		w.ws.broadcast(msg)
+		return nil
+	default:
+		return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+	}
 }
 
+// SendUnicast sends the message to the connection identified by address
 func (w *WebsocketHandle) SendUnicast(address string, msg transports.Message) error {
-	// WebSocket is not p2p so sendUnicast makes the same of Send()
-	return w.Send(msg)
+	return w.ws.sendTo(address, msg)
 }
 
 func (w *WebsocketHandle) SetBootnodes(bootnodes []string) {
@@ -130,22 +244,50 @@ func (w *WebsocketHandle) AddPeer(peer string) error {
 	return nil
 }
 
+// Address returns the listening address of the proxy, as the other mhttp
+// handlers do. The Connection given to Init is not kept, so its address
+// cannot be used.
 func (w *WebsocketHandle) Address() string {
-	return w.Connection.Address
+	return w.String()
+}
+
+// Close stops accepting connections and closes the open websockets with the
+// going away code. The proxy is not closed, since it might be shared.
+func (w *WebsocketHandle) Close(ctx context.Context) error {
+	return w.lc.close(ctx)
 }
 
 func (w *WebsocketHandle) String() string {
 	return w.WsProxy.Addr.String()
 }
 
-func wshandler(w http.ResponseWriter, r *http.Request, ph ProxyWsHandler, readLimit int64) {
-	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: []string{"*"}})
+func wshandler(w http.ResponseWriter, r *http.Request, ph ProxyWsRequestHandler, readLimit int64, subprotocols, origins []string) {
+	conn, err := websocket.Accept(w, r, &websocket.AcceptOptions{
+		OriginPatterns: origins,
+		Subprotocols:   subprotocols,
+	})
 	if err != nil {
 		log.Errorf("failed to set websocket upgrade: %s", err)
 		return
 	}
 	conn.SetReadLimit(readLimit)
-	ph(conn)
+	ph(conn, r)
+}
+
+// wsOriginPatterns returns the websocket origin patterns of the CORS allowed
+// origins, matched against the origin host. Any origin is allowed if empty.
+func wsOriginPatterns(allowed []string) []string {
+	if len(allowed) == 0 {
+		return []string{"*"}
+	}
+	patterns := make([]string, 0, len(allowed))
+	for _, origin := range allowed {
+		if i := strings.Index(origin, "://"); i >= 0 {
+			origin = origin[i+3:]
+		}
+		patterns = append(patterns, origin)
+	}
+	return patterns
 }
 
 func somaxconn() int {
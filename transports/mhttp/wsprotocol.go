@@ -0,0 +1,134 @@
+package mhttp
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+
+	"github.com/ugorji/go/codec"
+	"nhooyr.io/websocket"
+)
+
+const (
+	// WsProtocolJSON is the websocket subprotocol of the JSON messages, sent on text frames
+	WsProtocolJSON = "multirpc.json"
+	// WsProtocolCBOR is the websocket subprotocol of the CBOR messages, sent on binary frames
+	WsProtocolCBOR = "multirpc.cbor"
+)
+
+// DefaultWsSubprotocols are the subprotocols negotiated by the websocket handlers, by order of preference
+var DefaultWsSubprotocols = []string{WsProtocolJSON, WsProtocolCBOR}
+
+// WsCodec translates the messages of a websocket subprotocol from and to the
+// JSON messages handled by the router
+type WsCodec interface {
+	// MessageType is the type of the frames written
+	MessageType() websocket.MessageType
+	// Decode returns the JSON message of a received frame
+	Decode(frame []byte) ([]byte, error)
+	// Encode returns the frame of a JSON message
+	Encode(msg []byte) ([]byte, error)
+}
+
+var (
+	wsCodecs = map[string]WsCodec{
+		WsProtocolJSON: jsonCodec{},
+		WsProtocolCBOR: newCborCodec(),
+	}
+	wsCodecsLock sync.RWMutex
+)
+
+// RegisterWsCodec adds the codec of a websocket subprotocol. The subprotocol
+// must also be added to the Subprotocols of the handler to be negotiated.
+func RegisterWsCodec(subprotocol string, c WsCodec) {
+	wsCodecsLock.Lock()
+	defer wsCodecsLock.Unlock()
+	wsCodecs[subprotocol] = c
+}
+
+// wsCodec returns the codec of subprotocol, nil if it is not known
+func wsCodec(subprotocol string) WsCodec {
+	wsCodecsLock.RLock()
+	defer wsCodecsLock.RUnlock()
+	return wsCodecs[subprotocol]
+}
+
+// wsFrame returns the frame of a message. Without codec (no subprotocol
+// negotiated) the message is sent as is on a frame of type legacy, binary if 0.
+func wsFrame(c WsCodec, legacy websocket.MessageType, msg []byte) (websocket.MessageType, []byte, error) {
+	if c == nil {
+		if legacy == 0 {
+			legacy = websocket.MessageBinary
+		}
+		return legacy, msg, nil
+	}
+	frame, err := c.Encode(msg)
+	if err != nil {
+		return 0, nil, fmt.Errorf("cannot encode websocket message: %w", err)
+	}
+	return c.MessageType(), frame, nil
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) MessageType() websocket.MessageType  { return websocket.MessageText }
+func (jsonCodec) Decode(frame []byte) ([]byte, error) { return frame, nil }
+func (jsonCodec) Encode(msg []byte) ([]byte, error)   { return msg, nil }
+
+// cborCodec transcodes the CBOR messages to JSON. The byte strings are
+// encoded in JSON as base64 strings.
+type cborCodec struct {
+	handle *codec.CborHandle
+}
+
+func newCborCodec() cborCodec {
+	h := new(codec.CborHandle)
+	h.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	h.Canonical = true
+	return cborCodec{handle: h}
+}
+
+func (cborCodec) MessageType() websocket.MessageType { return websocket.MessageBinary }
+
+func (c cborCodec) Decode(frame []byte) ([]byte, error) {
+	var v interface{}
+	if err := codec.NewDecoderBytes(frame, c.handle).Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+func (c cborCodec) Encode(msg []byte) ([]byte, error) {
+	d := json.NewDecoder(bytes.NewReader(msg))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	var frame []byte
+	err := codec.NewEncoderBytes(&frame, c.handle).Encode(jsonNumbers(v))
+	return frame, err
+}
+
+// jsonNumbers replaces the JSON numbers by integers when possible, floats otherwise
+func jsonNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for k, e := range v {
+			v[k] = jsonNumbers(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = jsonNumbers(e)
+		}
+	}
+	return v
+}
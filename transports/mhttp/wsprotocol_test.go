@@ -0,0 +1,124 @@
+package mhttp
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ugorji/go/codec"
+	"github.com/vocdoni/multirpc/transports"
+	"nhooyr.io/websocket"
+)
+
+func TestWsSubprotocols(t *testing.T) {
+	tr := newProxied(&WebsocketHandle{})(t)
+	if err := tr.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message, 16)
+	tr.Listen(receiver)
+
+	dial := func(t *testing.T, subprotocols ...string) *websocket.Conn {
+		conn, _, err := websocket.Dial(context.Background(), fmt.Sprintf("ws://%s/main", tr.String()),
+			&websocket.DialOptions{Subprotocols: subprotocols})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close(websocket.StatusNormalClosure, "") })
+		return conn
+	}
+	// roundTrip sends a frame, checks the message received by the transport
+	// and replies with reply, returning the reply frame
+	roundTrip := func(t *testing.T, conn *websocket.Conn, typ websocket.MessageType, frame []byte,
+		want, reply string) (websocket.MessageType, []byte) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Write(ctx, typ, frame); err != nil {
+			t.Fatal(err)
+		}
+		var msg transports.Message
+		select {
+		case msg = <-receiver:
+		case <-ctx.Done():
+			t.Fatal("message not received")
+		}
+		if string(msg.Data) != want {
+			t.Fatalf("got message %s, want %s", msg.Data, want)
+		}
+		wsCtx := msg.Context.(*WebsocketContext)
+		if wsCtx.Subprotocol != conn.Subprotocol() {
+			t.Fatalf("context subprotocol %q, want %q", wsCtx.Subprotocol, conn.Subprotocol())
+		}
+		if err := tr.Send(transports.Message{Data: []byte(reply), Context: wsCtx}); err != nil {
+			t.Fatal(err)
+		}
+		rtyp, data, err := conn.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rtyp, data
+	}
+
+	t.Run("JSON", func(t *testing.T) {
+		conn := dial(t, "unknown", WsProtocolJSON)
+		if conn.Subprotocol() != WsProtocolJSON {
+			t.Fatalf("negotiated %q", conn.Subprotocol())
+		}
+		// The binary frames are accepted too, but the replies are text
+		typ, data := roundTrip(t, conn, websocket.MessageBinary, []byte(`{"a":1}`), `{"a":1}`, `{"b":2}`)
+		if typ != websocket.MessageText || string(data) != `{"b":2}` {
+			t.Fatalf("got %v %s", typ, data)
+		}
+	})
+
+	t.Run("CBOR", func(t *testing.T) {
+		conn := dial(t, WsProtocolCBOR)
+		if conn.Subprotocol() != WsProtocolCBOR {
+			t.Fatalf("negotiated %q", conn.Subprotocol())
+		}
+		h := new(codec.CborHandle)
+		var frame []byte
+		if err := codec.NewEncoderBytes(&frame, h).Encode(map[string]interface{}{"id": "1", "n": 7}); err != nil {
+			t.Fatal(err)
+		}
+		typ, data := roundTrip(t, conn, websocket.MessageBinary, frame, `{"id":"1","n":7}`, `{"id":"1","big":9007199254740993}`)
+		if typ != websocket.MessageBinary {
+			t.Fatalf("got reply of type %v", typ)
+		}
+		var reply map[string]interface{}
+		if err := codec.NewDecoderBytes(data, h).Decode(&reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply["id"] != "1" || fmt.Sprint(reply["big"]) != "9007199254740993" {
+			t.Fatalf("got reply %v", reply)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := conn.Write(ctx, websocket.MessageBinary, []byte{0xff}); err != nil {
+			t.Fatal(err)
+		}
+		_, _, err := conn.Read(ctx)
+		if status := websocket.CloseStatus(err); status != websocket.StatusInvalidFramePayloadData {
+			t.Fatalf("closed with %v, want invalid payload", err)
+		}
+	})
+
+	t.Run("None", func(t *testing.T) {
+		conn := dial(t)
+		if conn.Subprotocol() != "" {
+			t.Fatalf("negotiated %q", conn.Subprotocol())
+		}
+		// Without subprotocol the reply has the frame type of the request
+		typ, _ := roundTrip(t, conn, websocket.MessageText, []byte(`{}`), `{}`, `{}`)
+		if typ != websocket.MessageText {
+			t.Fatalf("got reply of type %v", typ)
+		}
+		typ, _ = roundTrip(t, conn, websocket.MessageBinary, []byte(`{}`), `{}`, `{}`)
+		if typ != websocket.MessageBinary {
+			t.Fatalf("got reply of type %v", typ)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package mhttp
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/log"
+	"nhooyr.io/websocket"
+)
+
+// DefaultWsBroadcastTimeout is the default time a broadcast waits for each connection
+const DefaultWsBroadcastTimeout = 10 * time.Second
+
+// WsConn is a live websocket connection of a handler. The connections are
+// identified by ID, used as the address of SendUnicast.
+type WsConn struct {
+	ID          string
+	Namespace   string
+	Conn        *websocket.Conn
+	Request     *http.Request
+	ConnectedAt time.Time
+	// Subprotocol is the negotiated subprotocol, empty if none
+	Subprotocol string
+
+	session  *transports.Session
+	metadata map[string]interface{}
+	lock     sync.RWMutex
+}
+
+// ConnSession returns the session of the connection, used by the router to
+// authenticate its messages
+func (c *WsConn) ConnSession() *transports.Session {
+	return c.session
+}
+
+// SetMetadata attaches a value to the connection
+func (c *WsConn) SetMetadata(key string, value interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.metadata == nil {
+		c.metadata = make(map[string]interface{})
+	}
+	c.metadata[key] = value
+}
+
+// Metadata returns the value attached to the connection for key
+func (c *WsConn) Metadata(key string) (interface{}, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	value, ok := c.metadata[key]
+	return value, ok
+}
+
+// Send writes the message on the connection, encoded by the subprotocol codec
+func (c *WsConn) Send(ctx context.Context, msg transports.Message) error {
+	typ, frame, err := wsFrame(wsCodec(c.Subprotocol), 0, msg.Data)
+	if err != nil {
+		return err
+	}
+	return c.Conn.Write(ctx, typ, frame)
+}
+
+// register adds a new connection to the registry
+func (s *wsServer) register(namespace string, conn *websocket.Conn, r *http.Request) *WsConn {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.conns == nil {
+		s.conns = make(map[string]*WsConn)
+	}
+	s.lastID++
+	wc := &WsConn{
+		ID:          fmt.Sprintf("ws-%d", s.lastID),
+		Namespace:   namespace,
+		Conn:        conn,
+		Request:     r,
+		ConnectedAt: time.Now(),
+		Subprotocol: conn.Subprotocol(),
+		session:     transports.NewSession(),
+	}
+	s.conns[wc.ID] = wc
+	return wc
+}
+
+func (s *wsServer) unregister(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, id)
+}
+
+// connection returns the live connection identified by id
+func (s *wsServer) connection(id string) (*WsConn, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	wc, ok := s.conns[id]
+	return wc, ok
+}
+
+// connections returns the live connections of namespace, all of them if it is empty
+func (s *wsServer) connections(namespace string) []*WsConn {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	conns := make([]*WsConn, 0, len(s.conns))
+	for _, wc := range s.conns {
+		if namespace == "" || wc.Namespace == namespace {
+			conns = append(conns, wc)
+		}
+	}
+	return conns
+}
+
+// sendTo sends the message to the connection identified by id
+func (s *wsServer) sendTo(id string, msg transports.Message) error {
+	wc, ok := s.connection(id)
+	if !ok {
+		return fmt.Errorf("no websocket connection with id %s", id)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Minute)
+	defer cancel()
+	return wc.Send(ctx, msg)
+}
+
+// broadcast sends the message to all the connections of the message
+// namespace (all of them if it is empty). The connections failing to receive
+// it are skipped.
+func (s *wsServer) broadcast(msg transports.Message) {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultWsBroadcastTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, wc := range s.connections(msg.Namespace) {
+		wg.Add(1)
+		go func(wc *WsConn) {
+			defer wg.Done()
+			if err := wc.Send(ctx, msg); err != nil {
+				log.Debugf("cannot send message to websocket %s: %v", wc.ID, err)
+			}
+		}(wc)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,192 @@
+package mhttp
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/transporttest"
+)
+
+func TestWsRegistry(t *testing.T) {
+	h := &WebsocketHandle{}
+	tr := newProxied(h)(t)
+	for _, ns := range []string{"/a", "/b"} {
+		if err := tr.AddNamespace(ns); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receiver := make(chan transports.Message, 16)
+	tr.Listen(receiver)
+
+	// Each client sends a message, so its connection ID is known from the context
+	connect := func(namespace string) (*wsConn, string) {
+		c := dialWebsocket(t, tr, namespace).(*wsConn)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.Write(ctx, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-receiver:
+			return c, msg.Context.(*WebsocketContext).ConnID
+		case <-ctx.Done():
+			t.Fatal("message not received")
+		}
+		return nil, ""
+	}
+	a1, id1 := connect("/a")
+	a2, id2 := connect("/a")
+	b, idb := connect("/b")
+	if id1 == id2 || id1 == idb {
+		t.Fatalf("connection IDs are not unique: %s %s %s", id1, id2, idb)
+	}
+	if n := len(h.WsConnections("/a")); n != 2 {
+		t.Fatalf("%d connections on /a, want 2", n)
+	}
+	if n := len(h.WsConnections("")); n != 3 {
+		t.Fatalf("%d connections, want 3", n)
+	}
+
+	wc, ok := h.WsConnection(id1)
+	if !ok {
+		t.Fatalf("connection %s not found", id1)
+	}
+	wc.SetMetadata("user", "alice")
+	if v, ok := wc.Metadata("user"); !ok || v != "alice" {
+		t.Fatalf("got metadata %v", v)
+	}
+
+	expect := func(c *wsConn, want string) {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("got %q, want %q", data, want)
+		}
+	}
+	if err := tr.SendUnicast(id2, transports.Message{Data: []byte("unicast")}); err != nil {
+		t.Fatal(err)
+	}
+	expect(a2, "unicast")
+	if err := tr.SendUnicast("ws-unknown", transports.Message{Data: []byte("lost")}); err == nil {
+		t.Fatal("sending to an unknown connection did not fail")
+	}
+
+	if err := tr.Send(transports.Message{Data: []byte("to /a"), Namespace: "/a"}); err != nil {
+		t.Fatal(err)
+	}
+	expect(a1, "to /a")
+	expect(a2, "to /a")
+	if err := tr.Send(transports.Message{Data: []byte("to all")}); err != nil {
+		t.Fatal(err)
+	}
+	// The /a broadcast was not received on /b
+	expect(b, "to all")
+	expect(a1, "to all")
+
+	b.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := h.WsConnection(idb); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("closed connection still registered")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestHttpWsSend(t *testing.T) {
+	tr := newProxied(new(HttpWsHandler))(t)
+	if err := tr.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message, 16)
+	tr.Listen(receiver)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The replies to the websocket requests of the mixed handler are sent on
+	// their connection, as the HTTP replies are
+	for name, dial := range map[string]func(*testing.T, transports.Transport, string) transporttest.Conn{
+		"HTTP":      dialHTTP,
+		"Websocket": dialWebsocket,
+	} {
+		t.Run(name, func(t *testing.T) {
+			c := dial(t, tr, "/main")
+			defer c.Close()
+			if err := c.Write(ctx, []byte("{}")); err != nil {
+				t.Fatal(err)
+			}
+			var msg transports.Message
+			select {
+			case msg = <-receiver:
+			case <-ctx.Done():
+				t.Fatal("message not received")
+			}
+			msg.Data = []byte(`{"reply":"` + name + `"}`)
+			if err := tr.Send(msg); err != nil {
+				t.Fatal(err)
+			}
+			data, err := c.Read(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(string(data)); got != string(msg.Data) {
+				t.Fatalf("got %q, want %q", got, msg.Data)
+			}
+		})
+	}
+
+	if err := tr.Send(transports.Message{Data: []byte("{}"), Context: new(SSEContext)}); err == nil {
+		t.Fatal("sending with a foreign context did not fail")
+	}
+}
+
+// TestWsSession checks the messages of a connection share its session
+func TestWsSession(t *testing.T) {
+	tr := newProxied(&WebsocketHandle{})(t)
+	if err := tr.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message, 16)
+	tr.Listen(receiver)
+
+	session := func(c transporttest.Conn) *transports.Session {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := c.Write(ctx, []byte("{}")); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case msg := <-receiver:
+			sc, ok := msg.Context.(transports.SessionContext)
+			if !ok || sc.ConnSession() == nil {
+				t.Fatal("message without session")
+			}
+			return sc.ConnSession()
+		case <-ctx.Done():
+			t.Fatal("message not received")
+		}
+		return nil
+	}
+	c := dialWebsocket(t, tr, "/main")
+	s := session(c)
+	s.Set("key", "value")
+	if session(c) != s {
+		t.Fatal("messages of the same connection with different sessions")
+	}
+	other := session(dialWebsocket(t, tr, "/main"))
+	if _, ok := other.Get("key"); ok || other == s {
+		t.Fatal("session shared by different connections")
+	}
+}
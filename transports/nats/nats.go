@@ -0,0 +1,293 @@
+// Package nats provides a transport serving the router over NATS subjects
+package nats
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/vocdoni/multirpc/transports"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// DefaultSubjectPrefix is the default prefix of the subjects the namespaces are mapped to
+	DefaultSubjectPrefix = "multirpc"
+	// DefaultQueueGroup is the default queue group, the routers on the same
+	// group share the requests of a subject
+	DefaultQueueGroup = "multirpc"
+	// EventsSuffix is appended to the namespace subject for the messages sent without context
+	EventsSuffix = "events"
+)
+
+// NATSContext is the MessageContext of the messages received from NATS.
+// The reply is published on the inbox of the request.
+type NATSContext struct {
+	Conn    *nats.Conn
+	Subject string
+	Reply   string
+
+	release func()
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (c *NATSContext) ConnectionType() string {
+	return "NATS"
+}
+
+// Send publishes the message on the reply inbox of the request
+func (c *NATSContext) Send(msg transports.Message) error {
+	if c.Reply == "" {
+		return fmt.Errorf("nats message on %s has no reply subject", c.Subject)
+	}
+	if c.release != nil {
+		defer c.release()
+	}
+	return c.Conn.Publish(c.Reply, msg.Data)
+}
+
+// NATSHandle serves the router over NATS. Each namespace is mapped to a
+// subject (see Subject) which is subscribed as part of QueueGroup, so several
+// routers on the same group load-balance the requests without any proxy.
+//
+// The NATS server URL is taken from the Connection Address, and the subjects
+// prefix from the Connection Topic if SubjectPrefix is not set.
+type NATSHandle struct {
+	Conn          *transports.Connection
+	NC            *nats.Conn
+	SubjectPrefix string
+	QueueGroup    string
+	Options       []nats.Option
+
+	subscriptions    map[string]*nats.Subscription
+	internalReceiver chan transports.Message
+	closed           chan struct{}
+	closeOnce        sync.Once
+	draining         bool
+	inflight         sync.WaitGroup
+	lock             sync.RWMutex
+}
+
+// Init connects to the NATS server
+func (n *NATSHandle) Init(c *transports.Connection) error {
+	if c == nil {
+		c = new(transports.Connection)
+	}
+	url := c.Address
+	if url == "" {
+		url = nats.DefaultURL
+	}
+	if n.SubjectPrefix == "" {
+		n.SubjectPrefix = c.Topic
+	}
+	if n.SubjectPrefix == "" {
+		n.SubjectPrefix = DefaultSubjectPrefix
+	}
+	if n.QueueGroup == "" {
+		n.QueueGroup = DefaultQueueGroup
+	}
+	nc, err := nats.Connect(url, n.Options...)
+	if err != nil {
+		return fmt.Errorf("cannot connect to nats %s: %w", url, err)
+	}
+	n.Conn = c
+	n.NC = nc
+	n.subscriptions = make(map[string]*nats.Subscription)
+	n.internalReceiver = make(chan transports.Message, 1)
+	n.closed = make(chan struct{})
+	log.Infof("nats transport connected to %s (queue group %s)", nc.ConnectedUrl(), n.QueueGroup)
+	return nil
+}
+
+// Subject returns the NATS subject the namespace is mapped to. The namespace
+// path elements become subject tokens, so /api/v1 is served on
+// <prefix>.api.v1
+func (n *NATSHandle) Subject(namespace string) string {
+	ns := strings.Trim(namespace, "/")
+	if ns == "" {
+		return n.SubjectPrefix
+	}
+	return n.SubjectPrefix + "." + strings.ReplaceAll(ns, "/", ".")
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (n *NATSHandle) ConnectionType() string {
+	return "NATS"
+}
+
+// Listen writes the received requests into the receiver channel
+func (n *NATSHandle) Listen(receiver chan<- transports.Message) {
+	go func() {
+		for {
+			select {
+			case msg := <-n.internalReceiver:
+				select {
+				case receiver <- msg:
+				case <-n.closed:
+					return
+				}
+			case <-n.closed:
+				return
+			}
+		}
+	}()
+}
+
+// Send replies to the request of the message context. If the message has no
+// context, it is published on the events subject of its namespace.
+func (n *NATSHandle) Send(msg transports.Message) error {
+	if msg.Context != nil {
+		nctx, ok := msg.Context.(*NATSContext)
+		if !ok {
+			return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+		}
+		return nctx.Send(msg)
+	}
+	return n.NC.Publish(n.Subject(msg.Namespace)+"."+EventsSuffix, msg.Data)
+}
+
+// SendUnicast publishes the message on the address subject, usually a client inbox
+func (n *NATSHandle) SendUnicast(address string, msg transports.Message) error {
+	return n.NC.Publish(address, msg.Data)
+}
+
+// AddNamespace subscribes the namespace subject on the queue group
+func (n *NATSHandle) AddNamespace(namespace string) error {
+	if strings.ContainsAny(namespace, " \t\r\n*>.") {
+		return fmt.Errorf("namespace %q cannot be mapped to a nats subject", namespace)
+	}
+	subject := n.Subject(namespace)
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if _, ok := n.subscriptions[namespace]; ok {
+		return nil
+	}
+	sub, err := n.NC.QueueSubscribe(subject, n.QueueGroup, func(m *nats.Msg) {
+		if m.Reply == "" {
+			log.Debugf("dropping nats message on %s without reply subject", m.Subject)
+			return
+		}
+		n.lock.RLock()
+		if n.draining {
+			// Close stopped waiting for the in-flight requests
+			n.lock.RUnlock()
+			return
+		}
+		n.inflight.Add(1)
+		n.lock.RUnlock()
+		var once sync.Once
+		release := func() { once.Do(n.inflight.Done) }
+		select {
+		case n.internalReceiver <- transports.Message{
+			Data:      m.Data,
+			TimeStamp: int32(time.Now().Unix()),
+			Namespace: namespace,
+			Context:   &NATSContext{Conn: n.NC, Subject: m.Subject, Reply: m.Reply, release: release},
+		}:
+		case <-n.closed:
+			release()
+		}
+	})
+	if err != nil {
+		return err
+	}
+	n.subscriptions[namespace] = sub
+	log.Infof("nats transport serving namespace %s on subject %s", namespace, subject)
+	return nil
+}
+
+// Address returns the URL of the connected NATS server
+func (n *NATSHandle) Address() string {
+	return n.NC.ConnectedUrl()
+}
+
+func (n *NATSHandle) SetBootnodes(bootnodes []string) {
+	// No bootnodes on nats handler
+}
+
+func (n *NATSHandle) AddPeer(peer string) error {
+	// No peers on nats handler
+	return nil
+}
+
+// Close drains the subscriptions, so the requests already received are
+// handled, waits for their replies and closes the NATS connection once the
+// replies are flushed. It gives up when ctx is done.
+func (n *NATSHandle) Close(ctx context.Context) error {
+	var err error
+	n.closeOnce.Do(func() {
+		defer close(n.closed)
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		// wait polls until cond is true or ctx is done
+		wait := func(cond func() bool) bool {
+			for !cond() {
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					err = ctx.Err()
+					return false
+				}
+			}
+			return true
+		}
+
+		n.lock.RLock()
+		subs := make([]*nats.Subscription, 0, len(n.subscriptions))
+		for _, sub := range n.subscriptions {
+			subs = append(subs, sub)
+		}
+		n.lock.RUnlock()
+		for _, sub := range subs {
+			if derr := sub.Drain(); derr != nil {
+				log.Debugf("cannot drain nats subscription %s: %v", sub.Subject, derr)
+			}
+		}
+		drained := wait(func() bool {
+			for _, sub := range subs {
+				if sub.IsValid() {
+					return false
+				}
+			}
+			return true
+		})
+
+		n.lock.Lock()
+		n.draining = true
+		n.lock.Unlock()
+		replied := make(chan struct{})
+		go func() {
+			n.inflight.Wait()
+			close(replied)
+		}()
+		if drained {
+			select {
+			case <-replied:
+			case <-ctx.Done():
+				err = ctx.Err()
+			}
+		}
+
+		// Draining the connection flushes the replies before closing it
+		if derr := n.NC.Drain(); derr != nil {
+			n.NC.Close()
+			if err == nil {
+				err = derr
+			}
+			return
+		}
+		if !wait(n.NC.IsClosed) {
+			n.NC.Close()
+		}
+	})
+	return err
+}
+
+func (n *NATSHandle) String() string {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+	return fmt.Sprintf("%s queue:%s subjects:%d", n.NC.ConnectedUrl(), n.QueueGroup, len(n.subscriptions))
+}
@@ -0,0 +1,191 @@
+package nats
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/vocdoni/multirpc/client"
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/transporttest"
+)
+
+// runServer starts an embedded NATS server on a random port
+func runServer(t *testing.T) string {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1", Port: -1, NoLog: true, NoSigs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("nats server not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns.ClientURL()
+}
+
+type conformanceConn struct {
+	nc      *nats.Conn
+	subject string
+	inbox   string
+	msgs    chan *nats.Msg
+}
+
+func (c *conformanceConn) Write(ctx context.Context, data []byte) error {
+	return c.nc.PublishRequest(c.subject, c.inbox, data)
+}
+
+func (c *conformanceConn) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case m := <-c.msgs:
+		return m.Data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *conformanceConn) Close() error {
+	c.nc.Close()
+	return nil
+}
+
+func TestConformance(t *testing.T) {
+	url := runServer(t)
+	var prefix uint64
+	transporttest.Run(t, transporttest.Config{
+		New: func(t *testing.T) transports.Transport {
+			// Each transport uses its own subjects, so the ones left by
+			// previous checks do not take the requests of the queue group.
+			nh := &NATSHandle{SubjectPrefix: fmt.Sprintf("test%d", atomic.AddUint64(&prefix, 1))}
+			if err := nh.Init(&transports.Connection{Address: url}); err != nil {
+				t.Fatal(err)
+			}
+			return nh
+		},
+		Dial: func(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+			nc, err := nats.Connect(url)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c := &conformanceConn{
+				nc:      nc,
+				subject: tr.(*NATSHandle).Subject(namespace),
+				inbox:   nats.NewInbox(),
+				msgs:    make(chan *nats.Msg, 16),
+			}
+			if _, err := nc.ChanSubscribe(c.inbox, c.msgs); err != nil {
+				t.Fatal(err)
+			}
+			return c
+		},
+		Namespace:        "/main",
+		InvalidNamespace: "/main/*",
+	})
+}
+
+// TestQueueGroup checks the requests are spread among the routers of the same queue group
+func TestQueueGroup(t *testing.T) {
+	url := runServer(t)
+	var served [2]int64
+	var subject string
+	for i := range served {
+		i := i
+		nh := new(NATSHandle)
+		if err := nh.Init(&transports.Connection{Address: url}); err != nil {
+			t.Fatal(err)
+		}
+		if err := nh.AddNamespace("/main"); err != nil {
+			t.Fatal(err)
+		}
+		subject = nh.Subject("/main")
+		receiver := make(chan transports.Message)
+		nh.Listen(receiver)
+		go func() {
+			for msg := range receiver {
+				atomic.AddInt64(&served[i], 1)
+				msg.Context.Send(transports.Message{Data: msg.Data, Context: msg.Context})
+			}
+		}()
+	}
+	if subject != "multirpc.main" {
+		t.Fatalf("got subject %s, want multirpc.main", subject)
+	}
+
+	ct, err := client.NewNATSTransport(url, subject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ct.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for i := 0; i < 40; i++ {
+		req := fmt.Sprintf(`{"request":"%d"}`, i)
+		reply, err := ct.Request(ctx, "", []byte(req))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(reply) != req {
+			t.Fatalf("got reply %q, want %q", reply, req)
+		}
+	}
+	if served[0] == 0 || served[1] == 0 || served[0]+served[1] != 40 {
+		t.Fatalf("requests not balanced among the queue group: %v", served)
+	}
+}
+
+func TestCloseDrain(t *testing.T) {
+	url := runServer(t)
+	nh := new(NATSHandle)
+	if err := nh.Init(&transports.Connection{Address: url}); err != nil {
+		t.Fatal(err)
+	}
+	if err := nh.AddNamespace("/main"); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	nh.Listen(receiver)
+
+	nc, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	replies := make(chan *nats.Msg, 1)
+	inbox := nats.NewInbox()
+	if _, err := nc.ChanSubscribe(inbox, replies); err != nil {
+		t.Fatal(err)
+	}
+	if err := nc.PublishRequest(nh.Subject("/main"), inbox, []byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-receiver
+
+	// The reply of the request received before Close is not lost
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	closed := make(chan error, 1)
+	go func() { closed <- nh.Close(ctx) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the in-flight request was replied: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if err := nh.Send(transports.Message{Data: []byte("reply"), Context: msg.Context}); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case m := <-replies:
+		if string(m.Data) != "reply" {
+			t.Fatalf("got reply %q", m.Data)
+		}
+	case <-ctx.Done():
+		t.Fatal("reply lost")
+	}
+}
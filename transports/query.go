@@ -0,0 +1,20 @@
+package transports
+
+import (
+	"net/url"
+	"time"
+)
+
+// QueryContext is implemented by the message contexts of the transports able
+// to receive queries, the requests to a read-only method given by its name and
+// parameters (e.g. HTTP GET /namespace/method?param=value) instead of a
+// message payload
+type QueryContext interface {
+	// Query returns the method and the parameters of the request, ok is
+	// false if the request is not a query
+	Query() (method string, params url.Values, ok bool)
+	// SetCache sets the weak validator of the reply, equal for the replies
+	// with the same content, and the time it can be cached. It is not
+	// cached if maxAge is 0.
+	SetCache(etag string, maxAge time.Duration)
+}
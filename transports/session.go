@@ -0,0 +1,45 @@
+package transports
+
+import "sync"
+
+// Session holds the values shared by the messages received on a long-lived
+// connection, until the connection is closed. It is safe for concurrent use.
+type Session struct {
+	values map[string]interface{}
+	lock   sync.RWMutex
+}
+
+// NewSession returns an empty session
+func NewSession() *Session {
+	return &Session{values: make(map[string]interface{})}
+}
+
+// Set stores a value on the session
+func (s *Session) Set(key string, value interface{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.values[key] = value
+}
+
+// Get returns the value stored for key
+func (s *Session) Get(key string) (interface{}, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	value, ok := s.values[key]
+	return value, ok
+}
+
+// Delete removes the value stored for key
+func (s *Session) Delete(key string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.values, key)
+}
+
+// SessionContext is implemented by the message contexts of the long-lived
+// connections able to keep a session
+type SessionContext interface {
+	// ConnSession returns the session of the connection, or nil if the
+	// message was not received on a long-lived connection
+	ConnSession() *Session
+}
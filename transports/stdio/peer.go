@@ -0,0 +1,178 @@
+package stdio
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports/framing"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// DefaultInboxSize is the default number of undelivered notifications a peer can hold
+	DefaultInboxSize = 64
+	// DefaultExitTimeout is the time the child process has to exit after its
+	// input is closed, before it is killed
+	DefaultExitTimeout = 5 * time.Second
+)
+
+// Peer is the parent side of the stdio transport, it writes the requests to
+// the input of the child and reads the replies from its output. The replies
+// are matched by ID, any other message is delivered to Inbox.
+// Peer implements the client.Transport interface.
+type Peer struct {
+	Inbox       chan []byte
+	ExitTimeout time.Duration
+
+	cmd     *exec.Cmd
+	conn    *framing.Conn
+	pending map[string]chan []byte
+	closed  chan struct{}
+	lock    sync.Mutex
+	once    sync.Once
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+// Spawn starts the command as a child process and returns its peer. The
+// stderr of the child is forwarded to the parent stderr if cmd.Stderr is not set.
+func Spawn(cmd *exec.Cmd, f framing.Framing) (*Peer, error) {
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if cmd.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p := NewPeer(out, in, f)
+	p.cmd = cmd
+	return p, nil
+}
+
+// NewPeer returns a peer talking to a child over the given streams: r is the
+// output of the child and w its input.
+func NewPeer(r io.ReadCloser, w io.WriteCloser, f framing.Framing) *Peer {
+	if f == nil {
+		f = framing.Newline
+	}
+	p := &Peer{
+		Inbox:       make(chan []byte, DefaultInboxSize),
+		ExitTimeout: DefaultExitTimeout,
+		conn:        framing.NewConn(&streams{Reader: r, Writer: w, closers: []io.Closer{w}}, f),
+		pending:     make(map[string]chan []byte),
+		closed:      make(chan struct{}),
+	}
+	go p.read()
+	return p
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (p *Peer) ConnectionType() string {
+	return "Stdio"
+}
+
+// read delivers the messages of the child until its output is closed
+func (p *Peer) read() {
+	defer p.once.Do(func() { close(p.closed) })
+	for {
+		data, err := p.conn.ReadFrame()
+		if err != nil {
+			if err != io.EOF {
+				log.Debugf("cannot read from stdio child: %v", err)
+			}
+			return
+		}
+		var reply struct {
+			ID string `json:"id"`
+		}
+		// Messages which are not JSON are delivered to the Inbox
+		_ = json.Unmarshal(data, &reply)
+		p.lock.Lock()
+		ch, ok := p.pending[reply.ID]
+		delete(p.pending, reply.ID)
+		p.lock.Unlock()
+		if ok {
+			ch <- data
+			continue
+		}
+		select {
+		case p.Inbox <- data:
+		default:
+			log.Debugf("stdio inbox is full, dropping message")
+		}
+	}
+}
+
+// Write sends a raw message to the child without waiting for the reply
+func (p *Peer) Write(data []byte) error {
+	select {
+	case <-p.closed:
+		return fmt.Errorf("stdio child is closed")
+	default:
+	}
+	return p.conn.WriteFrame(data)
+}
+
+// Request sends the request identified by id and waits for its reply
+func (p *Peer) Request(ctx context.Context, id string, data []byte) ([]byte, error) {
+	ch := make(chan []byte, 1)
+	p.lock.Lock()
+	p.pending[id] = ch
+	p.lock.Unlock()
+	defer func() {
+		p.lock.Lock()
+		delete(p.pending, id)
+		p.lock.Unlock()
+	}()
+	if err := p.Write(data); err != nil {
+		return nil, err
+	}
+	select {
+	case reply := <-ch:
+		return reply, nil
+	case <-p.closed:
+		return nil, fmt.Errorf("stdio child closed its output")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Done is closed when the output of the child is closed
+func (p *Peer) Done() <-chan struct{} {
+	return p.closed
+}
+
+// Close closes the input of the child. If the peer was spawned, it waits
+// ExitTimeout for the process to exit before killing it.
+func (p *Peer) Close() error {
+	p.closeOnce.Do(func() {
+		p.closeErr = p.conn.Close()
+		if p.cmd == nil {
+			return
+		}
+		exited := make(chan error, 1)
+		go func() { exited <- p.cmd.Wait() }()
+		select {
+		case p.closeErr = <-exited:
+		case <-time.After(p.ExitTimeout):
+			log.Warnf("stdio child %d did not exit, killing it", p.cmd.Process.Pid)
+			p.cmd.Process.Kill()
+			p.closeErr = <-exited
+		}
+	})
+	return p.closeErr
+}
@@ -0,0 +1,224 @@
+// Package stdio provides a transport serving the router over the standard
+// input and output of the process, so it can run as a child process of
+// other tools (editors, orchestrators, plugins hosts). The messages are the
+// usual RequestMessage and ResponseMessage envelopes, delimited by newlines
+// or by Content-Length headers as the Language Server Protocol does.
+//
+// The child side is StdioHandle, the parent side is Peer. Since stdout
+// carries the messages, the logs of the child must go to stderr (the default
+// of the log package).
+package stdio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/framing"
+	"go.vocdoni.io/dvote/log"
+)
+
+// StdioContext is the MessageContext of the messages read from the standard input
+type StdioContext struct {
+	Conn *framing.Conn
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (c *StdioContext) ConnectionType() string {
+	return "Stdio"
+}
+
+// Send writes the message to the standard output
+func (c *StdioContext) Send(msg transports.Message) error {
+	return c.Conn.WriteFrame(msg.Data)
+}
+
+// StdioHandle serves the router over the process standard input and output.
+// In and Out can be set to serve any other pair of streams.
+type StdioHandle struct {
+	Conn         *transports.Connection
+	Framing      framing.Framing
+	In           io.ReadCloser
+	Out          io.WriteCloser
+	MaxFrameSize int
+
+	conn             *framing.Conn
+	namespace        string
+	internalReceiver chan transports.Message
+	done             chan struct{}
+	closed           chan struct{}
+	closeOnce        sync.Once
+	lock             sync.RWMutex
+}
+
+// NewStdioHandle returns a stdio transport using the given framing
+func NewStdioHandle(f framing.Framing) *StdioHandle {
+	return &StdioHandle{Framing: f}
+}
+
+// Init prepares the transport, the streams are not read until Listen is called
+func (s *StdioHandle) Init(c *transports.Connection) error {
+	if c == nil {
+		c = new(transports.Connection)
+	}
+	if c.Address == "" {
+		c.Address = "stdio"
+	}
+	if s.Framing == nil {
+		s.Framing = framing.Newline
+	}
+	if s.In == nil {
+		s.In = os.Stdin
+	}
+	if s.Out == nil {
+		s.Out = os.Stdout
+	}
+	if s.MaxFrameSize == 0 {
+		s.MaxFrameSize = framing.DefaultMaxFrameSize
+	}
+	s.Conn = c
+	s.conn = framing.NewConn(&streams{Reader: s.In, Writer: s.Out, closers: []io.Closer{s.In, s.Out}}, s.Framing)
+	s.conn.MaxFrameSize = s.MaxFrameSize
+	s.internalReceiver = make(chan transports.Message, 1)
+	s.done = make(chan struct{})
+	s.closed = make(chan struct{})
+	log.Infof("stdio transport ready (%s framing)", s.Framing.Name())
+	return nil
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (s *StdioHandle) ConnectionType() string {
+	return "Stdio"
+}
+
+// Listen reads the requests from the input and writes them into the receiver channel
+func (s *StdioHandle) Listen(receiver chan<- transports.Message) {
+	go func() {
+		for {
+			select {
+			case msg := <-s.internalReceiver:
+				select {
+				case receiver <- msg:
+				case <-s.closed:
+					return
+				}
+			case <-s.closed:
+				return
+			}
+		}
+	}()
+	go s.read()
+}
+
+func (s *StdioHandle) read() {
+	defer close(s.done)
+	for {
+		data, err := s.conn.ReadFrame()
+		if err != nil {
+			if err == io.EOF {
+				log.Infof("stdio input closed")
+			} else {
+				log.Warnf("cannot read from stdio: %v", err)
+			}
+			return
+		}
+		s.lock.RLock()
+		namespace := s.namespace
+		s.lock.RUnlock()
+		select {
+		case s.internalReceiver <- transports.Message{
+			Data:      data,
+			TimeStamp: int32(time.Now().Unix()),
+			Namespace: namespace,
+			Context:   &StdioContext{Conn: s.conn},
+		}:
+		case <-s.closed:
+			return
+		}
+	}
+}
+
+// Done is closed when the input is closed, usually because the parent
+// process exited. A child process should exit then.
+func (s *StdioHandle) Done() <-chan struct{} {
+	return s.done
+}
+
+// Send writes the message to the output. There is a single peer, so the
+// messages without context are written as notifications.
+func (s *StdioHandle) Send(msg transports.Message) error {
+	if msg.Context != nil {
+		sc, ok := msg.Context.(*StdioContext)
+		if !ok {
+			return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+		}
+		return sc.Send(msg)
+	}
+	return s.conn.WriteFrame(msg.Data)
+}
+
+// SendUnicast writes the message to the output, the address is ignored
+func (s *StdioHandle) SendUnicast(address string, msg transports.Message) error {
+	return s.conn.WriteFrame(msg.Data)
+}
+
+// AddNamespace sets the namespace of the received messages. The standard
+// input serves a single namespace.
+func (s *StdioHandle) AddNamespace(namespace string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.namespace != "" && s.namespace != namespace {
+		return fmt.Errorf("stdio transport already serves namespace %s", s.namespace)
+	}
+	s.namespace = namespace
+	return nil
+}
+
+// Address returns the transport address
+func (s *StdioHandle) Address() string {
+	return s.Conn.Address
+}
+
+func (s *StdioHandle) SetBootnodes(bootnodes []string) {
+	// No bootnodes on stdio handler
+}
+
+func (s *StdioHandle) AddPeer(peer string) error {
+	// No peers on stdio handler
+	return nil
+}
+
+// Close stops reading requests and closes the input and output streams
+func (s *StdioHandle) Close(ctx context.Context) error {
+	var err error
+	s.closeOnce.Do(func() {
+		close(s.closed)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+func (s *StdioHandle) String() string {
+	return fmt.Sprintf("%s (%s framing)", s.Conn.Address, s.Framing.Name())
+}
+
+// streams joins a reader and a writer in a single io.ReadWriteCloser
+type streams struct {
+	io.Reader
+	io.Writer
+	closers []io.Closer
+}
+
+func (s *streams) Close() error {
+	var err error
+	for _, c := range s.closers {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,140 @@
+package stdio
+
+import (
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/client"
+	"github.com/vocdoni/multirpc/router"
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/framing"
+	"go.vocdoni.io/dvote/crypto/ethereum"
+)
+
+type testAPI struct {
+	ID        string `json:"request"`
+	Method    string `json:"method,omitempty"`
+	Timestamp int32  `json:"timestamp"`
+	Error     string `json:"error,omitempty"`
+	Reply     string `json:"reply,omitempty"`
+}
+
+func (ta *testAPI) GetID() string        { return ta.ID }
+func (ta *testAPI) SetID(id string)      { ta.ID = id }
+func (ta *testAPI) SetTimestamp(t int32) { ta.Timestamp = t }
+func (ta *testAPI) SetError(e string)    { ta.Error = e }
+func (ta *testAPI) GetMethod() string    { return ta.Method }
+
+func newTestAPI() transports.MessageAPI { return &testAPI{} }
+
+// childEnv makes the test binary run as a stdio child, using the framing of its value
+const childEnv = "MULTIRPC_STDIO_CHILD"
+
+func TestMain(m *testing.M) {
+	if name := os.Getenv(childEnv); name != "" {
+		f, err := framing.ByName(name)
+		if err != nil {
+			panic(err)
+		}
+		runChild(NewStdioHandle(f))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runChild serves a router with a hello method until the input is closed
+func runChild(sh *StdioHandle) {
+	signer := ethereum.NewSignKeys()
+	if err := signer.Generate(); err != nil {
+		panic(err)
+	}
+	if err := sh.Init(nil); err != nil {
+		panic(err)
+	}
+	listener := make(chan transports.Message)
+	sh.Listen(listener)
+	r := router.NewRouter(listener, map[string]transports.Transport{"stdio": sh}, signer, newTestAPI)
+	if err := sh.AddNamespace("/main"); err != nil {
+		panic(err)
+	}
+	hello := func(rr router.RouterRequest) {
+		rr.Send(router.BuildReply(&testAPI{Reply: "hello"}, rr))
+	}
+	if err := r.AddHandler("hello", "/main", hello, false, true); err != nil {
+		panic(err)
+	}
+	go r.Route()
+	<-sh.Done()
+}
+
+func hello(t *testing.T, p *Peer) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c := client.New(p, nil, newTestAPI)
+	for i := 0; i < 3; i++ {
+		resp, err := c.Request(ctx, &testAPI{Method: "hello"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.(*testAPI).Reply; got != "hello" {
+			t.Fatalf("got reply %q, want hello", got)
+		}
+	}
+}
+
+func TestSpawn(t *testing.T) {
+	for _, f := range []framing.Framing{framing.Newline, framing.ContentLength} {
+		f := f
+		t.Run(f.Name(), func(t *testing.T) {
+			cmd := exec.Command(os.Args[0])
+			cmd.Env = append(os.Environ(), childEnv+"="+f.Name())
+			p, err := Spawn(cmd, f)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hello(t, p)
+			// The child exits when its input is closed
+			if err := p.Close(); err != nil {
+				t.Fatalf("child exit: %v", err)
+			}
+			select {
+			case <-p.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("child output not closed")
+			}
+		})
+	}
+}
+
+func TestPipes(t *testing.T) {
+	childIn, parentOut := io.Pipe()
+	parentIn, childOut := io.Pipe()
+	sh := NewStdioHandle(framing.ContentLength)
+	sh.In, sh.Out = childIn, childOut
+	go runChild(sh)
+	p := NewPeer(parentIn, parentOut, framing.ContentLength)
+	hello(t, p)
+
+	// Messages which are not replies go to the Inbox
+	if err := sh.Send(transports.Message{Data: []byte(`{"event":"ready"}`)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case data := <-p.Inbox:
+		if string(data) != `{"event":"ready"}` {
+			t.Fatalf("got notification %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("notification not received")
+	}
+	p.Close()
+	select {
+	case <-sh.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("child input not closed")
+	}
+}
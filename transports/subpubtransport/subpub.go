@@ -3,6 +3,7 @@ package subpubtransport
 import (
 	"context"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/vocdoni/multirpc/subpub"
@@ -23,10 +24,20 @@ func (sc *SubPubContext) Send(msg transports.Message) (err error) {
 	return sc.Sp.SendUnicast(sc.PeerID, msg)
 }
 
+// Peer returns the ID of the peer the message was received from
+func (sc *SubPubContext) Peer() string {
+	return sc.PeerID
+}
+
 type SubPubHandle struct {
 	Conn      *transports.Connection
 	SubPub    *subpub.SubPub
 	BootNodes []string
+
+	closed    chan struct{}
+	closeOnce sync.Once
+	started   bool
+	lock      sync.Mutex // protects started and the closing of closed
 }
 
 func (p *SubPubHandle) Init(c *transports.Connection) error {
@@ -45,21 +56,41 @@ func (p *SubPubHandle) Init(c *transports.Connection) error {
 	sp := subpub.NewSubPub(s.Private, []byte(p.Conn.TransportKey), int32(p.Conn.Port), private)
 	c.Address = sp.PubKey
 	p.SubPub = sp
+	p.closed = make(chan struct{})
 	return nil
 }
 
 func (s *SubPubHandle) Listen(reciever chan<- transports.Message) {
+	s.lock.Lock()
+	select {
+	case <-s.closed:
+		// Closed before listening, the libp2p host is not started
+		s.lock.Unlock()
+		return
+	default:
+	}
 	s.SubPub.Start(context.Background())
+	s.started = true
+	s.lock.Unlock()
 	go s.SubPub.Subscribe(context.Background())
 	go func() {
 		for {
 			var msg transports.Message
-			spmsg := <-s.SubPub.Reader
+			var spmsg *subpub.Message
+			select {
+			case spmsg = <-s.SubPub.Reader:
+			case <-s.closed:
+				return
+			}
 			msg.Data = spmsg.Data
 			msg.TimeStamp = int32(time.Now().Unix())
 			msg.Context = &SubPubContext{PeerID: spmsg.Peer, Sp: s}
 			log.Debugf("received %d bytes from %s", len(msg.Data), spmsg.Peer)
-			reciever <- msg
+			select {
+			case reciever <- msg:
+			case <-s.closed:
+				return
+			}
 		}
 	}()
 }
@@ -80,6 +111,24 @@ func (s *SubPubHandle) String() string {
 	return s.SubPub.String()
 }
 
+// Close stops forwarding the received messages and shuts down the libp2p host
+func (s *SubPubHandle) Close(ctx context.Context) error {
+	var err error
+	s.closeOnce.Do(func() {
+		if s.closed == nil {
+			return
+		}
+		s.lock.Lock()
+		close(s.closed)
+		started := s.started
+		s.lock.Unlock()
+		if started {
+			err = s.SubPub.Close()
+		}
+	})
+	return err
+}
+
 func (s *SubPubHandle) ConnectionType() string {
 	return "SubPub"
 }
@@ -0,0 +1,320 @@
+// Package tcp provides a raw TCP transport using length-prefixed frames
+package tcp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/framing"
+	"go.vocdoni.io/dvote/log"
+)
+
+const (
+	// DefaultKeepAlive is the default TCP keepalive period
+	DefaultKeepAlive = 30 * time.Second
+	// DefaultMaxPipeline is the default maximum number of in-flight requests per connection
+	DefaultMaxPipeline = 64
+	// DefaultReplyTimeout is the default time a request is considered in flight without reply
+	DefaultReplyTimeout = 30 * time.Second
+)
+
+// TCPContext is the MessageContext of the messages received on a TCP connection
+type TCPContext struct {
+	Conn       *framing.Conn
+	ConnID     string
+	RemoteAddr net.Addr
+
+	release func()
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (c *TCPContext) ConnectionType() string {
+	return "TCP"
+}
+
+// Send writes the reply on the connection which sent the request. The
+// replies are written as soon as they are ready, not in the requests order.
+func (c *TCPContext) Send(msg transports.Message) error {
+	if c.release != nil {
+		defer c.release()
+	}
+	return c.Conn.WriteFrame(msg.Data)
+}
+
+// TCPHandle serves the router over raw TCP connections. Each message is
+// prefixed by its length (4 bytes, big endian). Many requests can be in
+// flight on the same connection (up to MaxPipeline), the replies are matched
+// by the client using the message ID. A request not replied after
+// ReplyTimeout no longer counts as in flight, its reply can still be sent.
+type TCPHandle struct {
+	Conn         *transports.Connection
+	TLSConfig    *tls.Config
+	KeepAlive    time.Duration
+	MaxPipeline  int
+	MaxFrameSize int
+	ReplyTimeout time.Duration
+
+	listener         net.Listener
+	namespace        string
+	internalReceiver chan transports.Message
+	clients          map[string]*framing.Conn
+	lastID           uint64
+	closing          bool          // set when Close stops accepting requests
+	closed           chan struct{} // closed when the requests are no longer forwarded
+	closeOnce        sync.Once
+	inflight         sync.WaitGroup
+	lock             sync.RWMutex
+}
+
+// Init starts listening on the Connection Address and Port. If TLSConfig is
+// set, the connections use TLS.
+func (t *TCPHandle) Init(c *transports.Connection) error {
+	if c == nil {
+		c = new(transports.Connection)
+	}
+	if t.KeepAlive == 0 {
+		t.KeepAlive = DefaultKeepAlive
+	}
+	if t.MaxPipeline == 0 {
+		t.MaxPipeline = DefaultMaxPipeline
+	}
+	if t.MaxFrameSize == 0 {
+		t.MaxFrameSize = framing.DefaultMaxFrameSize
+	}
+	if t.ReplyTimeout == 0 {
+		t.ReplyTimeout = DefaultReplyTimeout
+	}
+	lc := net.ListenConfig{KeepAlive: t.KeepAlive}
+	ln, err := lc.Listen(context.Background(), "tcp", fmt.Sprintf("%s:%d", c.Address, c.Port))
+	if err != nil {
+		return err
+	}
+	if t.TLSConfig != nil {
+		ln = tls.NewListener(ln, t.TLSConfig)
+	}
+	t.Conn = c
+	t.listener = ln
+	t.internalReceiver = make(chan transports.Message, 1)
+	t.clients = make(map[string]*framing.Conn)
+	t.closed = make(chan struct{})
+	log.Infof("tcp transport listening on %s (tls:%t)", ln.Addr(), t.TLSConfig != nil)
+	return nil
+}
+
+// ConnectionType returns a string identifying the transport connection type
+func (t *TCPHandle) ConnectionType() string {
+	return "TCP"
+}
+
+// Listen accepts the client connections and writes their requests into the receiver channel
+func (t *TCPHandle) Listen(receiver chan<- transports.Message) {
+	go t.forward(receiver)
+	go t.accept()
+}
+
+// forward writes the requests into the receiver until the handle is closed,
+// after the in-flight requests are drained. The request left is released.
+func (t *TCPHandle) forward(receiver chan<- transports.Message) {
+	for {
+		select {
+		case msg := <-t.internalReceiver:
+			select {
+			case receiver <- msg:
+			case <-t.closed:
+				msg.Context.(*TCPContext).release()
+				return
+			}
+		case <-t.closed:
+			return
+		}
+	}
+}
+
+func (t *TCPHandle) accept() {
+	for {
+		conn, err := t.listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				log.Warnf("tcp accept error: %v", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			log.Debugf("tcp listener closed: %v", err)
+			return
+		}
+		go t.handleConn(conn)
+	}
+}
+
+// handleConn reads the requests of a client until the connection is closed.
+// The reading blocks while the connection has MaxPipeline requests in flight,
+// until one of them is replied or times out.
+func (t *TCPHandle) handleConn(conn net.Conn) {
+	fc := framing.NewConn(conn, framing.LengthPrefixed)
+	fc.MaxFrameSize = t.MaxFrameSize
+	t.lock.Lock()
+	t.lastID++
+	id := fmt.Sprintf("tcp-%d", t.lastID)
+	t.clients[id] = fc
+	t.lock.Unlock()
+	defer func() {
+		t.lock.Lock()
+		delete(t.clients, id)
+		t.lock.Unlock()
+		fc.Close()
+	}()
+	log.Debugf("tcp client %s connected from %s", id, conn.RemoteAddr())
+
+	inflight := make(chan struct{}, t.MaxPipeline)
+	for {
+		data, err := fc.ReadFrame()
+		if err != nil {
+			log.Debugf("tcp client %s disconnected: %v", id, err)
+			return
+		}
+		select {
+		case inflight <- struct{}{}:
+		case <-t.closed:
+			return
+		}
+		t.lock.RLock()
+		namespace := t.namespace
+		if t.closing {
+			// The requests received while closing are dropped
+			t.lock.RUnlock()
+			return
+		}
+		t.inflight.Add(1)
+		t.lock.RUnlock()
+		var once sync.Once
+		free := func() {
+			once.Do(func() {
+				<-inflight
+				t.inflight.Done()
+			})
+		}
+		timer := time.AfterFunc(t.ReplyTimeout, func() {
+			log.Debugf("request of tcp client %s not replied after %s", id, t.ReplyTimeout)
+			free()
+		})
+		release := func() {
+			timer.Stop()
+			free()
+		}
+		select {
+		case t.internalReceiver <- transports.Message{
+			Data:      data,
+			TimeStamp: int32(time.Now().Unix()),
+			Namespace: namespace,
+			Context: &TCPContext{
+				Conn:       fc,
+				ConnID:     id,
+				RemoteAddr: conn.RemoteAddr(),
+				release:    release,
+			},
+		}:
+		case <-t.closed:
+			release()
+			return
+		}
+	}
+}
+
+// Send replies to the client of the message context. If the message has no
+// context, it is sent to all the connected clients.
+func (t *TCPHandle) Send(msg transports.Message) error {
+	if msg.Context != nil {
+		tc, ok := msg.Context.(*TCPContext)
+		if !ok {
+			return fmt.Errorf("cannot send message with context of type %T", msg.Context)
+		}
+		return tc.Send(msg)
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for id, c := range t.clients {
+		if err := c.WriteFrame(msg.Data); err != nil {
+			log.Debugf("cannot send message to tcp client %s: %v", id, err)
+		}
+	}
+	return nil
+}
+
+// SendUnicast sends the message to the client connection identified by address
+func (t *TCPHandle) SendUnicast(address string, msg transports.Message) error {
+	t.lock.RLock()
+	c, ok := t.clients[address]
+	t.lock.RUnlock()
+	if !ok {
+		return fmt.Errorf("no tcp client with address %s", address)
+	}
+	return c.WriteFrame(msg.Data)
+}
+
+// AddNamespace sets the namespace of the received messages. A TCP listener
+// serves a single namespace.
+func (t *TCPHandle) AddNamespace(namespace string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.namespace != "" && t.namespace != namespace {
+		return fmt.Errorf("tcp transport already serves namespace %s", t.namespace)
+	}
+	t.namespace = namespace
+	return nil
+}
+
+// Address returns the listening address
+func (t *TCPHandle) Address() string {
+	return t.listener.Addr().String()
+}
+
+func (t *TCPHandle) SetBootnodes(bootnodes []string) {
+	// No bootnodes on tcp handler
+}
+
+func (t *TCPHandle) AddPeer(peer string) error {
+	// No peers on tcp handler
+	return nil
+}
+
+// Close stops accepting connections, waits until ctx is done for the replies
+// of the in-flight requests and closes the connected clients.
+func (t *TCPHandle) Close(ctx context.Context) error {
+	var err error
+	t.closeOnce.Do(func() {
+		t.lock.Lock()
+		t.closing = true
+		t.lock.Unlock()
+		err = t.listener.Close()
+
+		drained := make(chan struct{})
+		go func() {
+			t.inflight.Wait()
+			close(drained)
+		}()
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+		close(t.closed)
+
+		t.lock.Lock()
+		defer t.lock.Unlock()
+		for _, c := range t.clients {
+			c.Close()
+		}
+	})
+	return err
+}
+
+func (t *TCPHandle) String() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	return fmt.Sprintf("%s clients:%d", t.listener.Addr(), len(t.clients))
+}
@@ -0,0 +1,264 @@
+package tcp
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+	"github.com/vocdoni/multirpc/transports/framing"
+	"github.com/vocdoni/multirpc/transports/transporttest"
+)
+
+type conformanceConn struct {
+	*framing.Conn
+	frames chan []byte
+}
+
+func (c *conformanceConn) Write(ctx context.Context, data []byte) error {
+	return c.WriteFrame(data)
+}
+
+func (c *conformanceConn) Read(ctx context.Context) ([]byte, error) {
+	select {
+	case data, ok := <-c.frames:
+		if !ok {
+			return nil, fmt.Errorf("connection closed")
+		}
+		return data, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func newConformanceConn(conn net.Conn) *conformanceConn {
+	c := &conformanceConn{Conn: framing.NewConn(conn, framing.LengthPrefixed), frames: make(chan []byte, 16)}
+	go func() {
+		defer close(c.frames)
+		for {
+			data, err := c.ReadFrame()
+			if err != nil {
+				return
+			}
+			c.frames <- data
+		}
+	}()
+	return c
+}
+
+// selfSigned returns a server certificate for 127.0.0.1
+func selfSigned(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "multirpc"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("Plain", func(t *testing.T) {
+		transporttest.Run(t, transporttest.Config{
+			New: func(t *testing.T) transports.Transport {
+				th := new(TCPHandle)
+				if err := th.Init(&transports.Connection{Address: "127.0.0.1"}); err != nil {
+					t.Fatal(err)
+				}
+				return th
+			},
+			Dial: func(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+				conn, err := net.Dial("tcp", tr.Address())
+				if err != nil {
+					t.Fatal(err)
+				}
+				return newConformanceConn(conn)
+			},
+			Namespace: "/main",
+		})
+	})
+	t.Run("TLS", func(t *testing.T) {
+		cert := selfSigned(t)
+		transporttest.Run(t, transporttest.Config{
+			New: func(t *testing.T) transports.Transport {
+				th := &TCPHandle{TLSConfig: &tls.Config{Certificates: []tls.Certificate{cert}}}
+				if err := th.Init(&transports.Connection{Address: "127.0.0.1"}); err != nil {
+					t.Fatal(err)
+				}
+				return th
+			},
+			Dial: func(t *testing.T, tr transports.Transport, namespace string) transporttest.Conn {
+				conn, err := tls.Dial("tcp", tr.Address(), &tls.Config{InsecureSkipVerify: true})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return newConformanceConn(conn)
+			},
+			Namespace: "/main",
+		})
+	})
+}
+
+// TestPipelining checks the replies are written as they are ready and not in
+// the requests order.
+func TestPipelining(t *testing.T) {
+	th := new(TCPHandle)
+	if err := th.Init(&transports.Connection{Address: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	th.Listen(receiver)
+	conn, err := net.Dial("tcp", th.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConformanceConn(conn)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, data := range []string{"slow", "fast"} {
+		if err := c.Write(ctx, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var msgs []transports.Message
+	for len(msgs) < 2 {
+		select {
+		case msg := <-receiver:
+			msgs = append(msgs, msg)
+		case <-ctx.Done():
+			t.Fatal("requests not received")
+		}
+	}
+	// Reply to the second request first
+	for i := len(msgs) - 1; i >= 0; i-- {
+		if err := th.Send(transports.Message{Data: msgs[i].Data, Context: msgs[i].Context}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, want := range []string{"fast", "slow"} {
+		data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("got reply %q, want %q", data, want)
+		}
+	}
+}
+
+func TestNoReply(t *testing.T) {
+	th := &TCPHandle{MaxPipeline: 1, ReplyTimeout: 50 * time.Millisecond}
+	if err := th.Init(&transports.Connection{Address: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	th.Listen(receiver)
+	conn, err := net.Dial("tcp", th.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConformanceConn(conn)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// None of the requests is replied, the connection keeps reading once
+	// the pipeline slot of the previous one times out
+	for i := 0; i < 3; i++ {
+		if err := c.Write(ctx, []byte(fmt.Sprintf("request %d", i))); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-receiver:
+		case <-ctx.Done():
+			t.Fatalf("request %d not received", i)
+		}
+	}
+
+	// A request not replied after the timeout does not hold Close
+	if err := c.Write(ctx, []byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	<-receiver
+	if err := th.Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestCloseQueued(t *testing.T) {
+	th := new(TCPHandle)
+	if err := th.Init(&transports.Connection{Address: "127.0.0.1"}); err != nil {
+		t.Fatal(err)
+	}
+	receiver := make(chan transports.Message)
+	th.Listen(receiver)
+	conn, err := net.Dial("tcp", th.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := newConformanceConn(conn)
+	defer c.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// The router is busy with the first request, the second one is queued
+	if err := c.Write(ctx, []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	first := <-receiver
+	if err := c.Write(ctx, []byte("queued")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() { closed <- th.Close(ctx) }()
+	select {
+	case err := <-closed:
+		t.Fatalf("Close returned before the queued request was replied: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	// The queued request is still forwarded while Close drains
+	var queued transports.Message
+	select {
+	case queued = <-receiver:
+	case <-ctx.Done():
+		t.Fatal("queued request dropped on Close")
+	}
+	for _, msg := range []transports.Message{first, queued} {
+		if err := th.Send(transports.Message{Data: msg.Data, Context: msg.Context}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	for _, want := range []string{"first", "queued"} {
+		data, err := c.Read(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Fatalf("got reply %q, want %q", data, want)
+		}
+	}
+}
@@ -1,11 +1,14 @@
 package transports
 
+import "context"
+
 type Transport interface {
 	// Init initializes the transport layer. Takes a struct of options. Not all options must have effect.
 	Init(c *Connection) error
 	// ConnectionType returns the human readable name for the transport layer.
 	ConnectionType() string
 	// Listen starts and keeps listening for new messages, takes a channel where new messages will be written.
+	// Listen must not block, the messages are written to the channel from a background goroutine.
 	Listen(reciever chan<- Message)
 	// Send outputs a new message to the connection of MessageContext.
 	// The package implementing this interface must also implement its own transports.MessageContext.
@@ -24,6 +27,10 @@ type Transport interface {
 	AddPeer(peer string) error
 	// String returns a human readable string representation of the transport state
 	String() string
+	// Close stops listening for new messages, waits for the in-flight requests
+	// until ctx is done and releases the transport resources.
+	// Calling Close more than once must not fail.
+	Close(ctx context.Context) error
 }
 
 type MessageContext interface {
@@ -31,6 +38,13 @@ type MessageContext interface {
 	Send(Message) error
 }
 
+// PeerContext is implemented by the message contexts of the peer to peer
+// transports, whose messages from the same client are told apart by its peer
+type PeerContext interface {
+	// Peer identifies the client the message was received from
+	Peer() string
+}
+
 type MessageAPI interface {
 	GetID() string
 	SetID(string)
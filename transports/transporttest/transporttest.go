@@ -0,0 +1,286 @@
+// Package transporttest provides a conformance test suite for the
+// implementations of transports.Transport.
+//
+// A transport package runs the suite from its tests by providing a Config:
+//
+//	func TestConformance(t *testing.T) {
+//		transporttest.Run(t, transporttest.Config{
+//			New:       newTransport,
+//			Dial:      dialTransport,
+//			Namespace: "/main",
+//		})
+//	}
+package transporttest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/vocdoni/multirpc/transports"
+)
+
+// DefaultTimeout is the default time to wait for a message to be delivered
+const DefaultTimeout = 5 * time.Second
+
+// Conn is a client connection to the transport under test
+type Conn interface {
+	// Write sends a request payload to the transport.
+	Write(ctx context.Context, data []byte) error
+	// Read returns the next message delivered to the client.
+	Read(ctx context.Context) ([]byte, error)
+	// Close closes the client connection.
+	Close() error
+}
+
+// Config describes the transport under test
+type Config struct {
+	// New returns a new transport, already initialized with Init.
+	New func(t *testing.T) transports.Transport
+	// Dial connects a new client to namespace of the transport.
+	Dial func(t *testing.T, tr transports.Transport, namespace string) Conn
+	// Namespace is a valid namespace for the transport.
+	Namespace string
+	// InvalidNamespace is a namespace AddNamespace must reject. If empty, the check is skipped.
+	InvalidNamespace string
+	// IgnoresNamespace must be true if the transport does not set the namespace on the received messages.
+	IgnoresNamespace bool
+	// Concurrency is the number of concurrent clients used on the concurrency checks (default 8).
+	Concurrency int
+	// Timeout is the time to wait for a message to be delivered (default DefaultTimeout).
+	Timeout time.Duration
+}
+
+// Run executes the conformance suite for the transport described by cfg
+func Run(t *testing.T, cfg Config) {
+	if cfg.New == nil || cfg.Dial == nil {
+		t.Fatal("transporttest: Config.New and Config.Dial are required")
+	}
+	if cfg.Concurrency == 0 {
+		cfg.Concurrency = 8
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	t.Run("Identity", func(t *testing.T) { testIdentity(t, cfg) })
+	t.Run("Namespace", func(t *testing.T) { testNamespace(t, cfg) })
+	t.Run("ListenNonBlocking", func(t *testing.T) { testListenNonBlocking(t, cfg) })
+	t.Run("RequestReply", func(t *testing.T) { testRequestReply(t, cfg) })
+	t.Run("TransportSend", func(t *testing.T) { testTransportSend(t, cfg) })
+	t.Run("SendWithoutContext", func(t *testing.T) { testSendWithoutContext(t, cfg) })
+	t.Run("Concurrency", func(t *testing.T) { testConcurrency(t, cfg) })
+	t.Run("Shutdown", func(t *testing.T) { testShutdown(t, cfg) })
+}
+
+// start creates a transport listening on the configured namespace
+func start(t *testing.T, cfg Config) (transports.Transport, chan transports.Message) {
+	t.Helper()
+	tr := cfg.New(t)
+	if err := tr.AddNamespace(cfg.Namespace); err != nil {
+		t.Fatalf("AddNamespace(%q): %v", cfg.Namespace, err)
+	}
+	receiver := make(chan transports.Message)
+	listenReturned := make(chan struct{})
+	go func() {
+		tr.Listen(receiver)
+		close(listenReturned)
+	}()
+	select {
+	case <-listenReturned:
+	case <-time.After(cfg.Timeout):
+		t.Fatal("Listen is blocking")
+	}
+	t.Cleanup(func() { closeTransport(cfg, tr) })
+	return tr, receiver
+}
+
+func closeTransport(cfg Config, tr transports.Transport) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	return tr.Close(ctx)
+}
+
+func receive(t *testing.T, cfg Config, receiver chan transports.Message) transports.Message {
+	t.Helper()
+	select {
+	case msg := <-receiver:
+		return msg
+	case <-time.After(cfg.Timeout):
+		t.Fatal("timeout waiting for a message on the receiver channel")
+	}
+	return transports.Message{}
+}
+
+func read(t *testing.T, cfg Config, conn Conn) []byte {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	data, err := conn.Read(ctx)
+	if err != nil {
+		t.Fatalf("cannot read from client: %v", err)
+	}
+	return bytes.TrimSpace(data)
+}
+
+func write(t *testing.T, cfg Config, conn Conn, data []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+	defer cancel()
+	if err := conn.Write(ctx, data); err != nil {
+		t.Fatalf("cannot write from client: %v", err)
+	}
+}
+
+func testIdentity(t *testing.T, cfg Config) {
+	tr, _ := start(t, cfg)
+	if tr.ConnectionType() == "" {
+		t.Error("ConnectionType is empty")
+	}
+	// None of them must panic
+	_ = tr.Address()
+	_ = tr.String()
+	tr.SetBootnodes(nil)
+}
+
+func testNamespace(t *testing.T, cfg Config) {
+	tr := cfg.New(t)
+	if err := tr.AddNamespace(cfg.Namespace); err != nil {
+		t.Fatalf("AddNamespace(%q): %v", cfg.Namespace, err)
+	}
+	if cfg.InvalidNamespace != "" {
+		if err := tr.AddNamespace(cfg.InvalidNamespace); err == nil {
+			t.Errorf("AddNamespace(%q) must fail", cfg.InvalidNamespace)
+		}
+	}
+	closeTransport(cfg, tr)
+}
+
+func testListenNonBlocking(t *testing.T, cfg Config) {
+	// start fails if Listen does not return
+	start(t, cfg)
+}
+
+func testRequestReply(t *testing.T, cfg Config) {
+	tr, receiver := start(t, cfg)
+	conn := cfg.Dial(t, tr, cfg.Namespace)
+	defer conn.Close()
+
+	write(t, cfg, conn, []byte(`{"request":"ping"}`))
+	msg := receive(t, cfg, receiver)
+	if string(bytes.TrimSpace(msg.Data)) != `{"request":"ping"}` {
+		t.Fatalf("received %q, want the request payload", msg.Data)
+	}
+	if !cfg.IgnoresNamespace && msg.Namespace != cfg.Namespace {
+		t.Errorf("received namespace %q, want %q", msg.Namespace, cfg.Namespace)
+	}
+	if msg.Context == nil {
+		t.Fatal("received message without context")
+	}
+	if msg.Context.ConnectionType() == "" {
+		t.Error("context ConnectionType is empty")
+	}
+	if err := msg.Context.Send(transports.Message{Data: []byte(`{"reply":"pong"}`), Context: msg.Context}); err != nil {
+		t.Fatalf("context Send: %v", err)
+	}
+	if got := read(t, cfg, conn); string(got) != `{"reply":"pong"}` {
+		t.Fatalf("client received %q, want the reply", got)
+	}
+}
+
+func testTransportSend(t *testing.T, cfg Config) {
+	tr, receiver := start(t, cfg)
+	conn := cfg.Dial(t, tr, cfg.Namespace)
+	defer conn.Close()
+
+	write(t, cfg, conn, []byte(`{"request":"ping"}`))
+	msg := receive(t, cfg, receiver)
+	if err := tr.Send(transports.Message{Data: []byte(`{"reply":"pong"}`), Context: msg.Context}); err != nil {
+		t.Fatalf("transport Send: %v", err)
+	}
+	if got := read(t, cfg, conn); string(got) != `{"reply":"pong"}` {
+		t.Fatalf("client received %q, want the reply", got)
+	}
+}
+
+func testSendWithoutContext(t *testing.T, cfg Config) {
+	tr, _ := start(t, cfg)
+	// It might be an error or a broadcast, but it must not panic
+	_ = tr.Send(transports.Message{Data: []byte(`{"reply":"pong"}`), Namespace: cfg.Namespace})
+}
+
+func testConcurrency(t *testing.T, cfg Config) {
+	tr, receiver := start(t, cfg)
+
+	// Echo every request back to its sender
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case msg := <-receiver:
+				go msg.Context.Send(transports.Message{Data: msg.Data, Context: msg.Context})
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	const requests = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, cfg.Concurrency)
+	for i := 0; i < cfg.Concurrency; i++ {
+		conn := cfg.Dial(t, tr, cfg.Namespace)
+		defer conn.Close()
+		wg.Add(1)
+		go func(i int, conn Conn) {
+			defer wg.Done()
+			for j := 0; j < requests; j++ {
+				req := fmt.Sprintf(`{"request":"%d-%d"}`, i, j)
+				ctx, cancel := context.WithTimeout(context.Background(), cfg.Timeout)
+				err := conn.Write(ctx, []byte(req))
+				var data []byte
+				if err == nil {
+					data, err = conn.Read(ctx)
+				}
+				cancel()
+				if err != nil {
+					errs <- fmt.Errorf("client %d request %d: %w", i, j, err)
+					return
+				}
+				if got := string(bytes.TrimSpace(data)); got != req {
+					errs <- fmt.Errorf("client %d received %q, want %q", i, got, req)
+					return
+				}
+			}
+		}(i, conn)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+func testShutdown(t *testing.T, cfg Config) {
+	tr, _ := start(t, cfg)
+	conn := cfg.Dial(t, tr, cfg.Namespace)
+	defer conn.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- closeTransport(cfg, tr) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Close: %v", err)
+		}
+	case <-time.After(cfg.Timeout):
+		t.Fatal("Close is blocking")
+	}
+	// Closing twice must not fail
+	if err := closeTransport(cfg, tr); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}